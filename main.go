@@ -1,21 +1,14 @@
 package main
 
 import (
-    "time"
 	"fmt"
+	"io"
 	"log"
 	"os"
-	"io"
 
 	"github.com/AlexAkulov/clickhouse-backup/pkg/chbackup"
 
 	"github.com/urfave/cli"
-
-	"net/http"
-	"github.com/julienschmidt/httprouter"
-	"github.com/prometheus/client_golang/prometheus"
-    "github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const (
@@ -28,177 +21,52 @@ var (
 	buildDate = "unknown"
 )
 
-var (
-        httpRequestsSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
-                Name: "clickhouse_backup_http_request_duration_seconds",
-                Help: "Execution time of each http request",
-                Buckets: []float64{1,10,30,60,120,240,300,600,1200,2400,3600,7200,14400},
-        },
-        []string{"method", "path", "status"})
-)
-
-func attachConfig(h func(c *cli.Context, w http.ResponseWriter, r *http.Request, ps httprouter.Params) error, c *cli.Context, name string, method string) httprouter.Handle {
-  return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-        start := time.Now()
-        err := h(c, w, r, ps)
-        t := time.Now()
-        elapsed := t.Sub(start)
-
-        fmt.Println(err)
-        if err != nil {
-            str := err.Error()
-            http.Error(w, str, 500)
-            fmt.Println(str)
-            httpRequestsSeconds.With(prometheus.Labels{"status": "500", "method": method, "path": name}).Observe(elapsed.Seconds())
-            return
-        }
-
-        httpRequestsSeconds.With(prometheus.Labels{"status": "200", "method": method, "path": name}).Observe(elapsed.Seconds())
-  	}
-}
-
-func create(c *cli.Context, w http.ResponseWriter, r *http.Request, ps httprouter.Params) error {
-    var backupName = ps.ByName("backupName")
-    return chbackup.CreateBackup(*getConfig(c), backupName, c.String("t"), false)
-}
-
-func restore(c *cli.Context, w http.ResponseWriter, r *http.Request, ps httprouter.Params) error {
-    var backupName = ps.ByName("backupName")
-    return chbackup.Restore(*getConfig(c), backupName, c.String("t"), c.Bool("s"), c.Bool("d"))
-}
-
-func delete(c *cli.Context, w http.ResponseWriter, r *http.Request, ps httprouter.Params) error {
-    var serverType = ps.ByName("serverType")
-    var backupName = ps.ByName("backupName")
-    return deleteBackup(c, serverType, backupName)
-}
-
-func upload(c *cli.Context, w http.ResponseWriter, r *http.Request, ps httprouter.Params) error {
-    var backupName = ps.ByName("backupName")
-    return chbackup.Upload(*getConfig(c), backupName, c.String("diff-from"))
-}
-
-func download(c *cli.Context, w http.ResponseWriter, r *http.Request, ps httprouter.Params) error {
-    var backupName = ps.ByName("backupName")
-    fmt.Println(backupName)
-    return chbackup.Download(*getConfig(c), backupName)
-}
-
-func uploadWithDiff(c *cli.Context, w http.ResponseWriter, r *http.Request, ps httprouter.Params) error {
-    var backupName = ps.ByName("backupName")
-    var diffFrom = ps.ByName("diffFrom")
-    return chbackup.Upload(*getConfig(c), backupName, diffFrom)
-}
-
-func freeze(c *cli.Context, w http.ResponseWriter, r *http.Request, ps httprouter.Params) error {
-    return chbackup.Freeze(*getConfig(c), c.String("t"))
-}
-
-func tables(c *cli.Context, w http.ResponseWriter, r *http.Request, ps httprouter.Params) error {
-    return chbackup.PrintTables(*getConfig(c), w)
-}
-
-func clean(c *cli.Context, w http.ResponseWriter, r *http.Request, ps httprouter.Params) error {
-    return chbackup.Clean(*getConfig(c))
-}
-
-func isClean(c *cli.Context, w http.ResponseWriter, r *http.Request, ps httprouter.Params) error {
-    return chbackup.IsClean(*getConfig(c), w)
-}
-
-func list(c *cli.Context, w http.ResponseWriter, r *http.Request, ps httprouter.Params) error {
-    var serverType = ps.ByName("serverType")
-    var format = ps.ByName("format")
-    return listBackups(c, serverType, format, w)
-}
-
-func listAll(c *cli.Context, w http.ResponseWriter, r *http.Request, ps httprouter.Params) error {
-    var serverType = ps.ByName("serverType")
-    return listBackups(c, serverType, "", w)
-}
-
-func metrics(h http.Handler) httprouter.Handle {
-	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-		h.ServeHTTP(w, r)
+func listBackups(c *cli.Context, serverType string, format string, outputFormat string, w io.Writer) error {
+	config := getConfig(c)
+	switch serverType {
+	case "local":
+		return chbackup.PrintLocalBackups(*config, format, outputFormat, w)
+	case "remote":
+		return chbackup.PrintRemoteBackups(*config, format, outputFormat, w)
+	case "all", "":
+		return chbackup.PrintAllBackups(*config, format, outputFormat, w)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command '%s'\n", serverType)
+		cli.ShowCommandHelpAndExit(c, c.Command.Name, 1)
 	}
-}
-
-func listBackups(c *cli.Context, serverType string, format string, w io.Writer) error {
-    config := getConfig(c)
-    switch serverType {
-    case "local":
-        return chbackup.PrintLocalBackups(*config, format, w)
-    case "remote":
-        return chbackup.PrintRemoteBackups(*config, format, w)
-    case "all", "":
-        fmt.Println("Local backups:")
-        if err := chbackup.PrintLocalBackups(*config, format, w); err != nil {
-            return err
-        }
-        fmt.Println("Remote backups:")
-        if err := chbackup.PrintRemoteBackups(*config, format, w); err != nil {
-            return err
-        }
-    default:
-        fmt.Fprintf(os.Stderr, "Unknown command '%s'\n", serverType)
-        cli.ShowCommandHelpAndExit(c, c.Command.Name, 1)
-    }
-    return nil
+	return nil
 }
 
 func deleteBackup(c *cli.Context, serverType string, backupName string) error {
-    config := getConfig(c)
-    switch serverType {
-    case "local":
-        return chbackup.RemoveBackupLocal(*config, backupName)
-    case "remote":
-        return chbackup.RemoveBackupRemote(*config, backupName)
-    default:
-        fmt.Fprintf(os.Stderr, "Unknown command '%s'\n", serverType)
-        cli.ShowCommandHelpAndExit(c, c.Command.Name, 1)
-    }
-    return nil
-}
-
-func bindGet(router *httprouter.Router, c *cli.Context, name string, h func(c *cli.Context, w http.ResponseWriter, r *http.Request, ps httprouter.Params) error) {
-	// initialise the historgram to 0 count
-	httpRequestsSeconds.With(prometheus.Labels{"status": "200", "method": "GET", "path": name})
-	httpRequestsSeconds.With(prometheus.Labels{"status": "500", "method": "GET", "path": name})
-    router.GET(name, attachConfig(h, c, name, "GET"))
-}
-
-func bindPost(router *httprouter.Router, c *cli.Context, name string, h func(c *cli.Context, w http.ResponseWriter, r *http.Request, ps httprouter.Params) error) {
-	httpRequestsSeconds.With(prometheus.Labels{"status": "200", "method": "POST", "path": name})
-	httpRequestsSeconds.With(prometheus.Labels{"status": "500", "method": "POST", "path": name})
-    router.POST(name, attachConfig(h, c, name, "POST"))
+	config := getConfig(c)
+	switch serverType {
+	case "local":
+		return chbackup.RemoveBackupLocal(*config, backupName)
+	case "remote":
+		return chbackup.RemoveBackupRemote(*config, backupName)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command '%s'\n", serverType)
+		cli.ShowCommandHelpAndExit(c, c.Command.Name, 1)
+	}
+	return nil
 }
 
-func getConfigAndRun(c *cli.Context) error {
-	router := httprouter.New()
-    bindPost(router, c, "/create/:backupName", create)
-    bindPost(router, c, "/upload/:backupName", upload)
-    bindPost(router, c, "/download/:backupName", download)
-    bindPost(router, c, "/upload/:backupName/:diffFrom", uploadWithDiff)
-    bindPost(router, c, "/freeze", freeze)
-    bindGet(router, c, "/tables", tables)
-    bindGet(router, c, "/list/:serverType/:format", list)
-    bindGet(router, c, "/list/:serverType", listAll)
-    bindPost(router, c, "/restore/:backupName", restore)
-    bindPost(router, c, "/delete/:serverType/:backupName", delete)
-    bindPost(router, c, "/clean", clean)
-    bindGet(router, c, "/is-clean", isClean)
-    router.GET("/metrics", metrics(promhttp.Handler()))
-    // todo check for empty shadow dir so we can check that the last backup ran fine, and someone else is not in teh middle of making one
-
-    port := getConfig(c).General.ShardBackupPort
-    return http.ListenAndServe(fmt.Sprintf(":%d", port), router)
+// runLocked - execute mutating command while holding the operation lock
+func runLocked(config *chbackup.Config, operation string, fn func() error) error {
+	lock, err := chbackup.Lock(*config, operation)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	return fn()
 }
 
 func main() {
 
-    log.SetOutput(os.Stdout)
+	log.SetOutput(os.Stdout)
+	chbackup.ToolVersion = version
 
-    cliapp := cli.NewApp()
+	cliapp := cli.NewApp()
 	cliapp.Name = "clickhouse-backup"
 	cliapp.Usage = "Tool for easy backup of ClickHouse with cloud support"
 	cliapp.UsageText = "clickhouse-backup <command> [-t, --tables=<db>.<table>] <backup_name>"
@@ -213,6 +81,15 @@ func main() {
 			EnvVar: "CLICKHOUSE_BACKUP_CONFIG",
 		},
 	}
+	formatFlag := cli.StringFlag{
+		Name:  "format, f",
+		Value: chbackup.OutputFormatText,
+		Usage: "Output format 'text' or 'json'",
+	}
+	clusterFlag := cli.StringFlag{
+		Name:  "cluster",
+		Usage: "Cluster from system.clusters, by default it's 'cluster' option of config",
+	}
 	cliapp.CommandNotFound = func(c *cli.Context, command string) {
 		fmt.Printf("Error. Unknown command: '%s'\n\n", command)
 		cli.ShowAppHelpAndExit(c, 1)
@@ -228,11 +105,11 @@ func main() {
 		{
 			Name:      "tables",
 			Usage:     "Print list of tables",
-			UsageText: "clickhouse-backup tables",
+			UsageText: "clickhouse-backup tables [--format=text|json]",
 			Action: func(c *cli.Context) error {
-				return chbackup.PrintTables(*getConfig(c), os.Stdout)
+				return chbackup.PrintTables(*getConfig(c), c.String("format"), os.Stdout)
 			},
-			Flags: cliapp.Flags,
+			Flags: append(cliapp.Flags, formatFlag),
 		},
 		{
 			Name:        "create",
@@ -240,55 +117,175 @@ func main() {
 			UsageText:   "clickhouse-backup create [-t, --tables=<db>.<table>] <backup_name>",
 			Description: "Create new backup",
 			Action: func(c *cli.Context) error {
-				return chbackup.CreateBackup(*getConfig(c), c.Args().First(), c.String("t"), false)
+				config := getConfig(c)
+				return runLocked(config, "create", func() error {
+					return chbackup.CreateBackup(*config, c.Args().First(), c.String("t"), false)
+				})
+			},
+			Flags: append(cliapp.Flags,
+				cli.StringFlag{
+					Name:   "table, tables, t",
+					Hidden: false,
+				},
+			),
+		},
+		{
+			Name:      "create-remote",
+			Usage:     "Create new backup and upload it to remote storage",
+			UsageText: "clickhouse-backup create-remote [-t, --tables=<db>.<table>] [--diff-from=<backup_name>] <backup_name>",
+			Action: func(c *cli.Context) error {
+				config := getConfig(c)
+				return runLocked(config, "create-remote", func() error {
+					return chbackup.CreateRemote(*config, c.Args().First(), c.String("t"), c.String("diff-from"))
+				})
 			},
 			Flags: append(cliapp.Flags,
 				cli.StringFlag{
 					Name:   "table, tables, t",
 					Hidden: false,
 				},
+				cli.StringFlag{
+					Name:  "diff-from",
+					Usage: "Base of incremental upload, by default it's chosen by create_remote_diff_from",
+				},
 			),
 		},
 		{
 			Name:      "upload",
 			Usage:     "Upload backup to remote storage",
-			UsageText: "clickhouse-backup upload [--diff-from=<backup_name>] <backup_name>",
+			UsageText: "clickhouse-backup upload [--diff-from=<backup_name>] [--resume=false] <backup_name>",
 			Action: func(c *cli.Context) error {
-				return chbackup.Upload(*getConfig(c), c.Args().First(), c.String("diff-from"))
+				config := getConfig(c)
+				return runLocked(config, "upload", func() error {
+					return chbackup.Upload(*config, c.Args().First(), c.String("diff-from"), c.BoolT("resume"))
+				})
 			},
 			Flags: append(cliapp.Flags,
 				cli.StringFlag{
 					Name:   "diff-from",
 					Hidden: false,
+					Usage:  "Base of incremental upload, it's compared by manifest when it isn't stored locally",
+				},
+				cli.BoolTFlag{
+					Name:  "resume",
+					Usage: "Continue interrupted upload of the same backup, use --resume=false to start over",
 				},
 			),
 		},
 		{
 			Name:      "list",
 			Usage:     "Print list of backups",
-			UsageText: "clickhouse-backup list [all|local|remote] [latest|penult]",
+			UsageText: "clickhouse-backup list [--format=text|json] [all|local|remote] [latest|penult]",
 			Action: func(c *cli.Context) error {
-				return listBackups(c, c.Args().Get(0), c.Args().Get(1), os.Stdout)
+				return listBackups(c, c.Args().Get(0), c.Args().Get(1), c.String("format"), os.Stdout)
 			},
-			Flags: cliapp.Flags,
+			Flags: append(cliapp.Flags, formatFlag),
 		},
 		{
 			Name:      "download",
 			Usage:     "Download backup from remote storage",
-			UsageText: "clickhouse-backup download <backup_name>",
+			UsageText: "clickhouse-backup download [-t, --tables=<db>.<table>] [--resume=false] <backup_name>",
 			Action: func(c *cli.Context) error {
-				return chbackup.Download(*getConfig(c), c.Args().First())
+				config := getConfig(c)
+				return runLocked(config, "download", func() error {
+					return chbackup.Download(*config, c.Args().First(), c.String("t"), c.BoolT("resume"))
+				})
 			},
-			Flags: cliapp.Flags,
+			Flags: append(cliapp.Flags,
+				cli.StringFlag{
+					Name:   "table, tables, t",
+					Hidden: false,
+				},
+				cli.BoolTFlag{
+					Name:  "resume",
+					Usage: "Continue interrupted download of the same backup, use --resume=false to remove partially downloaded backup and start over",
+				},
+			),
 		},
 		{
 			Name:      "restore",
 			Usage:     "Create schema and restore data from backup",
 			UsageText: "clickhouse-backup restore [--schema] [--data] [-t, --tables=<db>.<table>] <backup_name>",
 			Action: func(c *cli.Context) error {
-				return chbackup.Restore(*getConfig(c), c.Args().First(), c.String("t"), c.Bool("s"), c.Bool("d"))
+				config := getConfig(c)
+				return runLocked(config, "restore", func() error {
+					return chbackup.Restore(*config, c.Args().First(), c.String("t"), c.Bool("s"), c.Bool("d"))
+				})
+			},
+			Flags: append(cliapp.Flags,
+				cli.StringFlag{
+					Name:   "table, tables, t",
+					Hidden: false,
+				},
+				cli.BoolFlag{
+					Name:   "schema, s",
+					Hidden: false,
+					Usage:  "Restore schema only",
+				},
+				cli.BoolFlag{
+					Name:   "data, d",
+					Hidden: false,
+					Usage:  "Restore data only",
+				},
+			),
+		},
+		{
+			Name:      "restore-remote",
+			Usage:     "Create schema and restore data streaming backup from remote storage",
+			UsageText: "clickhouse-backup restore-remote [--schema] [--data] [-t, --tables=<db>.<table>] <backup_name>",
+			Action: func(c *cli.Context) error {
+				config := getConfig(c)
+				return runLocked(config, "restore-remote", func() error {
+					return chbackup.RestoreRemote(*config, c.Args().First(), c.String("t"), c.Bool("s"), c.Bool("d"))
+				})
+			},
+			Flags: append(cliapp.Flags,
+				cli.StringFlag{
+					Name:   "table, tables, t",
+					Hidden: false,
+				},
+				cli.BoolFlag{
+					Name:   "schema, s",
+					Hidden: false,
+					Usage:  "Restore schema only",
+				},
+				cli.BoolFlag{
+					Name:   "data, d",
+					Hidden: false,
+					Usage:  "Restore data only",
+				},
+			),
+		},
+		{
+			Name:      "cluster-create",
+			Usage:     "Create backup with the same name on one replica of every shard of cluster",
+			UsageText: "clickhouse-backup cluster-create [--cluster=<cluster>] [--local] [-t, --tables=<db>.<table>] [--format=text|json] <backup_name>",
+			Action: func(c *cli.Context) error {
+				return chbackup.ClusterCreate(*getConfig(c), c.String("cluster"), c.Args().First(), c.String("t"), c.Bool("local"), c.String("format"), os.Stdout)
+			},
+			Flags: append(cliapp.Flags,
+				formatFlag,
+				clusterFlag,
+				cli.StringFlag{
+					Name:   "table, tables, t",
+					Hidden: false,
+				},
+				cli.BoolFlag{
+					Name:  "local",
+					Usage: "Run 'create' instead of 'create-remote' on shards, backups are kept locally",
+				},
+			),
+		},
+		{
+			Name:      "cluster-restore",
+			Usage:     "Restore backup with the same name on one replica of every shard of cluster",
+			UsageText: "clickhouse-backup cluster-restore [--cluster=<cluster>] [--local] [--schema] [--data] [-t, --tables=<db>.<table>] [--format=text|json] <backup_name>",
+			Action: func(c *cli.Context) error {
+				return chbackup.ClusterRestore(*getConfig(c), c.String("cluster"), c.Args().First(), c.String("t"), c.Bool("s"), c.Bool("d"), c.Bool("local"), c.String("format"), os.Stdout)
 			},
 			Flags: append(cliapp.Flags,
+				formatFlag,
+				clusterFlag,
 				cli.StringFlag{
 					Name:   "table, tables, t",
 					Hidden: false,
@@ -303,8 +300,21 @@ func main() {
 					Hidden: false,
 					Usage:  "Restore data only",
 				},
+				cli.BoolFlag{
+					Name:  "local",
+					Usage: "Run 'restore' of local backups instead of 'restore-remote' on shards",
+				},
 			),
 		},
+		{
+			Name:      "cluster-list",
+			Usage:     "Print list of backups stored on shards of cluster",
+			UsageText: "clickhouse-backup cluster-list [--cluster=<cluster>] [--format=text|json] [local|remote]",
+			Action: func(c *cli.Context) error {
+				return chbackup.ClusterList(*getConfig(c), c.String("cluster"), c.Args().First(), c.String("format"), os.Stdout)
+			},
+			Flags: append(cliapp.Flags, formatFlag, clusterFlag),
+		},
 		{
 			Name:      "delete",
 			Usage:     "Delete specific backup",
@@ -314,10 +324,46 @@ func main() {
 					fmt.Fprintln(os.Stderr, "Backup name must be defined")
 					cli.ShowCommandHelpAndExit(c, c.Command.Name, 1)
 				}
-				return deleteBackup(c, c.Args().Get(0), c.Args().Get(1))
+				return runLocked(getConfig(c), "delete", func() error {
+					return deleteBackup(c, c.Args().Get(0), c.Args().Get(1))
+				})
 			},
 			Flags: cliapp.Flags,
 		},
+		{
+			Name:      "verify",
+			Usage:     "Check integrity of local or remote backup",
+			UsageText: "clickhouse-backup verify [--format=text|json] <local|remote> <backup_name>",
+			Action: func(c *cli.Context) error {
+				if c.Args().Get(1) == "" {
+					fmt.Fprintln(os.Stderr, "Backup name must be defined")
+					cli.ShowCommandHelpAndExit(c, c.Command.Name, 1)
+				}
+				return chbackup.Verify(*getConfig(c), c.Args().Get(0), c.Args().Get(1), c.String("format"), os.Stdout)
+			},
+			Flags: append(cliapp.Flags, formatFlag),
+		},
+		{
+			Name:      "prune",
+			Usage:     "Delete old backups according to retention policy",
+			UsageText: "clickhouse-backup prune [--dry-run] [--format=text|json] [all|local|remote]",
+			Action: func(c *cli.Context) error {
+				config := getConfig(c)
+				if c.Bool("dry-run") {
+					return chbackup.Prune(*config, c.Args().First(), true, c.String("format"), os.Stdout)
+				}
+				return runLocked(config, "prune", func() error {
+					return chbackup.Prune(*config, c.Args().First(), false, c.String("format"), os.Stdout)
+				})
+			},
+			Flags: append(cliapp.Flags,
+				formatFlag,
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Print what would be deleted and why without deleting",
+				},
+			),
+		},
 		{
 			Name:  "default-config",
 			Usage: "Print default config",
@@ -332,7 +378,10 @@ func main() {
 			UsageText:   "clickhouse-backup freeze [-t, --tables=<db>.<table>] <backup_name>",
 			Description: "Freeze tables",
 			Action: func(c *cli.Context) error {
-				return chbackup.Freeze(*getConfig(c), c.String("t"))
+				config := getConfig(c)
+				return runLocked(config, "freeze", func() error {
+					return chbackup.Freeze(*config, c.String("t"))
+				})
 			},
 			Flags: append(cliapp.Flags,
 				cli.StringFlag{
@@ -345,7 +394,10 @@ func main() {
 			Name:  "clean",
 			Usage: "Remove data in 'shadow' folder",
 			Action: func(c *cli.Context) error {
-				return chbackup.Clean(*getConfig(c))
+				config := getConfig(c)
+				return runLocked(config, "clean", func() error {
+					return chbackup.Clean(*config)
+				})
 			},
 			Flags: cliapp.Flags,
 		},
@@ -353,7 +405,7 @@ func main() {
 			Name:  "isclean",
 			Usage: "Checks if the shadow dir is clean",
 			Action: func(c *cli.Context) error {
-				return chbackup.IsClean(*getConfig(c), os.Stdout)
+				return chbackup.IsClean(*getConfig(c), chbackup.OutputFormatText, os.Stdout)
 			},
 			Flags: cliapp.Flags,
 		},
@@ -0,0 +1,226 @@
+package chbackup
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// ArchiveLayoutSingle - whole backup is uploaded as one archive '<backup_name>.<ext>'
+	ArchiveLayoutSingle = "single"
+	// ArchiveLayoutTable - backup is uploaded as '<backup_name>/metadata.<ext>' and archive per table
+	// '<backup_name>/shadow/<db>/<table>.<ext>', large tables are split to '<backup_name>/shadow/<db>/<table>/<partition>.<ext>'
+	ArchiveLayoutTable = "table"
+)
+
+// matchTablePattern - check that table is matched by comma separated list of patterns like 'db.*,default.table', empty pattern matches all tables
+func matchTablePattern(tablePattern, database, table string) bool {
+	if tablePattern == "" {
+		return true
+	}
+	tableName := fmt.Sprintf("%s.%s", database, table)
+	for _, pattern := range strings.Split(tablePattern, ",") {
+		if matched, _ := filepath.Match(pattern, tableName); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// matchBackupFile - check that file of backup belongs to table matched by tablePattern, files which don't belong to any table are always matched
+func matchBackupFile(name, tablePattern string) bool {
+	if tablePattern == "" {
+		return true
+	}
+	pathParts := strings.Split(name, "/")
+	var database, table string
+	switch {
+	case len(pathParts) == 3 && pathParts[0] == "metadata" && strings.HasSuffix(pathParts[2], ".sql"):
+		database, table = pathParts[1], strings.TrimSuffix(pathParts[2], ".sql")
+	case len(pathParts) > 3 && pathParts[0] == "shadow":
+		database, table = pathParts[1], pathParts[2]
+	default:
+		return true
+	}
+	database, _ = url.PathUnescape(database)
+	table, _ = url.PathUnescape(table)
+	return matchTablePattern(tablePattern, database, table)
+}
+
+// selectArchives - return archives with metadata and archives of tables matched by tablePattern
+func selectArchives(archives []ManifestArchive, tablePattern string) []ManifestArchive {
+	result := []ManifestArchive{}
+	for _, archive := range archives {
+		if archive.Table == "" || matchTablePattern(tablePattern, archive.Database, archive.Table) {
+			result = append(result, archive)
+		}
+	}
+	return result
+}
+
+// archiveGroup - files of local backup which are packed to one archive of 'table' layout
+type archiveGroup struct {
+	ManifestArchive
+	files []string
+	size  int64
+}
+
+func (g *archiveGroup) add(name string, size int64) {
+	g.files = append(g.files, name)
+	g.size += size
+}
+
+// groupBackupFiles - split files of local backup to archive with metadata and archive per table
+// tables larger than splitSize are split to archive per partition, splitSize 0 disables splitting
+func groupBackupFiles(backupPath string, manifest *BackupManifest, splitSize int64, extension string) ([]*archiveGroup, error) {
+	// partition of every part is taken from manifest, it's not always a prefix of part name
+	partitions := map[string]string{}
+	if manifest != nil {
+		for _, table := range manifest.Tables {
+			for _, part := range table.Parts {
+				if len(part.Files) > 0 {
+					if pathParts := strings.SplitN(part.Files[0].Name, "/", 5); len(pathParts) == 5 {
+						partitions[path.Join(pathParts[:4]...)] = part.Partition
+					}
+				}
+			}
+		}
+	}
+	type tableFile struct {
+		name      string
+		partition string
+		size      int64
+	}
+	metadata := &archiveGroup{ManifestArchive: ManifestArchive{Name: "metadata." + extension}, files: []string{}}
+	tables := map[string][]tableFile{}
+	if err := filepath.Walk(backupPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		relativePath := strings.TrimPrefix(strings.TrimPrefix(filePath, backupPath), "/")
+		if relativePath == ManifestFileName {
+			return nil
+		}
+		pathParts := strings.SplitN(relativePath, "/", 5)
+		if len(pathParts) != 5 || pathParts[0] != "shadow" {
+			metadata.add(relativePath, info.Size())
+			return nil
+		}
+		partition, ok := partitions[path.Join(pathParts[:4]...)]
+		if !ok {
+			partition = partitionFromPartName(pathParts[3])
+		}
+		tableKey := path.Join(pathParts[:3]...)
+		tables[tableKey] = append(tables[tableKey], tableFile{name: relativePath, partition: partition, size: info.Size()})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	tableKeys := []string{}
+	for tableKey := range tables {
+		tableKeys = append(tableKeys, tableKey)
+	}
+	sort.Strings(tableKeys)
+	result := []*archiveGroup{metadata}
+	for _, tableKey := range tableKeys {
+		pathParts := strings.Split(tableKey, "/")
+		database, _ := url.PathUnescape(pathParts[1])
+		table, _ := url.PathUnescape(pathParts[2])
+		var tableSize int64
+		for _, file := range tables[tableKey] {
+			tableSize += file.size
+		}
+		if splitSize == 0 || tableSize <= splitSize {
+			group := &archiveGroup{ManifestArchive: ManifestArchive{
+				Name:     fmt.Sprintf("%s.%s", tableKey, extension),
+				Database: database,
+				Table:    table,
+			}}
+			for _, file := range tables[tableKey] {
+				group.add(file.name, file.size)
+			}
+			result = append(result, group)
+			continue
+		}
+		groups := map[string]*archiveGroup{}
+		for _, file := range tables[tableKey] {
+			group, ok := groups[file.partition]
+			if !ok {
+				group = &archiveGroup{ManifestArchive: ManifestArchive{
+					Name:      fmt.Sprintf("%s/%s.%s", tableKey, file.partition, extension),
+					Database:  database,
+					Table:     table,
+					Partition: file.partition,
+				}}
+				groups[file.partition] = group
+			}
+			group.add(file.name, file.size)
+		}
+		partitionGroups := []*archiveGroup{}
+		for _, group := range groups {
+			partitionGroups = append(partitionGroups, group)
+		}
+		sort.Slice(partitionGroups, func(i, j int) bool { return partitionGroups[i].Name < partitionGroups[j].Name })
+		result = append(result, partitionGroups...)
+	}
+	return result, nil
+}
+
+// tableArchivesUpload - upload local backup with 'table' archive_layout and return archives for manifest
+// archives are uploaded by upload_concurrency workers, archives uploaded by previous failed attempt of the same upload are skipped
+// and interrupted multipart uploads are continued
+func (bd *BackupDestination) tableArchivesUpload(localPath, remotePath string, base *diffBase, manifest *BackupManifest, splitSize int64) ([]ManifestArchive, error) {
+	groups, err := groupBackupFiles(localPath, manifest, splitSize, getExtension(bd.compressionFormat))
+	if err != nil {
+		return nil, err
+	}
+	state := &uploadState{
+		Destination:       fmt.Sprintf("%s:%s", bd.Kind(), path.Join(bd.path, remotePath)),
+		CreationDate:      manifest.CreationDate,
+		CompressionFormat: bd.compressionFormat,
+		Encryption:        bd.encryption.info(),
+		RequiredBackup:    base.backupName(),
+	}
+	bd.resumeUpload(localPath, state)
+	uploaded := map[string]bool{}
+	for _, name := range state.Archives {
+		uploaded[name] = true
+	}
+
+	var totalBytes int64
+	for _, group := range groups {
+		if !uploaded[group.Name] {
+			totalBytes += group.size
+		}
+	}
+	bar := StartNewByteBar(!bd.disableProgressBar, totalBytes)
+	archives := []ManifestArchive{}
+	pending := []*archiveGroup{}
+	for _, group := range groups {
+		archives = append(archives, group.ManifestArchive)
+		if !uploaded[group.Name] {
+			pending = append(pending, group)
+		}
+	}
+	if err := runParallel(bd.uploadConcurrency, len(pending), func(i int, cancel <-chan struct{}) error {
+		group := pending[i]
+		key := path.Join(bd.path, remotePath, group.Name)
+		if err := bd.putArchive(key, localPath, group.files, base, state.multipart(key), bar, cancel); err != nil {
+			return fmt.Errorf("can't upload '%s' with %v", group.Name, err)
+		}
+		return state.uploaded(group.Name, key)
+	}); err != nil {
+		return nil, err
+	}
+	bar.Finish()
+	return archives, nil
+}
@@ -0,0 +1,205 @@
+package chbackup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchBackupFile(t *testing.T) {
+	assert.True(t, matchBackupFile("shadow/db/t2/all_1_1_0/data.bin", ""))
+	assert.True(t, matchBackupFile("shadow/db/t1/all_1_1_0/data.bin", "db.t1"))
+	assert.False(t, matchBackupFile("shadow/db/t2/all_1_1_0/data.bin", "db.t1"))
+	assert.True(t, matchBackupFile("metadata/db/t1.sql", "db.*"))
+	assert.False(t, matchBackupFile("metadata/db/t2.sql", "other.*,db.t1"))
+	assert.True(t, matchBackupFile("metadata/my%2Ddb/t.sql", "my-db.t"))
+	assert.True(t, matchBackupFile("metadata/db.sql", "db.t1"))
+}
+
+// createTestBackup - create local backup with manifest, table db.t2 has two partitions
+func createTestBackup(t *testing.T, backupPath string) *BackupManifest {
+	files := map[string]string{
+		"metadata/db/t1.sql":                  "ATTACH TABLE t1",
+		"metadata/db/t2.sql":                  "ATTACH TABLE t2",
+		"shadow/db/t1/all_1_1_0/data.bin":     "t1 data",
+		"shadow/db/t2/2020_1_1_0/data.bin":    "t2 data of 2020",
+		"shadow/db/t2/2021_2_2_0/data.bin":    "t2 data of 2021",
+		"shadow/db/t2/2021_2_2_0/columns.txt": "columns",
+	}
+	manifestFiles := map[string]ManifestFile{}
+	for name, content := range files {
+		filePath := filepath.Join(backupPath, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(filePath), os.ModePerm))
+		require.NoError(t, ioutil.WriteFile(filePath, []byte(content), 0640))
+		file, err := getManifestFile(backupPath, filePath)
+		require.NoError(t, err)
+		manifestFiles[name] = file
+	}
+	manifest := &BackupManifest{
+		Version:      ManifestVersion,
+		BackupName:   filepath.Base(backupPath),
+		CreationDate: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		Tables: []ManifestTable{
+			{
+				Database:   "db",
+				Name:       "t1",
+				Metadata:   &ManifestFile{Name: "metadata/db/t1.sql", Size: manifestFiles["metadata/db/t1.sql"].Size, Checksum: manifestFiles["metadata/db/t1.sql"].Checksum},
+				Partitions: []string{"all"},
+				Parts: []ManifestPart{
+					{Name: "all_1_1_0", Partition: "all", Files: []ManifestFile{manifestFiles["shadow/db/t1/all_1_1_0/data.bin"]}},
+				},
+			},
+			{
+				Database:   "db",
+				Name:       "t2",
+				Metadata:   &ManifestFile{Name: "metadata/db/t2.sql", Size: manifestFiles["metadata/db/t2.sql"].Size, Checksum: manifestFiles["metadata/db/t2.sql"].Checksum},
+				Partitions: []string{"2020", "2021"},
+				Parts: []ManifestPart{
+					{Name: "2020_1_1_0", Partition: "2020", Files: []ManifestFile{manifestFiles["shadow/db/t2/2020_1_1_0/data.bin"]}},
+					{Name: "2021_2_2_0", Partition: "2021", Files: []ManifestFile{
+						manifestFiles["shadow/db/t2/2021_2_2_0/columns.txt"],
+						manifestFiles["shadow/db/t2/2021_2_2_0/data.bin"],
+					}},
+				},
+			},
+		},
+	}
+	require.NoError(t, writeLocalManifest(backupPath, manifest))
+	return manifest
+}
+
+func TestGroupBackupFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clickhouse-backup-archives")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	manifest := createTestBackup(t, dir)
+
+	groups, err := groupBackupFiles(dir, manifest, 0, "tar.gz")
+	require.NoError(t, err)
+	names := []string{}
+	for _, group := range groups {
+		names = append(names, group.Name)
+	}
+	assert.Equal(t, []string{"metadata.tar.gz", "shadow/db/t1.tar.gz", "shadow/db/t2.tar.gz"}, names)
+	assert.ElementsMatch(t, []string{"metadata/db/t1.sql", "metadata/db/t2.sql"}, groups[0].files)
+	assert.Equal(t, "t2", groups[2].Table)
+	assert.Len(t, groups[2].files, 3)
+
+	groups, err = groupBackupFiles(dir, manifest, 10, "tar.gz")
+	require.NoError(t, err)
+	require.Len(t, groups, 4)
+	assert.Equal(t, "shadow/db/t1.tar.gz", groups[1].Name)
+	assert.Equal(t, ManifestArchive{Name: "shadow/db/t2/2020.tar.gz", Database: "db", Table: "t2", Partition: "2020"}, groups[2].ManifestArchive)
+	assert.Equal(t, "shadow/db/t2/2021.tar.gz", groups[3].Name)
+	assert.Len(t, groups[3].files, 2)
+}
+
+func TestTableArchiveLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clickhouse-backup-archives")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "remote")
+	require.NoError(t, os.MkdirAll(root, os.ModePerm))
+	backupPath := filepath.Join(dir, "data", "backup", "backup")
+	createTestBackup(t, backupPath)
+
+	config := DefaultConfig()
+	config.ClickHouse.DataPath = filepath.Join(dir, "data")
+	config.General.RemoteStorage = "fs"
+	config.General.DisableProgressBar = true
+	config.General.ArchiveLayout = ArchiveLayoutTable
+	config.General.ArchiveSplitSize = 10
+	config.General.UploadConcurrency = 3
+	config.General.DownloadConcurrency = 3
+	config.FS.RootPath = root
+	require.NoError(t, Upload(*config, "backup", "", true))
+	for _, name := range []string{"manifest.json", "metadata.tar.gz", "shadow/db/t1.tar.gz", "shadow/db/t2/2020.tar.gz", "shadow/db/t2/2021.tar.gz"} {
+		_, err := os.Stat(filepath.Join(root, "backup", name))
+		assert.NoError(t, err, name)
+	}
+	_, err = os.Stat(backupPath + uploadStateSuffix)
+	assert.True(t, os.IsNotExist(err))
+
+	backups, err := ListRemoteBackups(*config)
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+	assert.Equal(t, "backup", backups[0].Name)
+	assert.Equal(t, "gzip", backups[0].CompressionFormat)
+	assert.Equal(t, 2, backups[0].Tables)
+	assert.True(t, backups[0].Size > 0)
+
+	result, err := VerifyRemote(*config, "backup")
+	require.NoError(t, err)
+	assert.True(t, result.OK(), result.Error())
+
+	config.ClickHouse.DataPath = filepath.Join(dir, "download")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "download", "backup"), os.ModePerm))
+	require.NoError(t, Download(*config, "backup", "db.t1", true))
+	downloadPath := filepath.Join(dir, "download", "backup", "backup")
+	content, err := ioutil.ReadFile(filepath.Join(downloadPath, "shadow", "db", "t1", "all_1_1_0", "data.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, "t1 data", string(content))
+	_, err = os.Stat(filepath.Join(downloadPath, "metadata", "db", "t1.sql"))
+	assert.NoError(t, err)
+	for _, name := range []string{"metadata/db/t2.sql", "shadow/db/t2"} {
+		_, err = os.Stat(filepath.Join(downloadPath, name))
+		assert.True(t, os.IsNotExist(err), name)
+	}
+	manifest, err := readLocalManifest(downloadPath)
+	require.NoError(t, err)
+	require.Len(t, manifest.Tables, 1)
+	assert.Equal(t, "t1", manifest.Tables[0].Name)
+	assert.Len(t, manifest.Archives, 2)
+	result, err = VerifyLocal(*config, "backup")
+	require.NoError(t, err)
+	assert.True(t, result.OK(), result.Error())
+}
+
+func TestTableArchivesUploadResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clickhouse-backup-archives")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "remote")
+	require.NoError(t, os.MkdirAll(root, os.ModePerm))
+	backupPath := filepath.Join(dir, "backup")
+	manifest := createTestBackup(t, backupPath)
+
+	config := DefaultConfig()
+	config.General.RemoteStorage = "fs"
+	config.General.DisableProgressBar = true
+	config.FS.RootPath = root
+	bd, err := NewBackupDestination(*config)
+	require.NoError(t, err)
+	require.NoError(t, bd.Connect())
+
+	// previous attempt uploaded metadata only
+	require.NoError(t, writeUploadState(backupPath, &uploadState{
+		Destination:       "FS:backup",
+		CreationDate:      manifest.CreationDate,
+		CompressionFormat: "gzip",
+		Archives:          []string{"metadata.tar.gz"},
+	}))
+	archives, err := bd.tableArchivesUpload(backupPath, "backup", nil, manifest, 0)
+	require.NoError(t, err)
+	assert.Len(t, archives, 3)
+	_, err = os.Stat(filepath.Join(root, "backup", "metadata.tar.gz"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(root, "backup", "shadow", "db", "t2.tar.gz"))
+	assert.NoError(t, err)
+	state, err := readUploadState(backupPath)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"metadata.tar.gz", "shadow/db/t1.tar.gz", "shadow/db/t2.tar.gz"}, state.Archives)
+
+	// state of other backup with the same name is ignored
+	state.CreationDate = state.CreationDate.Add(time.Hour)
+	require.NoError(t, writeUploadState(backupPath, state))
+	_, err = bd.tableArchivesUpload(backupPath, "backup", nil, manifest, 0)
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(root, "backup", "metadata.tar.gz"))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,195 @@
+package chbackup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// AzureBlob - presents methods for manipulate data on Azure Blob Storage
+type AzureBlob struct {
+	container azblob.ContainerURL
+	Config    *AzureBlobConfig
+}
+
+// parseAzureConnectionString - read settings from connection string like
+// 'DefaultEndpointsProtocol=https;AccountName=name;AccountKey=key;EndpointSuffix=core.windows.net'
+// values from connection string override values from config
+func parseAzureConnectionString(connectionString string, config *AzureBlobConfig) error {
+	protocol := "https"
+	for _, part := range strings.Split(connectionString, ";") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("bad azblob connection_string part '%s'", part)
+		}
+		switch kv[0] {
+		case "DefaultEndpointsProtocol":
+			protocol = kv[1]
+		case "AccountName":
+			config.AccountName = kv[1]
+		case "AccountKey":
+			config.AccountKey = kv[1]
+		case "EndpointSuffix":
+			config.EndpointSuffix = kv[1]
+		case "BlobEndpoint":
+			config.Endpoint = kv[1]
+		case "SharedAccessSignature":
+			config.SharedAccessSignature = kv[1]
+		}
+	}
+	if config.Endpoint == "" && config.AccountName != "" {
+		config.Endpoint = fmt.Sprintf("%s://%s.blob.%s", protocol, config.AccountName, config.EndpointSuffix)
+	}
+	return nil
+}
+
+// Connect - connect to Azure Blob Storage and check that container exists
+func (a *AzureBlob) Connect() error {
+	config := *a.Config
+	if config.ConnectionString != "" {
+		if err := parseAzureConnectionString(config.ConnectionString, &config); err != nil {
+			return err
+		}
+	}
+	endpoint := config.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.%s", config.AccountName, config.EndpointSuffix)
+	}
+	serviceURL, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("can't parse azblob endpoint with %v", err)
+	}
+	var credential azblob.Credential
+	switch {
+	case config.AccountKey != "":
+		credential, err = azblob.NewSharedKeyCredential(config.AccountName, config.AccountKey)
+		if err != nil {
+			return fmt.Errorf("can't use azblob account_key with %v", err)
+		}
+	case config.SharedAccessSignature != "":
+		credential = azblob.NewAnonymousCredential()
+		serviceURL.RawQuery = strings.TrimPrefix(config.SharedAccessSignature, "?")
+	default:
+		return fmt.Errorf("azblob account_key, sas or connection_string must be set")
+	}
+	timeout, err := time.ParseDuration(config.Timeout)
+	if err != nil {
+		return err
+	}
+	pipeline := azblob.NewPipeline(credential, azblob.PipelineOptions{
+		Retry: azblob.RetryOptions{TryTimeout: timeout},
+	})
+	a.container = azblob.NewServiceURL(*serviceURL, pipeline).NewContainerURL(config.Container)
+	_, err = a.container.GetProperties(context.Background(), azblob.LeaseAccessConditions{})
+	return err
+}
+
+func (a *AzureBlob) Kind() string {
+	return "AzureBlob"
+}
+
+func isAzureNotFound(err error) bool {
+	storageErr, ok := err.(azblob.StorageError)
+	return ok && storageErr.Response() != nil && storageErr.Response().StatusCode == http.StatusNotFound
+}
+
+func (a *AzureBlob) GetFile(key string) (RemoteFile, error) {
+	properties, err := a.container.NewBlobURL(key).GetProperties(context.Background(), azblob.BlobAccessConditions{})
+	if err != nil {
+		if isAzureNotFound(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &azureBlobFile{
+		name:         key,
+		size:         properties.ContentLength(),
+		lastModified: properties.LastModified(),
+	}, nil
+}
+
+func (a *AzureBlob) DeleteFile(key string) error {
+	_, err := a.container.NewBlobURL(key).Delete(context.Background(), azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{})
+	return err
+}
+
+func (a *AzureBlob) Walk(azPath string, process func(RemoteFile)) error {
+	prefix := strings.TrimPrefix(azPath, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	ctx := context.Background()
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		page, err := a.container.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{Prefix: prefix})
+		if err != nil {
+			return err
+		}
+		for _, blob := range page.Segment.BlobItems {
+			var size int64
+			if blob.Properties.ContentLength != nil {
+				size = *blob.Properties.ContentLength
+			}
+			process(&azureBlobFile{
+				name:         blob.Name,
+				size:         size,
+				lastModified: blob.Properties.LastModified,
+			})
+		}
+		marker = page.NextMarker
+	}
+	return nil
+}
+
+func (a *AzureBlob) GetFileReader(key string) (io.ReadCloser, error) {
+	resp, err := a.container.NewBlobURL(key).Download(context.Background(), 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body(azblob.RetryReaderOptions{MaxRetryRequests: 3}), nil
+}
+
+// GetFileReaderWithOffset - download blob starting from offset
+func (a *AzureBlob) GetFileReaderWithOffset(key string, offset int64) (io.ReadCloser, error) {
+	resp, err := a.container.NewBlobURL(key).Download(context.Background(), offset, azblob.CountToEnd, azblob.BlobAccessConditions{}, false)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body(azblob.RetryReaderOptions{MaxRetryRequests: 3}), nil
+}
+
+// PutFile - upload stream as block blob, blocks of block_size are uploaded by max_buffers in parallel
+func (a *AzureBlob) PutFile(key string, r io.ReadCloser) error {
+	defer r.Close()
+	_, err := azblob.UploadStreamToBlockBlob(context.Background(), r, a.container.NewBlockBlobURL(key), azblob.UploadStreamToBlockBlobOptions{
+		BufferSize: a.Config.BlockSize,
+		MaxBuffers: a.Config.MaxBuffers,
+	})
+	return err
+}
+
+type azureBlobFile struct {
+	size         int64
+	lastModified time.Time
+	name         string
+}
+
+func (f *azureBlobFile) Size() int64 {
+	return f.size
+}
+
+func (f *azureBlobFile) Name() string {
+	return f.name
+}
+
+func (f *azureBlobFile) LastModified() time.Time {
+	return f.lastModified
+}
@@ -0,0 +1,22 @@
+package chbackup
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAzureConnectionString(t *testing.T) {
+	config := DefaultConfig().AzureBlob
+	assert.NoError(t, parseAzureConnectionString("DefaultEndpointsProtocol=https;AccountName=backup;AccountKey=a2V5==;EndpointSuffix=core.chinacloudapi.cn", &config))
+	assert.Equal(t, "backup", config.AccountName)
+	assert.Equal(t, "a2V5==", config.AccountKey)
+	assert.Equal(t, "https://backup.blob.core.chinacloudapi.cn", config.Endpoint)
+
+	config = DefaultConfig().AzureBlob
+	assert.NoError(t, parseAzureConnectionString("BlobEndpoint=http://127.0.0.1:10000/devstoreaccount1;SharedAccessSignature=sv=2019-02-02&sig=abc", &config))
+	assert.Equal(t, "http://127.0.0.1:10000/devstoreaccount1", config.Endpoint)
+	assert.Equal(t, "sv=2019-02-02&sig=abc", config.SharedAccessSignature)
+
+	assert.Error(t, parseAzureConnectionString("AccountName", &config))
+}
@@ -86,6 +86,26 @@ func parseTablePatternForRestoreData(tables map[string]BackupTable, tablePattern
 	return result
 }
 
+// walkMetadata - walk metadata directory, directories of Atomic databases are symlinks to 'store' and are walked as if they were in metadataPath
+func walkMetadata(metadataPath string, walkFn filepath.WalkFunc) error {
+	return filepath.Walk(metadataPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			return walkFn(filePath, info, err)
+		}
+		target, err := filepath.EvalSymlinks(filePath)
+		if err != nil {
+			return walkFn(filePath, info, err)
+		}
+		targetInfo, err := os.Stat(target)
+		if err != nil || !targetInfo.IsDir() {
+			return walkFn(filePath, targetInfo, err)
+		}
+		return filepath.Walk(target, func(targetPath string, info os.FileInfo, err error) error {
+			return walkFn(filepath.Join(filePath, strings.TrimPrefix(targetPath, target)), info, err)
+		})
+	})
+}
+
 func parseSchemaPattern(metadataPath string, tablePattern string) (RestoreTables, error) {
 	regularTables := RestoreTables{}
 	distributedTables := RestoreTables{}
@@ -94,7 +114,23 @@ func parseSchemaPattern(metadataPath string, tablePattern string) (RestoreTables
 	if tablePattern != "" {
 		tablePatterns = strings.Split(tablePattern, ",")
 	}
-	if err := filepath.Walk(metadataPath, func(filePath string, info os.FileInfo, err error) error {
+	// metadata files of databases, missing in backups created by old versions
+	databaseQueries := map[string]string{}
+	databaseQuery := func(databaseDir, database string) (string, error) {
+		if query, ok := databaseQueries[databaseDir]; ok {
+			return query, nil
+		}
+		data, err := ioutil.ReadFile(filepath.Join(metadataPath, databaseDir+".sql"))
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		databaseQueries[databaseDir] = createDatabaseQuery(string(data), database)
+		return databaseQueries[databaseDir], nil
+	}
+	if err := walkMetadata(metadataPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
 		if !strings.HasSuffix(filePath, ".sql") || !info.Mode().IsRegular() {
 			return nil
 		}
@@ -113,11 +149,16 @@ func parseSchemaPattern(metadataPath string, tablePattern string) (RestoreTables
 				if err != nil {
 					return err
 				}
+				query, err := databaseQuery(parts[0], database)
+				if err != nil {
+					return err
+				}
 				restoreTable := RestoreTable{
-					Database: database,
-					Table:    table,
-					Query:    strings.Replace(string(data), "ATTACH", "CREATE", 1),
-					Path:     filePath,
+					Database:      database,
+					Table:         table,
+					Query:         createQuery(string(data), database, table),
+					Path:          filePath,
+					DatabaseQuery: query,
 				}
 				if strings.Contains(restoreTable.Query, "ENGINE = Distributed") {
 					distributedTables = addRestoreTable(distributedTables, restoreTable)
@@ -145,7 +186,10 @@ func parseSchemaPattern(metadataPath string, tablePattern string) (RestoreTables
 }
 
 // PrintTables - print all tables suitable for backup
-func PrintTables(config Config, w io.Writer) error {
+func PrintTables(config Config, outputFormat string, w io.Writer) error {
+	if err := ValidateOutputFormat(outputFormat); err != nil {
+		return err
+	}
 	ch := &ClickHouse{
 		Config: &config.ClickHouse,
 	}
@@ -159,6 +203,9 @@ func PrintTables(config Config, w io.Writer) error {
 	if err != nil {
 		return fmt.Errorf("can't get tables with: %v", err)
 	}
+	if outputFormat == OutputFormatJSON {
+		return printJSON(w, allTables)
+	}
 	for _, table := range allTables {
 		if table.Skip {
 			fmt.Fprintf(w, "%s.%s\t(ignored)\n", table.Database, table.Name)
@@ -172,7 +219,7 @@ func PrintTables(config Config, w io.Writer) error {
 func restoreSchema(config Config, backupName string, tablePattern string) error {
 	if backupName == "" {
 		fmt.Println("Select backup for restore:")
-		PrintLocalBackups(config, "all", os.Stdout)
+		PrintLocalBackups(config, "all", OutputFormatText, os.Stdout)
 		os.Exit(1)
 	}
 	dataPath := getDataPath(config)
@@ -202,8 +249,13 @@ func restoreSchema(config Config, backupName string, tablePattern string) error
 	}
 	defer ch.Close()
 
+	return createSchemas(ch, tablesForRestore)
+}
+
+// createSchemas - create databases and tables in order returned by parseSchemaPattern
+func createSchemas(ch *ClickHouse, tablesForRestore RestoreTables) error {
 	for _, schema := range tablesForRestore {
-		if err := ch.CreateDatabase(schema.Database); err != nil {
+		if err := ch.CreateDatabase(schema.Database, schema.DatabaseQuery); err != nil {
 			return fmt.Errorf("can't create database `%s` %v", schema.Database, err)
 		}
 		if err := ch.CreateTable(schema); err != nil {
@@ -213,23 +265,42 @@ func restoreSchema(config Config, backupName string, tablePattern string) error
 	return nil
 }
 
-func printBackups(backupList []Backup, format string, printSize bool, w io.Writer) error {
+// selectBackups - return backups chosen by format: 'latest', 'penult' or 'all'
+func selectBackups(backupList []Backup, format string) ([]Backup, error) {
 	switch format {
 	case "latest", "last", "l":
 		if len(backupList) < 1 {
-			return fmt.Errorf("no backups found")
+			return nil, fmt.Errorf("no backups found")
 		}
-		fmt.Fprintln(w, backupList[len(backupList)-1].Name)
+		return backupList[len(backupList)-1:], nil
 	case "penult", "prev", "previous", "p":
 		if len(backupList) < 2 {
-			return fmt.Errorf("no penult backup is found")
+			return nil, fmt.Errorf("no penult backup is found")
 		}
-		fmt.Fprintln(w, backupList[len(backupList)-2].Name)
+		return backupList[len(backupList)-2 : len(backupList)-1], nil
 	case "all", "":
-		if len(backupList) == 0 {
+		return backupList, nil
+	}
+	return nil, fmt.Errorf("'%s' undefined", format)
+}
+
+func printBackups(backupList []Backup, format string, outputFormat string, printSize bool, w io.Writer) error {
+	if err := ValidateOutputFormat(outputFormat); err != nil {
+		return err
+	}
+	selected, err := selectBackups(backupList, format)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "all", "":
+		if outputFormat == OutputFormatJSON {
+			return printJSON(w, selected)
+		}
+		if len(selected) == 0 {
 			fmt.Fprintln(w, "no backups found")
 		}
-		for _, backup := range backupList {
+		for _, backup := range selected {
 			if printSize {
 				fmt.Fprintf(w, "- '%s'\t%s\t(created at %s)\n", backup.Name, FormatBytes(backup.Size), backup.Date.Format("02-01-2006 15:04:05"))
 			} else {
@@ -237,18 +308,48 @@ func printBackups(backupList []Backup, format string, printSize bool, w io.Write
 			}
 		}
 	default:
-		return fmt.Errorf("'%s' undefined", format)
+		if outputFormat == OutputFormatJSON {
+			return printJSON(w, selected[0])
+		}
+		fmt.Fprintln(w, selected[0].Name)
 	}
 	return nil
 }
 
 // PrintLocalBackups - print all backups stored locally
-func PrintLocalBackups(config Config, format string, w io.Writer) error {
+func PrintLocalBackups(config Config, format string, outputFormat string, w io.Writer) error {
 	backupList, err := ListLocalBackups(config)
 	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
-	return printBackups(backupList, format, false, w)
+	return printBackups(backupList, format, outputFormat, false, w)
+}
+
+// PrintAllBackups - print backups stored locally and on remote storage
+func PrintAllBackups(config Config, format string, outputFormat string, w io.Writer) error {
+	if outputFormat != OutputFormatJSON {
+		fmt.Fprintln(w, "Local backups:")
+		if err := PrintLocalBackups(config, format, outputFormat, w); err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "Remote backups:")
+		return PrintRemoteBackups(config, format, outputFormat, w)
+	}
+	localList, err := ListLocalBackups(config)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if localList, err = selectBackups(localList, format); err != nil {
+		return err
+	}
+	remoteList, err := ListRemoteBackups(config)
+	if err != nil {
+		return err
+	}
+	if remoteList, err = selectBackups(remoteList, format); err != nil {
+		return err
+	}
+	return printJSON(w, append(localList, remoteList...))
 }
 
 // ListLocalBackups - return slice of all backups stored locally
@@ -276,10 +377,30 @@ func ListLocalBackups(config Config) ([]Backup, error) {
 		if !info.IsDir() {
 			continue
 		}
-		result = append(result, Backup{
-			Name: name,
-			Date: info.ModTime(),
+		backup := Backup{
+			Name:     name,
+			Location: "local",
+			Date:     info.ModTime(),
+		}
+		manifest, err := readLocalManifest(path.Join(backupsPath, name))
+		if err == nil {
+			backup.Date = manifest.CreationDate
+			backup.RequiredBackup = manifest.RequiredBackup
+			backup.Tables = len(manifest.Tables)
+		}
+		filepath.Walk(path.Join(backupsPath, name), func(filePath string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return nil
+			}
+			backup.Size += info.Size()
+			relativePath := strings.TrimPrefix(filePath, path.Join(backupsPath, name, "metadata"))
+			// 'metadata/<db>.sql' is metadata of database
+			if manifest == nil && relativePath != filePath && strings.HasSuffix(relativePath, ".sql") && strings.Contains(strings.Trim(relativePath, "/"), "/") {
+				backup.Tables++
+			}
+			return nil
 		})
+		result = append(result, backup)
 	}
 	sort.SliceStable(result, func(i, j int) bool {
 		return result[i].Date.Before(result[j].Date)
@@ -287,38 +408,41 @@ func ListLocalBackups(config Config) ([]Backup, error) {
 	return result, nil
 }
 
-// PrintRemoteBackups - print all backups stored on remote storage
-func PrintRemoteBackups(config Config, format string, w io.Writer) error {
+// ListRemoteBackups - return slice of all backups stored on remote storage
+func ListRemoteBackups(config Config) ([]Backup, error) {
 	bd, err := NewBackupDestination(config)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	err = bd.Connect()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return bd.BackupList()
+}
 
-	backupList, err := bd.BackupList()
+// PrintRemoteBackups - print all backups stored on remote storage
+func PrintRemoteBackups(config Config, format string, outputFormat string, w io.Writer) error {
+	backupList, err := ListRemoteBackups(config)
 	if err != nil {
 		return err
 	}
-	return printBackups(backupList, format, true, w)
+	return printBackups(backupList, format, outputFormat, true, w)
 }
 
-func IsClean(config Config, w io.Writer) error {
-    dataPath := getDataPath(config)
-    if dataPath == "" {
-        return ErrUnknownClickhouseDataPath
-    }
+// IsClean - check that shadow directory is empty
+func IsClean(config Config, outputFormat string, w io.Writer) error {
+	if err := ValidateOutputFormat(outputFormat); err != nil {
+		return err
+	}
+	dataPath := getDataPath(config)
+	if dataPath == "" {
+		return ErrUnknownClickhouseDataPath
+	}
 
-    shadowPath := filepath.Join(dataPath, "shadow")
+	shadowPath := filepath.Join(dataPath, "shadow")
 	files, err := ioutil.ReadDir(shadowPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-		    fmt.Fprintf(w, "ok\n")
-			return nil
-		}
-
+	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
 
@@ -326,6 +450,9 @@ func IsClean(config Config, w io.Writer) error {
 		return fmt.Errorf("'%s' is not empty, execute 'clean' command first", shadowPath)
 	}
 
+	if outputFormat == OutputFormatJSON {
+		return printJSON(w, map[string]string{"status": "ok"})
+	}
 	fmt.Fprintf(w, "ok\n")
 	return nil
 }
@@ -333,49 +460,193 @@ func IsClean(config Config, w io.Writer) error {
 
 // Freeze - freeze tables by tablePattern
 func Freeze(config Config, tablePattern string) error {
+	_, err := freeze(config, tablePattern, "")
+	return err
+}
+
+// namedFreeze - tables frozen with FREEZE WITH NAME to 'shadow/<escaped name>' of every disk, parts frozen by other commands are not touched
+type namedFreeze struct {
+	name   string
+	tables []Table
+}
+
+// freezeName - return name of FREEZE WITH NAME, empty for freeze to 'shadow/<increment>'
+func (f *namedFreeze) freezeName() string {
+	if f == nil {
+		return ""
+	}
+	return f.name
+}
+
+// shadowName - return directory in 'shadow' which parts are frozen to, ClickHouse escapes the name of freeze for it
+func (f *namedFreeze) shadowName() string {
+	if f == nil {
+		return ""
+	}
+	return escapeForFileName(f.name)
+}
+
+// checkParts - check that parts of every frozen table which has parts on server are moved to backup
+// parts of table frozen to other directory than expected 'shadow/<escaped name>' would be lost silently otherwise
+func (f *namedFreeze) checkParts(ch *ClickHouse, partDisks map[string]string) error {
+	if f == nil {
+		return nil
+	}
+	moved := map[string]bool{}
+	for part := range partDisks {
+		moved[path.Dir(part)] = true
+	}
+	for _, table := range f.tables {
+		if moved[path.Join(TablePathEncode(table.Database), TablePathEncode(table.Name))] {
+			continue
+		}
+		parts, err := ch.GetParts(table.Database, table.Name)
+		if err != nil {
+			return err
+		}
+		if len(parts) > 0 {
+			return fmt.Errorf("can't find parts of `%s`.`%s` frozen to 'shadow/%s'", table.Database, table.Name, f.shadowName())
+		}
+	}
+	return nil
+}
+
+// unfreeze - remove frozen parts of tables and 'shadow/<escaped name>' of every disk
+func (f *namedFreeze) unfreeze(ch *ClickHouse, disks []Disk) error {
+	if f == nil {
+		return nil
+	}
+	for _, table := range f.tables {
+		if err := ch.UnfreezeTable(table, f.name); err != nil {
+			log.Println(err)
+		}
+	}
+	for _, disk := range disks {
+		if err := os.RemoveAll(path.Join(disk.Path, "shadow", f.shadowName())); err != nil {
+			return fmt.Errorf("can't remove frozen parts with %v", err)
+		}
+	}
+	return nil
+}
+
+// freeze - freeze tables by tablePattern, with not empty name they are frozen to 'shadow/<name>' if server supports FREEZE WITH NAME
+// result is nil when tables are frozen to 'shadow/<increment>', shadow of every disk must be empty then
+// frozen parts are removed when freeze of any table fails
+func freeze(config Config, tablePattern, name string) (*namedFreeze, error) {
+	if err := ValidateTablePattern(tablePattern); err != nil {
+		return nil, err
+	}
 	ch := &ClickHouse{
 		Config: &config.ClickHouse,
 	}
 	if err := ch.Connect(); err != nil {
-		return fmt.Errorf("can't connect to clickouse with: %v", err)
+		return nil, fmt.Errorf("can't connect to clickouse with: %v", err)
 	}
 	defer ch.Close()
 
 	dataPath, err := ch.GetDataPath()
 	if err != nil || dataPath == "" {
-		return fmt.Errorf("can't get data path from clickhouse with: %v\nyou can set data_path in config file", err)
+		return nil, fmt.Errorf("can't get data path from clickhouse with: %v\nyou can set data_path in config file", err)
 	}
-
-	shadowPath := filepath.Join(dataPath, "shadow")
-	files, err := ioutil.ReadDir(shadowPath)
+	disks, err := ch.GetDisks()
 	if err != nil {
-		if !os.IsNotExist(err) {
-			return fmt.Errorf("can't read %s directory: %v", shadowPath, err)
+		return nil, fmt.Errorf("can't get disks from clickhouse with: %v", err)
+	}
+	var named *namedFreeze
+	if name != "" {
+		withName, err := ch.SupportsFreezeWithName()
+		if err != nil {
+			return nil, err
+		}
+		if withName {
+			named = &namedFreeze{name: name}
+		}
+	}
+	for _, disk := range disks {
+		shadowPath := filepath.Join(disk.Path, "shadow")
+		if named != nil {
+			namedPath := filepath.Join(shadowPath, named.shadowName())
+			if _, err := os.Stat(namedPath); !os.IsNotExist(err) {
+				return nil, fmt.Errorf("'%s' already exists, execute 'clean' command first", namedPath)
+			}
+			continue
+		}
+		files, err := ioutil.ReadDir(shadowPath)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return nil, fmt.Errorf("can't read %s directory: %v", shadowPath, err)
+			}
+		} else if len(files) > 0 {
+			return nil, fmt.Errorf("'%s' is not empty, execute 'clean' command first", shadowPath)
 		}
-	} else if len(files) > 0 {
-		return fmt.Errorf("'%s' is not empty, execute 'clean' command first", shadowPath)
 	}
 
 	allTables, err := ch.GetTables()
 	if err != nil {
-		return fmt.Errorf("can't get Clickhouse tables with: %v", err)
+		return nil, fmt.Errorf("can't get Clickhouse tables with: %v", err)
 	}
 	backupTables := parseTablePatternForFreeze(allTables, tablePattern)
 	if len(backupTables) == 0 {
-		return fmt.Errorf("there are no tables in Clickhouse, create something to freeze")
+		return nil, fmt.Errorf("there are no tables in Clickhouse, create something to freeze")
 	}
 	for _, table := range backupTables {
 		if table.Skip {
 			log.Printf("Skip `%s`.`%s`", table.Database, table.Name)
 			continue
 		}
-		if err := ch.FreezeTable(table); err != nil {
+		dataReplica, firstReplica, err := ch.isDataReplica(config.ClickHouse.ReplicatedBackup, table.Database, table.Name)
+		if err != nil {
+			return nil, err
+		}
+		if !dataReplica {
+			log.Printf("Skip data of `%s`.`%s`, it's backed up on replica '%s'", table.Database, table.Name, firstReplica)
+			continue
+		}
+		if named != nil {
+			named.tables = append(named.tables, table)
+		}
+		if err := ch.FreezeTable(table, named.freezeName()); err != nil {
+			if cleanErr := cleanFreeze(named, ch, disks); cleanErr != nil {
+				log.Printf("can't clean shadow with %v", cleanErr)
+			}
+			return nil, err
+		}
+	}
+	return named, nil
+}
+
+// cleanFreeze - remove parts frozen by failed backup, it's the whole shadow of every disk when tables are frozen without name
+func cleanFreeze(named *namedFreeze, ch *ClickHouse, disks []Disk) error {
+	if named != nil {
+		return named.unfreeze(ch, disks)
+	}
+	for _, disk := range disks {
+		if err := cleanDir(path.Join(disk.Path, "shadow")); err != nil && !os.IsNotExist(err) {
 			return err
 		}
 	}
 	return nil
 }
 
+// cleanBackupFreeze - remove parts frozen for backup which is not created
+func cleanBackupFreeze(config Config, named *namedFreeze) error {
+	if named == nil {
+		return Clean(config)
+	}
+	ch := &ClickHouse{
+		Config: &config.ClickHouse,
+	}
+	if err := ch.Connect(); err != nil {
+		return fmt.Errorf("can't connect to clickouse with: %v", err)
+	}
+	defer ch.Close()
+	disks, err := ch.GetDisks()
+	if err != nil {
+		return err
+	}
+	return named.unfreeze(ch, disks)
+}
+
 // NewBackupName - return default backup name
 func NewBackupName() string {
 	return time.Now().UTC().Format(BackupTimeFormat)
@@ -383,10 +654,16 @@ func NewBackupName() string {
 
 // CreateBackup - create new backup of all tables matched by tablePattern
 // If backupName is empty string will use default backup name
-func CreateBackup(config Config, backupName, tablePattern string, skipFreeze bool) error {
+func CreateBackup(config Config, backupName, tablePattern string, skipFreeze bool) (err error) {
 	if backupName == "" {
 		backupName = NewBackupName()
 	}
+	if err := ValidateBackupName(backupName); err != nil {
+		return err
+	}
+	if err := ValidateTablePattern(tablePattern); err != nil {
+		return err
+	}
 	dataPath := getDataPath(config)
 	if dataPath == "" {
 		return ErrUnknownClickhouseDataPath
@@ -398,11 +675,20 @@ func CreateBackup(config Config, backupName, tablePattern string, skipFreeze boo
 	if err := os.MkdirAll(backupPath, os.ModePerm); err != nil {
 		return fmt.Errorf("can't create backup with %v", err)
 	}
-	log.Println("Create backup '%s'", backupName)
+	log.Printf("Create backup '%s'", backupName)
+	var named *namedFreeze
 	if !skipFreeze {
-	    if err := Freeze(config, tablePattern); err != nil {
-            return err
-        }
+		if named, err = freeze(config, tablePattern, backupName); err != nil {
+			return err
+		}
+		defer func() {
+			if err == nil {
+				return
+			}
+			if cleanErr := cleanBackupFreeze(config, named); cleanErr != nil {
+				log.Printf("can't clean shadow with %v", cleanErr)
+			}
+		}()
 	}
 	log.Println("Copy metadata")
 	schemaList, err := parseSchemaPattern(path.Join(dataPath, "metadata"), tablePattern)
@@ -425,6 +711,14 @@ func CreateBackup(config Config, backupName, tablePattern string, skipFreeze boo
 		if err := copyFile(schema.Path, newPath); err != nil {
 			return fmt.Errorf("can't backup metadata with %v", err)
 		}
+		// engine of database is restored from its metadata file, old servers have no file for 'default' database
+		databaseFile := path.Dir(relativePath) + ".sql"
+		if _, err := os.Stat(path.Join(backupPath, "metadata", databaseFile)); err == nil {
+			continue
+		}
+		if err := copyFile(path.Join(dataPath, "metadata", databaseFile), path.Join(backupPath, "metadata", databaseFile)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("can't backup metadata of database with %v", err)
+		}
 	}
 	log.Println("  Done.")
 
@@ -433,8 +727,46 @@ func CreateBackup(config Config, backupName, tablePattern string, skipFreeze boo
 	if err := os.MkdirAll(backupShadowDir, os.ModePerm); err != nil {
 		return err
 	}
-	shadowDir := path.Join(dataPath, "shadow")
-	if err := moveShadow(shadowDir, backupShadowDir); err != nil {
+	ch := &ClickHouse{
+		Config: &config.ClickHouse,
+	}
+	if err := ch.Connect(); err != nil {
+		return fmt.Errorf("can't connect to clickouse with: %v", err)
+	}
+	defer ch.Close()
+	disks, err := ch.GetDisks()
+	if err != nil {
+		return err
+	}
+	tableInfos, err := ch.GetTableInfos()
+	if err != nil {
+		return fmt.Errorf("can't get tables with %v", err)
+	}
+	// parts of all disks are stored together, the disk of every part is written to manifest
+	partDisks := map[string]string{}
+	for _, disk := range disks {
+		parts, err := moveShadow(path.Join(disk.Path, "shadow"), backupShadowDir, tablePaths(tableInfos), named.shadowName())
+		if err != nil {
+			return err
+		}
+		for _, part := range parts {
+			partDisks[part] = disk.Name
+		}
+	}
+	if err := named.checkParts(ch, partDisks); err != nil {
+		return err
+	}
+	if err := named.unfreeze(ch, disks); err != nil {
+		log.Printf("can't clean shadow with %v", err)
+	}
+	log.Println("  Done.")
+
+	log.Println("Write manifest")
+	manifest, err := newManifest(ch, backupPath, backupName, partDisks)
+	if err != nil {
+		return fmt.Errorf("can't create %s with %v", ManifestFileName, err)
+	}
+	if err := writeLocalManifest(backupPath, manifest); err != nil {
 		return err
 	}
 	if err := RemoveOldBackupsLocal(config); err != nil {
@@ -446,6 +778,12 @@ func CreateBackup(config Config, backupName, tablePattern string, skipFreeze boo
 
 // Restore - restore tables matched by tablePattern from backupName
 func Restore(config Config, backupName string, tablePattern string, schemaOnly bool, dataOnly bool) error {
+	if err := ValidateBackupName(backupName); err != nil {
+		return err
+	}
+	if err := ValidateTablePattern(tablePattern); err != nil {
+		return err
+	}
 	if schemaOnly || (schemaOnly == dataOnly) {
 		err := restoreSchema(config, backupName, tablePattern)
 		if err != nil {
@@ -465,7 +803,7 @@ func Restore(config Config, backupName string, tablePattern string, schemaOnly b
 func RestoreData(config Config, backupName string, tablePattern string) error {
 	if backupName == "" {
 		fmt.Println("Select backup for restore:")
-		PrintLocalBackups(config, "all", os.Stdout)
+		PrintLocalBackups(config, "all", OutputFormatText, os.Stdout)
 		os.Exit(1)
 	}
 	dataPath := getDataPath(config)
@@ -485,6 +823,9 @@ func RestoreData(config Config, backupName string, tablePattern string) error {
 		return err
 	}
 	restoreTables := parseTablePatternForRestoreData(allBackupTables, tablePattern)
+	if manifest, err := readLocalManifest(path.Join(dataPath, "backup", backupName)); err == nil {
+		setPartitionDisks(restoreTables, manifest)
+	}
 	chTables, err := ch.GetTables()
 	if err != nil {
 		return err
@@ -509,6 +850,14 @@ func RestoreData(config Config, backupName string, tablePattern string) error {
 		return fmt.Errorf("%s is not created. Restore schema first or create missing tables manually", strings.Join(missingTables, ", "))
 	}
 	for _, table := range restoreTables {
+		dataReplica, firstReplica, err := ch.isDataReplica(config.ClickHouse.ReplicatedRestore, table.Database, table.Name)
+		if err != nil {
+			return err
+		}
+		if !dataReplica {
+			log.Printf("Skip data of `%s`.`%s`, it's attached on replica '%s' and fetched by replication", table.Database, table.Name, firstReplica)
+			continue
+		}
 		if err := ch.CopyData(table); err != nil {
 			return fmt.Errorf("can't restore `%s`.`%s` with %v", table.Database, table.Name, err)
 		}
@@ -535,6 +884,35 @@ func getDataPath(config Config) string {
 	return dataPath
 }
 
+// getDisks - return local disks of ClickHouse, only 'default' disk in data_path is returned when ClickHouse is not available
+func getDisks(config Config) ([]Disk, error) {
+	ch := &ClickHouse{Config: &config.ClickHouse}
+	if err := ch.Connect(); err != nil {
+		dataPath := getDataPath(config)
+		if dataPath == "" {
+			return nil, ErrUnknownClickhouseDataPath
+		}
+		return []Disk{{Name: DefaultDisk, Path: dataPath, Type: "local"}}, nil
+	}
+	defer ch.Close()
+	return ch.GetDisks()
+}
+
+// setPartitionDisks - set disk of every part of tables from manifest, parts of backups created by old versions are on 'default' disk
+func setPartitionDisks(tables []BackupTable, manifest *BackupManifest) {
+	partDisks := map[string]string{}
+	for _, table := range manifest.Tables {
+		for _, part := range table.Parts {
+			partDisks[fmt.Sprintf("%s.%s/%s", table.Database, table.Name, part.Name)] = part.Disk
+		}
+	}
+	for _, table := range tables {
+		for i, partition := range table.Partitions {
+			table.Partitions[i].Disk = partDisks[fmt.Sprintf("%s.%s/%s", table.Database, table.Name, partition.Name)]
+		}
+	}
+}
+
 func GetLocalBackup(config Config, backupName string) error {
 	if backupName == "" {
 		return fmt.Errorf("backup name is required")
@@ -551,12 +929,22 @@ func GetLocalBackup(config Config, backupName string) error {
 	return fmt.Errorf("backup '%s' not found", backupName)
 }
 
-func Upload(config Config, backupName string, diffFrom string) error {
+// Upload - upload local backup to remote storage, interrupted upload of the same backup is continued when resume is true
+func Upload(config Config, backupName string, diffFrom string, resume bool) error {
 	if backupName == "" {
 		fmt.Println("Select backup for upload:")
-		PrintLocalBackups(config, "all", os.Stdout)
+		PrintLocalBackups(config, "all", OutputFormatText, os.Stdout)
 		os.Exit(1)
 	}
+	if err := ValidateBackupName(backupName); err != nil {
+		return err
+	}
+	if err := ValidateBackupName(diffFrom); err != nil {
+		return err
+	}
+	if diffFrom == backupName {
+		return fmt.Errorf("backup '%s' can't be uploaded as diff from itself", backupName)
+	}
 	dataPath := getDataPath(config)
 	if dataPath == "" {
 		return ErrUnknownClickhouseDataPath
@@ -577,26 +965,75 @@ func Upload(config Config, backupName string, diffFrom string) error {
 	}
 	backupPath := path.Join(dataPath, "backup", backupName)
 	log.Printf("Upload backup '%s'", backupName)
-	diffFromPath := ""
-	if diffFrom != "" {
-		diffFromPath = path.Join(dataPath, "backup", diffFrom)
+	if !resume {
+		if err := bd.DiscardUpload(backupPath); err != nil {
+			return err
+		}
+	}
+	base, err := bd.newDiffBase(dataPath, backupPath, diffFrom)
+	if err != nil {
+		return fmt.Errorf("can't upload with %v", err)
+	}
+	manifest, err := readLocalManifest(backupPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
 	}
-	if err := bd.CompressedStreamUpload(backupPath, backupName, diffFromPath); err != nil {
+	tableLayout := config.General.ArchiveLayout == ArchiveLayoutTable && !isClickhouseShadow(path.Join(backupPath, "shadow"))
+	if manifest == nil && (tableLayout || base != nil) {
+		// backup created by old version, archives and base backup for retention are listed in minimal manifest
+		info, err := os.Stat(backupPath)
+		if err != nil {
+			return err
+		}
+		manifest = &BackupManifest{
+			Version:      ManifestVersion,
+			BackupName:   backupName,
+			CreationDate: info.ModTime().UTC(),
+			ToolVersion:  ToolVersion,
+			Tables:       []ManifestTable{},
+		}
+	}
+	if tableLayout {
+		archives, err := bd.tableArchivesUpload(backupPath, backupName, base, manifest, config.General.ArchiveSplitSize)
+		if err != nil {
+			return fmt.Errorf("can't upload with %v", err)
+		}
+		manifest.Archives = archives
+	} else if err := bd.compressedStreamUpload(backupPath, backupName, base); err != nil {
 		return fmt.Errorf("can't upload with %v", err)
 	}
-	if err := bd.RemoveOldBackups(bd.BackupsToKeep()); err != nil {
+	if manifest != nil {
+		manifest.CompressionFormat = bd.compressionFormat
+		manifest.RequiredBackup = diffFrom
+		manifest.Encryption = bd.encryption.info()
+		if err := bd.PutManifest(backupName, manifest); err != nil {
+			return fmt.Errorf("can't upload %s with %v", ManifestFileName, err)
+		}
+	}
+	if err := removeUploadState(backupPath); err != nil {
+		return err
+	}
+	if err := bd.RemoveOldBackups(bd.BackupsToKeep(), config.Retention.Remote); err != nil {
 		return fmt.Errorf("can't remove old backups: %v", err)
 	}
 	log.Println("  Done.")
 	return nil
 }
 
-func Download(config Config, backupName string) error {
+// Download - download backup from remote storage, only tables matched by tablePattern are downloaded from backups with 'table' archive_layout
+// interrupted download of the same backup is continued when resume is true, otherwise partially downloaded backup is removed
+func Download(config Config, backupName string, tablePattern string, resume bool) error {
 	if backupName == "" {
 		fmt.Println("Select backup for download:")
-		PrintRemoteBackups(config, "all", os.Stdout)
+		PrintRemoteBackups(config, "all", OutputFormatText, os.Stdout)
 		os.Exit(1)
 	}
+	if err := ValidateBackupName(backupName); err != nil {
+		return err
+	}
+	if err := ValidateTablePattern(tablePattern); err != nil {
+		return err
+	}
 	dataPath := getDataPath(config)
 	if dataPath == "" {
 		return ErrUnknownClickhouseDataPath
@@ -610,54 +1047,62 @@ func Download(config Config, backupName string) error {
 	if err != nil {
 		return err
 	}
-	err = bd.CompressedStreamDownload(backupName, path.Join(dataPath, "backup", backupName))
+	backupPath := path.Join(dataPath, "backup", backupName)
+	if !resume {
+		if err := DiscardDownload(backupPath); err != nil {
+			return err
+		}
+	}
+	err = bd.CompressedStreamDownload(backupName, backupPath, tablePattern)
 	if err != nil {
 		return err
 	}
+	manifest, err := bd.GetManifest(backupName)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	if manifest != nil {
+		if tablePattern != "" {
+			manifest = manifest.filterTables(tablePattern)
+		}
+		if err := writeLocalManifest(backupPath, manifest); err != nil {
+			return err
+		}
+	}
 	log.Println("  Done.")
 	return nil
 }
 
 // Clean - removed all data in shadow folder
 func Clean(config Config) error {
-	dataPath := getDataPath(config)
-	if dataPath == "" {
-		return ErrUnknownClickhouseDataPath
-	}
-	shadowDir := path.Join(dataPath, "shadow")
-	if _, err := os.Stat(shadowDir); os.IsNotExist(err) {
-		log.Printf("%s directory does not exist, nothing to do", shadowDir)
-		return nil
+	disks, err := getDisks(config)
+	if err != nil {
+		return err
 	}
-	log.Printf("Clean %s", shadowDir)
-	if err := cleanDir(shadowDir); err != nil {
-		return fmt.Errorf("can't remove contents from directory %v: %v", shadowDir, err)
+	for _, disk := range disks {
+		shadowDir := path.Join(disk.Path, "shadow")
+		if _, err := os.Stat(shadowDir); os.IsNotExist(err) {
+			log.Printf("%s directory does not exist, nothing to do", shadowDir)
+			continue
+		}
+		log.Printf("Clean %s", shadowDir)
+		if err := cleanDir(shadowDir); err != nil {
+			return fmt.Errorf("can't remove contents from directory %v: %v", shadowDir, err)
+		}
 	}
 	return nil
 }
 
-//
+// RemoveOldBackupsLocal - delete local backups according to backups_to_keep_local and local retention policy
 func RemoveOldBackupsLocal(config Config) error {
-	if config.General.BackupsToKeepLocal < 1 {
-		return nil
-	}
-	backupList, err := ListLocalBackups(config)
-	if err != nil {
-		return err
-	}
-	dataPath := getDataPath(config)
-	if dataPath == "" {
-		return ErrUnknownClickhouseDataPath
-	}
-	backupsToDelete := GetBackupsToDelete(backupList, config.General.BackupsToKeepLocal)
-	for _, backup := range backupsToDelete {
-		backupPath := path.Join(dataPath, "backup", backup.Name)
-		os.RemoveAll(backupPath)
-	}
-	return nil
+	_, err := pruneLocal(config, false)
+	return err
 }
 
 func RemoveBackupLocal(config Config, backupName string) error {
+	if err := ValidateBackupName(backupName); err != nil {
+		return err
+	}
 	backupList, err := ListLocalBackups(config)
 	if err != nil {
 		return err
@@ -668,7 +1113,14 @@ func RemoveBackupLocal(config Config, backupName string) error {
 	}
 	for _, backup := range backupList {
 		if backup.Name == backupName {
-			return os.RemoveAll(path.Join(dataPath, "backup", backupName))
+			backupPath := path.Join(dataPath, "backup", backupName)
+			if err := os.RemoveAll(backupPath); err != nil {
+				return err
+			}
+			if err := removeDownloadState(backupPath); err != nil {
+				return err
+			}
+			return removeUploadState(backupPath)
 		}
 	}
 	return fmt.Errorf("backup '%s' not found", backupName)
@@ -2,6 +2,7 @@ package chbackup
 
 import (
 	"archive/tar"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,6 +14,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mholt/archiver"
@@ -54,39 +56,34 @@ type RemoteStorage interface {
 	Connect() error
 	Walk(string, func(RemoteFile)) error
 	GetFileReader(key string) (io.ReadCloser, error)
+	GetFileReaderWithOffset(key string, offset int64) (io.ReadCloser, error)
 	PutFile(key string, r io.ReadCloser) error
 }
 
 type BackupDestination struct {
 	RemoteStorage
-	path               string
-	compressionFormat  string
-	compressionLevel   int
-	disableProgressBar bool
-	backupsToKeep      int
+	path                   string
+	compressionFormat      string
+	compressionLevel       int
+	compressionConcurrency int
+	uploadConcurrency      int
+	downloadConcurrency    int
+	disableProgressBar     bool
+	backupsToKeep          int
+	encryption             *archiveEncryption
 }
 
-func (bd *BackupDestination) RemoveOldBackups(keep int) error {
-	if keep < 1 {
-		return nil
-	}
-	backupList, err := bd.BackupList()
-	if err != nil {
-		return err
-	}
-	backupsToDelete := GetBackupsToDelete(backupList, keep)
-	for _, backupToDelete := range backupsToDelete {
-		if err := bd.RemoveBackup(backupToDelete.Name); err != nil {
-			return err
-		}
-	}
-	return nil
+// RemoveOldBackups - delete remote backups according to keep newest backups and retention policy
+func (bd *BackupDestination) RemoveOldBackups(keep int, policy RetentionPolicy) error {
+	_, err := bd.pruneBackups(keep, policy, false)
+	return err
 }
 
 func (bd *BackupDestination) RemoveBackup(backupName string) error {
 	objects := []string{}
 	if err := bd.Walk(bd.path, func(f RemoteFile) {
-		if strings.HasPrefix(f.Name(), path.Join(bd.path, backupName)) {
+		key := strings.TrimPrefix(strings.TrimPrefix(f.Name(), bd.path), "/")
+		if name, _, ok := splitArchiveName(key); (ok && name == backupName) || strings.HasPrefix(key, backupName+"/") {
 			objects = append(objects, f.Name())
 		}
 	}); err != nil {
@@ -107,39 +104,46 @@ func (bd *BackupDestination) BackupsToKeep() int {
 
 func (bd *BackupDestination) BackupList() ([]Backup, error) {
 	type ClickhouseBackup struct {
-		Metadata bool
-		Shadow   bool
-		Tar      bool
-		Size     int64
-		Date     time.Time
+		Metadata          bool
+		Shadow            bool
+		Tar               bool
+		Size              int64
+		Date              time.Time
+		CompressionFormat string
+		Manifest          bool
 	}
 	files := map[string]ClickhouseBackup{}
-	path := bd.path
-	err := bd.Walk(path, func(o RemoteFile) {
-		if strings.HasPrefix(o.Name(), path) {
-			key := strings.TrimPrefix(o.Name(), path)
+	prefix := bd.path
+	if path.Clean(prefix) == "." {
+		// names of objects in current directory are not prefixed with './'
+		prefix = ""
+	}
+	err := bd.Walk(bd.path, func(o RemoteFile) {
+		if strings.HasPrefix(o.Name(), prefix) {
+			key := strings.TrimPrefix(o.Name(), prefix)
 			key = strings.TrimPrefix(key, "/")
 			parts := strings.Split(key, "/")
-			if strings.HasSuffix(parts[0], ".tar") ||
-				strings.HasSuffix(parts[0], ".tar.lz4") ||
-				strings.HasSuffix(parts[0], ".tar.bz2") ||
-				strings.HasSuffix(parts[0], ".tar.gz") ||
-				strings.HasSuffix(parts[0], ".tar.sz") ||
-				strings.HasSuffix(parts[0], ".tar.xz") {
-				files[parts[0]] = ClickhouseBackup{
-					Tar:  true,
-					Date: o.LastModified(),
-					Size: o.Size(),
-				}
+			if backupName, format, ok := splitArchiveName(parts[0]); ok && len(parts) == 1 {
+				b := files[backupName]
+				b.Tar = true
+				b.Date = o.LastModified()
+				b.Size += o.Size()
+				b.CompressionFormat = format
+				files[backupName] = b
 			}
 			if len(parts) > 1 {
 				b := files[parts[0]]
-				files[parts[0]] = ClickhouseBackup{
-					Metadata: b.Metadata || parts[1] == "metadata",
-					Shadow:   b.Shadow || parts[1] == "shadow",
-					Date:     b.Date,
-					Size:     b.Size,
+				if len(parts) > 2 || parts[1] != ManifestFileName {
+					b.Size += o.Size()
 				}
+				b.Metadata = b.Metadata || parts[1] == "metadata"
+				b.Shadow = b.Shadow || parts[1] == "shadow"
+				b.Manifest = b.Manifest || (len(parts) == 2 && parts[1] == ManifestFileName)
+				// date of the last uploaded object is used when manifest can't be read
+				if !b.Tar && o.LastModified().After(b.Date) {
+					b.Date = o.LastModified()
+				}
+				files[parts[0]] = b
 			}
 		}
 	})
@@ -148,12 +152,35 @@ func (bd *BackupDestination) BackupList() ([]Backup, error) {
 	}
 	result := []Backup{}
 	for name, e := range files {
-		if e.Metadata && e.Shadow || e.Tar {
-			result = append(result, Backup{
-				Name: name,
-				Date: e.Date,
-				Size: e.Size,
-			})
+		// backups with 'table' archive_layout are listed only after manifest is uploaded
+		if e.Metadata && e.Shadow || e.Tar || e.Manifest {
+			backup := Backup{
+				Name:              name,
+				Location:          "remote",
+				Date:              e.Date,
+				Size:              e.Size,
+				CompressionFormat: e.CompressionFormat,
+			}
+			// archive uploaded by old version lists its base in meta file at the end of archive only, it isn't read
+			// by listing, so retention keeps all backups older than such backup
+			backup.unknownRequired = e.Tar && !e.Manifest
+			if e.Manifest {
+				manifest, err := bd.GetManifest(name)
+				if err != nil {
+					// base of backup is unknown, so retention keeps all older backups
+					log.Printf("can't read manifest of '%s' with %v, date of uploaded files is used", name, err)
+					backup.unknownRequired = true
+					result = append(result, backup)
+					continue
+				}
+				backup.Date = manifest.CreationDate
+				backup.RequiredBackup = manifest.RequiredBackup
+				backup.Tables = len(manifest.Tables)
+				if backup.CompressionFormat == "" {
+					backup.CompressionFormat = manifest.CompressionFormat
+				}
+			}
+			result = append(result, backup)
 		}
 	}
 	sort.SliceStable(result, func(i, j int) bool {
@@ -162,99 +189,312 @@ func (bd *BackupDestination) BackupList() ([]Backup, error) {
 	return result, nil
 }
 
-func (bd *BackupDestination) CompressedStreamDownload(remotePath string, localPath string) error {
-	if err := os.MkdirAll(localPath, os.ModePerm); err != nil {
-		return err
+// GetManifest - download manifest of remote backup, returns ErrNotFound for backups uploaded by old versions
+func (bd *BackupDestination) GetManifest(backupName string) (*BackupManifest, error) {
+	key := path.Join(bd.path, backupName, ManifestFileName)
+	if _, err := bd.GetFile(key); err != nil {
+		return nil, err
 	}
-	archiveName := path.Join(bd.path, fmt.Sprintf("%s.%s", remotePath, getExtension(bd.compressionFormat)))
-	if err := bd.Connect(); err != nil {
-		return err
+	r, err := bd.GetFileReader(key)
+	if err != nil {
+		return nil, err
 	}
-
-	reader, err := bd.GetFileReader(archiveName)
+	defer r.Close()
+	content, err := ioutil.ReadAll(r)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("can't read %s of '%s' with %v", ManifestFileName, backupName, err)
 	}
-	file, err := bd.GetFile(archiveName)
+	return parseManifest(content)
+}
+
+// PutManifest - upload manifest next to backup archive
+func (bd *BackupDestination) PutManifest(backupName string, manifest *BackupManifest) error {
+	content, err := json.MarshalIndent(manifest, "", "\t")
 	if err != nil {
-		return err
+		return fmt.Errorf("can't marshal %s with %v", ManifestFileName, err)
+	}
+	return bd.PutFile(path.Join(bd.path, backupName, ManifestFileName), ioutil.NopCloser(bytes.NewReader(content)))
+}
+
+// findArchive - find archive of backup, it may be uploaded with compression_format other than configured now
+func (bd *BackupDestination) findArchive(backupName string) (RemoteFile, string, error) {
+	formats := append([]string{bd.compressionFormat}, compressionFormats...)
+	for _, format := range formats {
+		archive, err := bd.GetFile(path.Join(bd.path, fmt.Sprintf("%s.%s", backupName, getExtension(format))))
+		if err == nil {
+			return archive, format, nil
+		}
+		if err != ErrNotFound {
+			return nil, "", err
+		}
 	}
-	filesize := file.Size()
+	return nil, "", ErrNotFound
+}
 
-	bar := StartNewByteBar(!bd.disableProgressBar, filesize)
+// extractToDir - return function which writes entries of archive to files under localPath
+func extractToDir(localPath string) func(name string, r io.Reader) error {
+	return func(name string, r io.Reader) error {
+		extractFile := filepath.Join(localPath, name)
+		extractDir := filepath.Dir(extractFile)
+		if _, err := os.Stat(extractDir); os.IsNotExist(err) {
+			os.MkdirAll(extractDir, os.ModePerm)
+		}
+		dst, err := os.Create(extractFile)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(dst, r); err != nil {
+			dst.Close()
+			return err
+		}
+		return dst.Close()
+	}
+}
+
+// extractArchive - pass files accepted by filter from archive stream to write function
+// returns meta file of incremental backup, hardlinks not accepted by filter are omitted
+// extracting is stopped when cancel channel is closed
+func (bd *BackupDestination) extractArchive(reader io.Reader, compressionFormat string, filter func(string) bool, write func(name string, r io.Reader) error, cancel <-chan struct{}) (MetaFile, error) {
+	var metafile MetaFile
 	buf := buffer.New(BufferSize)
 	bufReader := nio.NewReader(reader, buf)
-	proxyReader := bar.NewProxyReader(bufReader)
-	z, _ := getArchiveReader(bd.compressionFormat)
-	if err := z.Open(proxyReader, 0); err != nil {
-		return err
+	defer bufReader.Close()
+	archiveReader, err := bd.encryption.decryptReader(&cancelReader{Reader: bufReader, cancel: cancel})
+	if err != nil {
+		return metafile, err
+	}
+	z, _ := getArchiveReader(compressionFormat, bd.compressionConcurrency)
+	if err := z.Open(archiveReader, 0); err != nil {
+		return metafile, err
 	}
 	defer z.Close()
-	var metafile MetaFile
 	for {
 		file, err := z.Read()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return err
+			return metafile, err
 		}
 		header, ok := file.Header.(*tar.Header)
 		if !ok {
-			return fmt.Errorf("expected header to be *tar.Header but was %T", file.Header)
+			return metafile, fmt.Errorf("expected header to be *tar.Header but was %T", file.Header)
 		}
 		if header.Name == MetaFileName {
 			b, err := ioutil.ReadAll(file)
 			if err != nil {
-				return fmt.Errorf("can't read %s", MetaFileName)
+				return metafile, fmt.Errorf("can't read %s", MetaFileName)
 			}
 			if err := json.Unmarshal(b, &metafile); err != nil {
-				return err
+				return metafile, err
 			}
 			continue
 		}
-		extractFile := filepath.Join(localPath, header.Name)
-		extractDir := filepath.Dir(extractFile)
-		if _, err := os.Stat(extractDir); os.IsNotExist(err) {
-			os.MkdirAll(extractDir, os.ModePerm)
+		if !filter(header.Name) {
+			file.Close()
+			continue
 		}
-		dst, err := os.Create(extractFile)
+		if err := write(header.Name, file); err != nil {
+			return metafile, err
+		}
+		if err := file.Close(); err != nil {
+			return metafile, err
+		}
+	}
+	// tar reader stops at the end of archive, the rest of stream is read so integrity of OpenPGP message is checked at its end
+	if _, err := io.Copy(ioutil.Discard, archiveReader); err != nil {
+		return metafile, err
+	}
+	hardlinks := []string{}
+	for _, hardlink := range metafile.Hardlinks {
+		if filter(hardlink) {
+			hardlinks = append(hardlinks, hardlink)
+		}
+	}
+	metafile.Hardlinks = hardlinks
+	return metafile, nil
+}
+
+// CompressedStreamDownload - download backup of any archive layout to localPath, only tables matched by tablePattern are extracted
+// required backup of incremental backup is downloaded next to localPath
+// progress is saved next to localPath, so interrupted download is continued by the next call with the same arguments
+func (bd *BackupDestination) CompressedStreamDownload(remotePath string, localPath string, tablePattern string) error {
+	if err := bd.Connect(); err != nil {
+		return err
+	}
+	manifest, err := bd.GetManifest(remotePath)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	var compressionFormat string
+	archives := map[string]RemoteFile{}
+	// archives of tables are spooled, so interrupted download continues from saved offset
+	spooled := manifest != nil && len(manifest.Archives) > 0
+	if spooled {
+		compressionFormat = manifest.CompressionFormat
+		for _, archive := range selectArchives(manifest.Archives, tablePattern) {
+			archiveName := path.Join(bd.path, remotePath, archive.Name)
+			file, err := bd.GetFile(archiveName)
+			if err != nil {
+				if err == ErrNotFound {
+					return fmt.Errorf("'%s' is not found on remote storage", archiveName)
+				}
+				return err
+			}
+			archives[archiveName] = file
+		}
+	} else {
+		file, format, err := bd.findArchive(remotePath)
 		if err != nil {
+			if err == ErrNotFound {
+				return fmt.Errorf("archive of '%s' is not found on remote storage", remotePath)
+			}
 			return err
 		}
-		if _, err := io.Copy(dst, file); err != nil {
+		compressionFormat = format
+		archives[path.Join(bd.path, fmt.Sprintf("%s.%s", remotePath, getExtension(format)))] = file
+		if bd.downloadConcurrency > 1 {
+			log.Printf("'%s' is uploaded as one archive, download_concurrency %d is not used", remotePath, bd.downloadConcurrency)
+		}
+	}
+
+	state, err := resumeDownload(localPath, fmt.Sprintf("%s:%s", bd.Kind(), path.Join(bd.path, remotePath)), tablePattern)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(localPath, os.ModePerm); err != nil {
+		return err
+	}
+	var requiredBackup string
+	hardlinks := []string{}
+	pending := []string{}
+	var totalBytes int64
+	for archiveName, file := range archives {
+		archive := state.archive(archiveName, file)
+		if !archive.Extracted {
+			pending = append(pending, archiveName)
+			totalBytes += file.Size()
+			if info, err := os.Stat(downloadSpoolPath(localPath, archiveName)); spooled && err == nil {
+				totalBytes -= info.Size()
+			}
+			continue
+		}
+		if archive.MetaFile != nil {
+			if archive.MetaFile.RequiredBackup != "" {
+				requiredBackup = archive.MetaFile.RequiredBackup
+			}
+			hardlinks = append(hardlinks, archive.MetaFile.Hardlinks...)
+		}
+	}
+	sort.Strings(pending)
+	if err := state.write(); err != nil {
+		return err
+	}
+
+	filter := func(name string) bool {
+		return matchBackupFile(name, tablePattern)
+	}
+	bar := StartNewByteBar(!bd.disableProgressBar, totalBytes)
+	var mu sync.Mutex
+	if err := runParallel(bd.downloadConcurrency, len(pending), func(i int, cancel <-chan struct{}) error {
+		archiveName := pending[i]
+		spoolPath := ""
+		if spooled {
+			spoolPath = downloadSpoolPath(localPath, archiveName)
+		}
+		reader, err := bd.openSpooledArchive(archiveName, archives[archiveName].Size(), spoolPath, bar)
+		if err != nil {
 			return err
 		}
-		if err := dst.Close(); err != nil {
+		defer reader.Close()
+		metafile, err := bd.extractArchive(reader, compressionFormat, filter, extractToDir(localPath), cancel)
+		if err != nil {
 			return err
 		}
-		if err := file.Close(); err != nil {
+		if err := state.extracted(archiveName, metafile); err != nil {
 			return err
 		}
+		mu.Lock()
+		defer mu.Unlock()
+		if metafile.RequiredBackup != "" {
+			requiredBackup = metafile.RequiredBackup
+		}
+		hardlinks = append(hardlinks, metafile.Hardlinks...)
+		return nil
+	}); err != nil {
+		return err
 	}
-	if metafile.RequiredBackup != "" {
-		log.Printf("Backup '%s' required '%s'. Downloading.", remotePath, metafile.RequiredBackup)
-		err := bd.CompressedStreamDownload(metafile.RequiredBackup, filepath.Join(filepath.Dir(localPath), metafile.RequiredBackup))
+	bar.Finish()
+	if requiredBackup != "" {
+		log.Printf("Backup '%s' required '%s'. Downloading.", remotePath, requiredBackup)
+		err := bd.CompressedStreamDownload(requiredBackup, filepath.Join(filepath.Dir(localPath), requiredBackup), tablePattern)
 		if err != nil && !os.IsExist(err) {
-			return fmt.Errorf("can't download '%s' with %v", metafile.RequiredBackup, err)
+			return fmt.Errorf("can't download '%s' with %v", requiredBackup, err)
 		}
 	}
-	for _, hardlink := range metafile.Hardlinks {
+	for _, hardlink := range hardlinks {
 		newname := filepath.Join(localPath, hardlink)
 		extractDir := filepath.Dir(newname)
-		oldname := filepath.Join(filepath.Dir(localPath), metafile.RequiredBackup, hardlink)
+		oldname := filepath.Join(filepath.Dir(localPath), requiredBackup, hardlink)
 		if _, err := os.Stat(extractDir); os.IsNotExist(err) {
 			os.MkdirAll(extractDir, os.ModePerm)
 		}
+		// link may be created by interrupted attempt
+		if err := os.Remove(newname); err != nil && !os.IsNotExist(err) {
+			return err
+		}
 		if err := os.Link(oldname, newname); err != nil {
 			return err
 		}
 	}
-	bar.Finish()
+	return removeDownloadState(localPath)
+}
+
+// checkDiffFromPath - check that local backup can be used as base of incremental upload
+func checkDiffFromPath(diffFromPath string) error {
+	if diffFromPath == "" {
+		return nil
+	}
+	fi, err := os.Stat(diffFromPath)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("'%s' is not a directory", diffFromPath)
+	}
+	if isClickhouseShadow(filepath.Join(diffFromPath, "shadow")) {
+		return fmt.Errorf("'%s' is old format backup and doesn't supports diff", filepath.Base(diffFromPath))
+	}
 	return nil
 }
 
+// listBackupFiles - return paths relative to localPath of all regular files and their total size
+func listBackupFiles(localPath string) ([]string, int64, error) {
+	files := []string{}
+	var totalBytes int64
+	err := filepath.Walk(localPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, strings.TrimPrefix(strings.TrimPrefix(filePath, localPath), "/"))
+			totalBytes += info.Size()
+		}
+		return nil
+	})
+	return files, totalBytes, err
+}
+
+// CompressedStreamUpload - upload local backup as one archive, interrupted multipart upload of the same backup is continued
 func (bd *BackupDestination) CompressedStreamUpload(localPath, remotePath, diffFromPath string) error {
+	base, err := newLocalDiffBase(diffFromPath)
+	if err != nil {
+		return err
+	}
+	return bd.compressedStreamUpload(localPath, remotePath, base)
+}
+
+func (bd *BackupDestination) compressedStreamUpload(localPath, remotePath string, base *diffBase) error {
 	archiveName := path.Join(bd.path, fmt.Sprintf("%s.%s", remotePath, getExtension(bd.compressionFormat)))
 
 	if _, err := bd.GetFile(archiveName); err != nil {
@@ -262,77 +502,116 @@ func (bd *BackupDestination) CompressedStreamUpload(localPath, remotePath, diffF
 			return err
 		}
 	}
-
-	var totalBytes int64
-	filepath.Walk(localPath, func(filePath string, info os.FileInfo, err error) error {
-		if info.Mode().IsRegular() {
-			totalBytes += info.Size()
-		}
+	creationDate, err := localBackupDate(localPath)
+	if err != nil {
+		return err
+	}
+	state := &uploadState{
+		Destination:       fmt.Sprintf("%s:%s", bd.Kind(), archiveName),
+		CreationDate:      creationDate,
+		CompressionFormat: bd.compressionFormat,
+		Encryption:        bd.encryption.info(),
+		RequiredBackup:    base.backupName(),
+	}
+	bd.resumeUpload(localPath, state)
+	if len(state.Archives) > 0 {
 		return nil
-	})
+	}
+	files, totalBytes, err := listBackupFiles(localPath)
+	if err != nil {
+		return err
+	}
 	bar := StartNewByteBar(!bd.disableProgressBar, totalBytes)
-	if diffFromPath != "" {
-		fi, err := os.Stat(diffFromPath)
-		if err != nil {
-			return err
-		}
-		if !fi.IsDir() {
-			return fmt.Errorf("'%s' is not a directory", diffFromPath)
-		}
-		if isClickhouseShadow(filepath.Join(diffFromPath, "shadow")) {
-			return fmt.Errorf("'%s' is old format backup and doesn't supports diff", filepath.Base(diffFromPath))
-		}
+	if err := bd.putArchive(archiveName, localPath, files, base, state.multipart(archiveName), bar, nil); err != nil {
+		return err
 	}
+	bar.Finish()
+	return state.uploaded(path.Base(archiveName), archiveName)
+}
+
+// putArchive - pack files to archive and upload it as archiveName, files are paths relative to localPath
+// files which are stored in base backup are not packed and listed in meta file
+// storages which support resumable upload record progress to multipart upload, upload is aborted when cancel channel is closed
+func (bd *BackupDestination) putArchive(archiveName, localPath string, files []string, base *diffBase, upload *multipartUpload, bar *Bar, cancel <-chan struct{}) error {
 	hardlinks := []string{}
+	storage, resumable := bd.RemoteStorage.(resumableStorage)
+	resumable = resumable && upload != nil
+	// encrypted archive packed again never matches uploaded parts, interrupted upload is aborted and started over
+	// parts are never encrypted again with nonce of previous attempt
+	if resumable && bd.encryption != nil {
+		if uploadID := upload.id(); uploadID != "" {
+			if err := storage.AbortUpload(archiveName, uploadID); err != nil {
+				log.Printf("can't abort upload of '%s' with %v", archiveName, err)
+			}
+			if err := upload.start(""); err != nil {
+				return err
+			}
+		}
+	}
 
 	buf := buffer.New(BufferSize)
 	body, w := nio.Pipe(buf)
 	go func() (ferr error) {
-		defer w.CloseWithError(ferr)
+		defer func() {
+			w.CloseWithError(ferr)
+		}()
 		iobuf := buffer.New(BufferSize)
-		z, _ := getArchiveWriter(bd.compressionFormat, bd.compressionLevel)
-		if ferr = z.Create(w); ferr != nil {
+		var archiveWriter io.Writer = w
+		if bd.encryption != nil {
+			encryptWriter, err := bd.encryption.encryptWriter(w)
+			if err != nil {
+				ferr = err
+				return
+			}
+			// last chunk must be written after archive is closed
+			defer func() {
+				if err := encryptWriter.Close(); err != nil && ferr == nil {
+					ferr = fmt.Errorf("can't encrypt archive with %v", err)
+				}
+			}()
+			archiveWriter = encryptWriter
+		}
+		z, _ := getArchiveWriter(bd.compressionFormat, bd.compressionLevel, bd.compressionConcurrency)
+		if ferr = z.Create(archiveWriter); ferr != nil {
 			return
 		}
 		defer z.Close()
-		if ferr = filepath.Walk(localPath, func(filePath string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if !info.Mode().IsRegular() {
-				return nil
-			}
-			bar.Add64(info.Size())
-			file, err := os.Open(filePath)
-			if err != nil {
-				return err
-			}
-			defer file.Close()
-			relativePath := strings.TrimPrefix(strings.TrimPrefix(filePath, localPath), "/")
-			if diffFromPath != "" {
-				diffFromFile, err := os.Stat(filepath.Join(diffFromPath, relativePath))
-				if err == nil {
-					if os.SameFile(info, diffFromFile) {
-						hardlinks = append(hardlinks, relativePath)
-						return nil
-					}
+		for _, relativePath := range files {
+			if ferr = func() error {
+				filePath := filepath.Join(localPath, relativePath)
+				info, err := os.Lstat(filePath)
+				if err != nil {
+					return err
+				}
+				if !info.Mode().IsRegular() {
+					return nil
 				}
+				bar.Add64(info.Size())
+				if base.contains(relativePath, info) {
+					hardlinks = append(hardlinks, relativePath)
+					return nil
+				}
+				file, err := os.Open(filePath)
+				if err != nil {
+					return err
+				}
+				defer file.Close()
+				bfile := nio.NewReader(file, iobuf)
+				defer bfile.Close()
+				return z.Write(archiver.File{
+					FileInfo: archiver.FileInfo{
+						FileInfo:   info,
+						CustomName: relativePath,
+					},
+					ReadCloser: ioutil.NopCloser(&cancelReader{Reader: bfile, cancel: cancel}),
+				})
+			}(); ferr != nil {
+				return
 			}
-			bfile := nio.NewReader(file, iobuf)
-			defer bfile.Close()
-			return z.Write(archiver.File{
-				FileInfo: archiver.FileInfo{
-					FileInfo:   info,
-					CustomName: relativePath,
-				},
-				ReadCloser: bfile,
-			})
-		}); ferr != nil {
-			return
 		}
 		if len(hardlinks) > 0 {
 			metafile := MetaFile{
-				RequiredBackup: filepath.Base(diffFromPath),
+				RequiredBackup: base.backupName(),
 				Hardlinks:      hardlinks,
 			}
 			content, err := json.MarshalIndent(&metafile, "", "\t")
@@ -377,14 +656,19 @@ func (bd *BackupDestination) CompressedStreamUpload(localPath, remotePath, diffF
 		return
 	}()
 
-	if err := bd.PutFile(archiveName, body); err != nil {
-		return err
+	// only bytes of archive which are sent are counted as transferred, files stored in base backup are not
+	sent := &proxyReadCloser{Reader: &countingReader{body}, Closer: body}
+	if resumable {
+		return storage.PutFileResumable(archiveName, sent, upload)
 	}
-	bar.Finish()
-	return nil
+	return bd.PutFile(archiveName, sent)
 }
 
 func NewBackupDestination(config Config) (*BackupDestination, error) {
+	encryption, err := newArchiveEncryption(config.Encryption)
+	if err != nil {
+		return nil, err
+	}
 	switch config.General.RemoteStorage {
 	case "s3":
 		s3 := &S3{Config: &config.S3}
@@ -393,8 +677,12 @@ func NewBackupDestination(config Config) (*BackupDestination, error) {
 			config.S3.Path,
 			config.S3.CompressionFormat,
 			config.S3.CompressionLevel,
+			config.General.CompressionConcurrency,
+			config.General.UploadConcurrency,
+			config.General.DownloadConcurrency,
 			config.General.DisableProgressBar,
 			config.General.BackupsToKeepRemote,
+			encryption,
 		}, nil
 	case "gcs":
 		gcs := &GCS{Config: &config.GCS}
@@ -403,8 +691,12 @@ func NewBackupDestination(config Config) (*BackupDestination, error) {
 			config.GCS.Path,
 			config.GCS.CompressionFormat,
 			config.GCS.CompressionLevel,
+			config.General.CompressionConcurrency,
+			config.General.UploadConcurrency,
+			config.General.DownloadConcurrency,
 			config.General.DisableProgressBar,
 			config.General.BackupsToKeepRemote,
+			encryption,
 		}, nil
 	case "cos":
 		cos := &COS{Config: &config.COS}
@@ -413,8 +705,68 @@ func NewBackupDestination(config Config) (*BackupDestination, error) {
 			config.COS.Path,
 			config.COS.CompressionFormat,
 			config.COS.CompressionLevel,
+			config.General.CompressionConcurrency,
+			config.General.UploadConcurrency,
+			config.General.DownloadConcurrency,
+			config.General.DisableProgressBar,
+			config.General.BackupsToKeepRemote,
+			encryption,
+		}, nil
+	case "fs":
+		fs := &FS{Config: &config.FS}
+		return &BackupDestination{
+			fs,
+			strings.Trim(config.FS.Path, "/"),
+			config.FS.CompressionFormat,
+			config.FS.CompressionLevel,
+			config.General.CompressionConcurrency,
+			config.General.UploadConcurrency,
+			config.General.DownloadConcurrency,
+			config.General.DisableProgressBar,
+			config.General.BackupsToKeepRemote,
+			encryption,
+		}, nil
+	case "sftp":
+		sftp := &SFTP{Config: &config.SFTP}
+		return &BackupDestination{
+			sftp,
+			config.SFTP.Path,
+			config.SFTP.CompressionFormat,
+			config.SFTP.CompressionLevel,
+			config.General.CompressionConcurrency,
+			config.General.UploadConcurrency,
+			config.General.DownloadConcurrency,
+			config.General.DisableProgressBar,
+			config.General.BackupsToKeepRemote,
+			encryption,
+		}, nil
+	case "azblob":
+		azblob := &AzureBlob{Config: &config.AzureBlob}
+		return &BackupDestination{
+			azblob,
+			strings.Trim(config.AzureBlob.Path, "/"),
+			config.AzureBlob.CompressionFormat,
+			config.AzureBlob.CompressionLevel,
+			config.General.CompressionConcurrency,
+			config.General.UploadConcurrency,
+			config.General.DownloadConcurrency,
+			config.General.DisableProgressBar,
+			config.General.BackupsToKeepRemote,
+			encryption,
+		}, nil
+	case "ftp":
+		ftp := &FTP{Config: &config.FTP}
+		return &BackupDestination{
+			ftp,
+			config.FTP.Path,
+			config.FTP.CompressionFormat,
+			config.FTP.CompressionLevel,
+			config.General.CompressionConcurrency,
+			config.General.UploadConcurrency,
+			config.General.DownloadConcurrency,
 			config.General.DisableProgressBar,
 			config.General.BackupsToKeepRemote,
+			encryption,
 		}, nil
 	default:
 		return nil, fmt.Errorf("storage type '%s' not supported", config.General.RemoteStorage)
@@ -0,0 +1,286 @@
+package chbackup
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+const (
+	// ChecksumsFileName - file with checksums of all files of data part
+	ChecksumsFileName = "checksums.txt"
+	// checksumsBlockSize - ClickHouse hashes files by chained CityHash128 of blocks of this size
+	checksumsBlockSize = 2048
+)
+
+// PartChecksum - size and hash of data part file as ClickHouse stores it in checksums.txt
+type PartChecksum struct {
+	FileSize uint64
+	FileHash cityUint128
+}
+
+// cityHashWriter - calculate the same hash of file content as ClickHouse HashingWriteBuffer
+type cityHashWriter struct {
+	state cityUint128
+	block []byte
+}
+
+func newCityHashWriter() *cityHashWriter {
+	return &cityHashWriter{block: make([]byte, 0, checksumsBlockSize)}
+}
+
+func (h *cityHashWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if len(h.block) == 0 && len(p) >= checksumsBlockSize {
+			h.state = cityHash128WithSeed(p[:checksumsBlockSize], h.state)
+			p = p[checksumsBlockSize:]
+			continue
+		}
+		free := checksumsBlockSize - len(h.block)
+		if free > len(p) {
+			free = len(p)
+		}
+		h.block = append(h.block, p[:free]...)
+		p = p[free:]
+		if len(h.block) == checksumsBlockSize {
+			h.state = cityHash128WithSeed(h.block, h.state)
+			h.block = h.block[:0]
+		}
+	}
+	return n, nil
+}
+
+// Sum - hash of all written data
+func (h *cityHashWriter) Sum() cityUint128 {
+	if len(h.block) == 0 {
+		return h.state
+	}
+	return cityHash128WithSeed(h.block, h.state)
+}
+
+// readPartChecksums - parse checksums.txt of data part, supports text (v2), binary (v3) and compressed binary (v4) formats
+func readPartChecksums(r io.Reader) (map[string]PartChecksum, error) {
+	br := bufio.NewReader(r)
+	header, err := br.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("can't read header with %v", err)
+	}
+	const prefix = "checksums format version: "
+	if !strings.HasPrefix(header, prefix) {
+		return nil, fmt.Errorf("bad header '%s'", strings.TrimSpace(header))
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(header, prefix)))
+	if err != nil {
+		return nil, fmt.Errorf("bad header '%s'", strings.TrimSpace(header))
+	}
+	switch version {
+	case 2:
+		return readPartChecksumsText(br)
+	case 3:
+		return readPartChecksumsBinary(br)
+	case 4:
+		content, err := readCompressedBlocks(br)
+		if err != nil {
+			return nil, err
+		}
+		return readPartChecksumsBinary(bufio.NewReader(bytes.NewReader(content)))
+	}
+	return nil, fmt.Errorf("checksums format version %d is not supported", version)
+}
+
+func readPartChecksumsText(r *bufio.Reader) (map[string]PartChecksum, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSuffix(line, " files:\n"))
+	if err != nil {
+		return nil, fmt.Errorf("bad files count '%s'", strings.TrimSpace(line))
+	}
+	readField := func(name string) (string, error) {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		prefix := "\t" + name + ": "
+		if !strings.HasPrefix(line, prefix) {
+			return "", fmt.Errorf("expected '%s' got '%s'", name, strings.TrimSpace(line))
+		}
+		return strings.TrimSuffix(strings.TrimPrefix(line, prefix), "\n"), nil
+	}
+	readHash := func(name string) (cityUint128, error) {
+		value, err := readField(name)
+		if err != nil {
+			return cityUint128{}, err
+		}
+		var hash cityUint128
+		if _, err := fmt.Sscanf(value, "%d %d", &hash.Low, &hash.High); err != nil {
+			return cityUint128{}, fmt.Errorf("bad %s '%s'", name, value)
+		}
+		return hash, nil
+	}
+	result := make(map[string]PartChecksum, count)
+	for i := 0; i < count; i++ {
+		name, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		var checksum PartChecksum
+		size, err := readField("size")
+		if err != nil {
+			return nil, err
+		}
+		if checksum.FileSize, err = strconv.ParseUint(size, 10, 64); err != nil {
+			return nil, fmt.Errorf("bad size '%s'", size)
+		}
+		if checksum.FileHash, err = readHash("hash"); err != nil {
+			return nil, err
+		}
+		compressed, err := readField("compressed")
+		if err != nil {
+			return nil, err
+		}
+		if compressed == "1" {
+			if _, err := readField("uncompressed size"); err != nil {
+				return nil, err
+			}
+			if _, err := readHash("uncompressed hash"); err != nil {
+				return nil, err
+			}
+		}
+		result[strings.TrimSuffix(name, "\n")] = checksum
+	}
+	return result, nil
+}
+
+func readPartChecksumsBinary(r *bufio.Reader) (map[string]PartChecksum, error) {
+	readHash := func() (cityUint128, error) {
+		var buf [16]byte
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return cityUint128{}, err
+		}
+		return cityUint128{binary.LittleEndian.Uint64(buf[:8]), binary.LittleEndian.Uint64(buf[8:])}, nil
+	}
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]PartChecksum, count)
+	for i := uint64(0); i < count; i++ {
+		nameSize, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		name := make([]byte, nameSize)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return nil, err
+		}
+		var checksum PartChecksum
+		if checksum.FileSize, err = binary.ReadUvarint(r); err != nil {
+			return nil, err
+		}
+		if checksum.FileHash, err = readHash(); err != nil {
+			return nil, err
+		}
+		compressed, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if compressed != 0 {
+			if _, err := binary.ReadUvarint(r); err != nil {
+				return nil, err
+			}
+			if _, err := readHash(); err != nil {
+				return nil, err
+			}
+		}
+		result[string(name)] = checksum
+	}
+	return result, nil
+}
+
+// readCompressedBlocks - decompress data written by ClickHouse CompressedWriteBuffer
+// every block is 16 bytes of checksum, 1 byte of method, 4 bytes of compressed size with header, 4 bytes of decompressed size and data
+func readCompressedBlocks(r io.Reader) ([]byte, error) {
+	const headerSize = 9
+	result := []byte{}
+	for {
+		var header [16 + headerSize]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err == io.EOF {
+				return result, nil
+			}
+			return nil, err
+		}
+		method := header[16]
+		compressedSize := binary.LittleEndian.Uint32(header[17:21])
+		decompressedSize := binary.LittleEndian.Uint32(header[21:25])
+		if compressedSize < headerSize {
+			return nil, fmt.Errorf("bad compressed block size %d", compressedSize)
+		}
+		data := make([]byte, compressedSize-headerSize)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		block := make([]byte, decompressedSize)
+		switch method {
+		case 0x02:
+			block = data
+		case 0x82:
+			if _, err := lz4.UncompressBlock(data, block); err != nil {
+				return nil, fmt.Errorf("can't decompress lz4 block with %v", err)
+			}
+		case 0x90:
+			decoder, err := zstd.NewReader(nil)
+			if err != nil {
+				return nil, err
+			}
+			block, err = decoder.DecodeAll(data, block[:0])
+			decoder.Close()
+			if err != nil {
+				return nil, fmt.Errorf("can't decompress zstd block with %v", err)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported compression method 0x%02x", method)
+		}
+		result = append(result, block...)
+	}
+}
+
+// readPartChecksumsFile - read checksums.txt from part directory
+func readPartChecksumsFile(filePath string) (map[string]PartChecksum, error) {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	checksums, err := readPartChecksums(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("can't parse '%s' with %v", filePath, err)
+	}
+	return checksums, nil
+}
+
+// checkPartFile - compare size and hash of part file with the value from checksums.txt
+func checkPartFile(filePath string, expected PartChecksum) (bool, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	h := newCityHashWriter()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return false, fmt.Errorf("can't read '%s' with %v", filePath, err)
+	}
+	return uint64(size) == expected.FileSize && h.Sum() == expected.FileHash, nil
+}
@@ -0,0 +1,103 @@
+package chbackup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func testPattern(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}
+
+func TestCityHash128(t *testing.T) {
+	assert.Equal(t, cityUint128{3608080472651106394, 8105768702473070926}, cityHash128WithSeed([]byte("clickhouse-backup"), cityUint128{}))
+	assert.Equal(t, cityUint128{1378552052169057909, 3344542031980621333}, cityHash128WithSeed(testPattern(300), cityUint128{}))
+}
+
+func TestCityHashWriter(t *testing.T) {
+	data := testPattern(5000)
+	h := newCityHashWriter()
+	for _, size := range []int{1, 100, 2047, 2500, 352} {
+		h.Write(data[:size])
+		data = data[size:]
+	}
+	assert.Equal(t, cityUint128{3795480300697115773, 3302518545328358300}, h.Sum())
+	assert.Equal(t, cityUint128{}, newCityHashWriter().Sum())
+}
+
+func writeBinaryChecksums(buf *bytes.Buffer) {
+	varint := func(v uint64) {
+		b := make([]byte, binary.MaxVarintLen64)
+		buf.Write(b[:binary.PutUvarint(b, v)])
+	}
+	hash := func(low, high uint64) {
+		binary.Write(buf, binary.LittleEndian, low)
+		binary.Write(buf, binary.LittleEndian, high)
+	}
+	varint(2)
+	varint(uint64(len("count.txt")))
+	buf.WriteString("count.txt")
+	varint(1)
+	hash(10, 20)
+	buf.WriteByte(0)
+	varint(uint64(len("x.bin")))
+	buf.WriteString("x.bin")
+	varint(300)
+	hash(1, 2)
+	buf.WriteByte(1)
+	varint(800)
+	hash(3, 4)
+}
+
+func compressedBlock(method byte, data []byte, decompressedSize int) []byte {
+	block := make([]byte, 25, 25+len(data))
+	block[16] = method
+	binary.LittleEndian.PutUint32(block[17:], uint32(9+len(data)))
+	binary.LittleEndian.PutUint32(block[21:], uint32(decompressedSize))
+	return append(block, data...)
+}
+
+func TestReadPartChecksums(t *testing.T) {
+	expected := map[string]PartChecksum{
+		"count.txt": {FileSize: 1, FileHash: cityUint128{10, 20}},
+		"x.bin":     {FileSize: 300, FileHash: cityUint128{1, 2}},
+	}
+
+	text := "checksums format version: 2\n2 files:\n" +
+		"count.txt\n\tsize: 1\n\thash: 10 20\n\tcompressed: 0\n" +
+		"x.bin\n\tsize: 300\n\thash: 1 2\n\tcompressed: 1\n\tuncompressed size: 800\n\tuncompressed hash: 3 4\n"
+	checksums, err := readPartChecksums(strings.NewReader(text))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, checksums)
+
+	body := &bytes.Buffer{}
+	writeBinaryChecksums(body)
+	checksums, err = readPartChecksums(strings.NewReader("checksums format version: 3\n" + body.String()))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, checksums)
+
+	v4 := append([]byte("checksums format version: 4\n"), compressedBlock(0x02, body.Bytes(), body.Len())...)
+	checksums, err = readPartChecksums(bytes.NewReader(v4))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, checksums)
+
+	encoder, _ := zstd.NewWriter(nil)
+	v4 = append([]byte("checksums format version: 4\n"), compressedBlock(0x90, encoder.EncodeAll(body.Bytes(), nil), body.Len())...)
+	checksums, err = readPartChecksums(bytes.NewReader(v4))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, checksums)
+
+	_, err = readPartChecksums(strings.NewReader("checksums format version: 5\n"))
+	assert.Error(t, err)
+	_, err = readPartChecksums(strings.NewReader("some garbage\n"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,176 @@
+package chbackup
+
+import (
+	"encoding/binary"
+)
+
+// CityHash v1.0.2 as used by ClickHouse for checksums of data part files
+
+const (
+	cityK0 uint64 = 0xc3a5c85c97cb3127
+	cityK1 uint64 = 0xb492b66fbe98f273
+	cityK2 uint64 = 0x9ae16a3b2f90404f
+	cityK3 uint64 = 0xc949d7c7509e6557
+)
+
+// cityUint128 - 128 bit hash value, Low goes first in ClickHouse checksums
+type cityUint128 struct {
+	Low  uint64
+	High uint64
+}
+
+func cityFetch64(s []byte) uint64 {
+	return binary.LittleEndian.Uint64(s)
+}
+
+func cityFetch32(s []byte) uint64 {
+	return uint64(binary.LittleEndian.Uint32(s))
+}
+
+func cityRotate(val uint64, shift uint) uint64 {
+	if shift == 0 {
+		return val
+	}
+	return (val >> shift) | (val << (64 - shift))
+}
+
+func cityRotateByAtLeast1(val uint64, shift uint) uint64 {
+	return (val >> shift) | (val << (64 - shift))
+}
+
+func cityShiftMix(val uint64) uint64 {
+	return val ^ (val >> 47)
+}
+
+func cityHashLen16(u, v uint64) uint64 {
+	const kMul uint64 = 0x9ddfea08eb382d69
+	a := (u ^ v) * kMul
+	a ^= a >> 47
+	b := (v ^ a) * kMul
+	b ^= b >> 47
+	b *= kMul
+	return b
+}
+
+func cityHashLen0to16(s []byte) uint64 {
+	length := uint64(len(s))
+	if length > 8 {
+		a := cityFetch64(s)
+		b := cityFetch64(s[length-8:])
+		return cityHashLen16(a, cityRotateByAtLeast1(b+length, uint(length))) ^ b
+	}
+	if length >= 4 {
+		a := cityFetch32(s)
+		return cityHashLen16(length+(a<<3), cityFetch32(s[length-4:]))
+	}
+	if length > 0 {
+		a := uint64(s[0])
+		b := uint64(s[length>>1])
+		c := uint64(s[length-1])
+		y := a + (b << 8)
+		z := length + (c << 2)
+		return cityShiftMix(y*cityK2^z*cityK3) * cityK2
+	}
+	return cityK2
+}
+
+func cityWeakHashLen32WithSeeds(s []byte, a, b uint64) (uint64, uint64) {
+	w := cityFetch64(s)
+	x := cityFetch64(s[8:])
+	y := cityFetch64(s[16:])
+	z := cityFetch64(s[24:])
+	a += w
+	b = cityRotate(b+a+z, 21)
+	c := a
+	a += x
+	a += y
+	b += cityRotate(a, 44)
+	return a + z, b + c
+}
+
+func cityMurmur(s []byte, seed cityUint128) cityUint128 {
+	length := len(s)
+	a := seed.Low
+	b := seed.High
+	var c, d uint64
+	l := length - 16
+	if l <= 0 {
+		a = cityShiftMix(a*cityK1) * cityK1
+		c = b*cityK1 + cityHashLen0to16(s)
+		if length >= 8 {
+			d = cityShiftMix(a + cityFetch64(s))
+		} else {
+			d = cityShiftMix(a + c)
+		}
+	} else {
+		c = cityHashLen16(cityFetch64(s[length-8:])+cityK1, a)
+		d = cityHashLen16(b+uint64(length), c+cityFetch64(s[length-16:]))
+		a += d
+		for {
+			a ^= cityShiftMix(cityFetch64(s)*cityK1) * cityK1
+			a *= cityK1
+			b ^= a
+			c ^= cityShiftMix(cityFetch64(s[8:])*cityK1) * cityK1
+			c *= cityK1
+			d ^= c
+			s = s[16:]
+			l -= 16
+			if l <= 0 {
+				break
+			}
+		}
+	}
+	a = cityHashLen16(a, c)
+	b = cityHashLen16(d, b)
+	return cityUint128{a ^ b, cityHashLen16(b, a)}
+}
+
+// cityHash128WithSeed - CityHash128WithSeed from CityHash v1.0.2
+func cityHash128WithSeed(data []byte, seed cityUint128) cityUint128 {
+	length := len(data)
+	if length < 128 {
+		return cityMurmur(data, seed)
+	}
+	// pos is offset of unprocessed data, tail is hashed with offsets relative to it which may step back into processed data
+	pos := 0
+	s := data
+	x := seed.Low
+	y := seed.High
+	z := uint64(length) * cityK1
+	var v, w [2]uint64
+	v[0] = cityRotate(y^cityK1, 49)*cityK1 + cityFetch64(s)
+	v[1] = cityRotate(v[0], 42)*cityK1 + cityFetch64(s[8:])
+	w[0] = cityRotate(y+z, 35)*cityK1 + x
+	w[1] = cityRotate(x+cityFetch64(s[88:]), 53) * cityK1
+
+	round := func() {
+		x = cityRotate(x+y+v[0]+cityFetch64(s[16:]), 37) * cityK1
+		y = cityRotate(y+v[1]+cityFetch64(s[48:]), 42) * cityK1
+		x ^= w[1]
+		y ^= v[0]
+		z = cityRotate(z^w[0], 33)
+		v[0], v[1] = cityWeakHashLen32WithSeeds(s, v[1]*cityK1, x+w[0])
+		w[0], w[1] = cityWeakHashLen32WithSeeds(s[32:], z+w[1], y)
+		z, x = x, z
+		pos += 64
+		s = data[pos:]
+	}
+	for length >= 128 {
+		round()
+		round()
+		length -= 128
+	}
+	y += cityRotate(w[0], 37)*cityK0 + z
+	x += cityRotate(v[0]+z, 49) * cityK0
+	for tailDone := 0; tailDone < length; {
+		tailDone += 32
+		y = cityRotate(y-x, 42)*cityK0 + v[1]
+		w[0] += cityFetch64(data[pos+length-tailDone+16:])
+		x = cityRotate(x, 49)*cityK0 + w[0]
+		w[0] += v[0]
+		v[0], v[1] = cityWeakHashLen32WithSeeds(data[pos+length-tailDone:], v[0], v[1])
+	}
+	x = cityHashLen16(x, v[0])
+	y = cityHashLen16(y, w[0])
+	return cityUint128{cityHashLen16(x+v[1], w[1]) + y, cityHashLen16(x+w[1], y+v[1])}
+}
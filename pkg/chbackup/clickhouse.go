@@ -7,6 +7,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -27,15 +28,33 @@ type ClickHouse struct {
 
 // Table - ClickHouse table struct
 type Table struct {
-	Database string `db:"database"`
-	Name     string `db:"name"`
-	Skip     bool
+	Database string `db:"database" json:"database"`
+	Name     string `db:"name" json:"name"`
+	Skip     bool   `json:"skip"`
 }
 
-// BackupPartition - struct representing Clickhouse partition
+// BackupPartition - struct representing Clickhouse partition, Disk is the disk which the part was frozen on
 type BackupPartition struct {
 	Name string
 	Path string
+	Disk string
+}
+
+// Disk - local disk of ClickHouse from system.disks, Path is without trailing slash
+type Disk struct {
+	Name string `db:"name"`
+	Path string `db:"path"`
+	Type string `db:"type"`
+}
+
+// DefaultDisk - name of disk in data_path, it's the only disk of servers without storage policies
+const DefaultDisk = "default"
+
+// PartInfo - data part of table from system.parts
+type PartInfo struct {
+	Name        string `db:"name"`
+	PartitionID string `db:"partition_id"`
+	Disk        string `db:"disk_name"`
 }
 
 // BackupTable - struct to store additional information on partitions
@@ -57,10 +76,11 @@ func (bt BackupTables) Sort() {
 
 // RestoreTable - struct to store information needed during restore
 type RestoreTable struct {
-	Database string
-	Table    string
-	Query    string
-	Path     string
+	Database      string
+	Table         string
+	Query         string
+	Path          string
+	DatabaseQuery string
 }
 
 // RestoreTables - slice of RestoreTable
@@ -135,6 +155,204 @@ func (ch *ClickHouse) GetTables() ([]Table, error) {
 	return tables, nil
 }
 
+// TableInfo - table from system.tables, UUID is empty for tables of Ordinary databases and servers without 'uuid' column
+// DataPaths are directories of table on every disk, tables of Atomic databases are stored in 'store/<uuid prefix>/<uuid>'
+type TableInfo struct {
+	Database  string   `db:"database"`
+	Name      string   `db:"name"`
+	Engine    string   `db:"engine"`
+	UUID      string   `db:"uuid"`
+	DataPaths []string `db:"data_paths"`
+}
+
+// zeroUUID - uuid of tables in Ordinary databases
+const zeroUUID = "00000000-0000-0000-0000-000000000000"
+
+// relativePath - return directory of table relative to disk, it's 'data/<db>/<table>' when data_paths are not available
+func (t TableInfo) relativePath() string {
+	for _, dataPath := range t.DataPaths {
+		pathParts := strings.Split(strings.Trim(filepath.ToSlash(dataPath), "/"), "/")
+		if len(pathParts) >= 3 {
+			return path.Join(pathParts[len(pathParts)-3:]...)
+		}
+	}
+	return path.Join("data", TablePathEncode(t.Database), TablePathEncode(t.Name))
+}
+
+// selectTableInfos - return tables from system.tables matched by condition
+// 'data_paths' column is added in 19.15 and 'uuid' in 20.1, tables of older servers are stored in 'data/<db>/<table>'
+func (ch *ClickHouse) selectTableInfos(condition string) ([]TableInfo, error) {
+	var tables []TableInfo
+	q := fmt.Sprintf("SELECT database, name, engine, toString(uuid) AS uuid, data_paths FROM `system`.`tables` WHERE %s", condition)
+	if err := ch.conn.Select(&tables, q); err != nil {
+		tables = nil
+		q = fmt.Sprintf("SELECT database, name, engine, '' AS uuid, CAST([] AS Array(String)) AS data_paths FROM `system`.`tables` WHERE %s", condition)
+		if err := ch.conn.Select(&tables, q); err != nil {
+			return nil, err
+		}
+	}
+	for i := range tables {
+		if tables[i].UUID == zeroUUID {
+			tables[i].UUID = ""
+		}
+	}
+	return tables, nil
+}
+
+// GetTableInfos - return all tables, key is '<database>.<table>'
+func (ch *ClickHouse) GetTableInfos() (map[string]TableInfo, error) {
+	tables, err := ch.selectTableInfos("is_temporary = 0")
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]TableInfo, len(tables))
+	for _, t := range tables {
+		result[fmt.Sprintf("%s.%s", t.Database, t.Name)] = t
+	}
+	return result, nil
+}
+
+// GetTableInfo - return table from system.tables, table which doesn't exist is stored in 'data/<db>/<table>'
+func (ch *ClickHouse) GetTableInfo(database, table string) (TableInfo, error) {
+	tables, err := ch.selectTableInfos(fmt.Sprintf("database='%s' AND name='%s'", database, table))
+	if err != nil {
+		return TableInfo{}, fmt.Errorf("can't get \"%s.%s\" from system.tables with %v", database, table, err)
+	}
+	if len(tables) == 0 {
+		return TableInfo{Database: database, Name: table}, nil
+	}
+	return tables[0], nil
+}
+
+// tablePaths - return tables by their directories relative to disk, value is 'db/table' as it's stored in 'shadow' of backup
+func tablePaths(tables map[string]TableInfo) map[string]string {
+	result := make(map[string]string, len(tables))
+	for _, t := range tables {
+		result[t.relativePath()] = path.Join(TablePathEncode(t.Database), TablePathEncode(t.Name))
+	}
+	return result
+}
+
+// GetParts - return partition id and disk for each part of table, key is part name
+// disk_name is added to system.parts in 19.15, parts of older servers are on 'default' disk
+func (ch *ClickHouse) GetParts(database, table string) (map[string]PartInfo, error) {
+	var parts []PartInfo
+	q := fmt.Sprintf("SELECT name, partition_id, disk_name FROM `system`.`parts` WHERE database='%s' AND table='%s'", database, table)
+	if err := ch.conn.Select(&parts, q); err != nil {
+		q = fmt.Sprintf("SELECT name, partition_id, '%s' AS disk_name FROM `system`.`parts` WHERE database='%s' AND table='%s'", DefaultDisk, database, table)
+		if err := ch.conn.Select(&parts, q); err != nil {
+			return nil, fmt.Errorf("can't get parts for \"%s.%s\" with %v", database, table, err)
+		}
+	}
+	result := make(map[string]PartInfo, len(parts))
+	for _, p := range parts {
+		result[p.Name] = p
+	}
+	return result, nil
+}
+
+// GetDisks - return local disks from system.disks, disks of other types have no 'shadow' directory on filesystem
+// path of 'default' disk is data_path, servers without system.disks have only 'default' disk
+func (ch *ClickHouse) GetDisks() ([]Disk, error) {
+	dataPath, err := ch.GetDataPath()
+	if err != nil {
+		return nil, err
+	}
+	var disks []Disk
+	if err := ch.conn.Select(&disks, "SELECT name, path, type FROM `system`.`disks`"); err != nil {
+		// 'type' column is added in 20.x
+		if err := ch.conn.Select(&disks, "SELECT name, path, 'local' AS type FROM `system`.`disks`"); err != nil {
+			return []Disk{{Name: DefaultDisk, Path: dataPath, Type: "local"}}, nil
+		}
+	}
+	result := []Disk{}
+	for _, disk := range disks {
+		if !strings.EqualFold(disk.Type, "local") {
+			continue
+		}
+		disk.Path = strings.TrimSuffix(disk.Path, "/")
+		if disk.Name == DefaultDisk {
+			disk.Path = dataPath
+		}
+		result = append(result, disk)
+	}
+	return result, nil
+}
+
+// TableDisk - disk allowed by storage policy of table, TablePath is directory of table on the disk
+type TableDisk struct {
+	Disk
+	TablePath string
+}
+
+// newTableDisks - return disks with directory of table relative to disk
+func newTableDisks(disks []Disk, relativePath string) []TableDisk {
+	result := make([]TableDisk, len(disks))
+	for i, disk := range disks {
+		result[i] = TableDisk{Disk: disk, TablePath: filepath.Join(disk.Path, relativePath)}
+	}
+	return result
+}
+
+// GetTableDisks - return local disks allowed by storage policy of table in order of volume priority
+// tables without storage policy are stored on 'default' disk
+func (ch *ClickHouse) GetTableDisks(database, table string) ([]TableDisk, error) {
+	disks, err := ch.GetDisks()
+	if err != nil {
+		return nil, err
+	}
+	info, err := ch.GetTableInfo(database, table)
+	if err != nil {
+		return nil, err
+	}
+	byName := map[string]Disk{}
+	for _, disk := range disks {
+		byName[disk.Name] = disk
+	}
+	defaultDisks := newTableDisks([]Disk{byName[DefaultDisk]}, info.relativePath())
+	var policies []string
+	q := fmt.Sprintf("SELECT storage_policy FROM `system`.`tables` WHERE database='%s' AND name='%s'", database, table)
+	if err := ch.conn.Select(&policies, q); err != nil || len(policies) == 0 || policies[0] == "" {
+		// 'storage_policy' column is added in 19.15
+		return defaultDisks, nil
+	}
+	var volumes []struct {
+		Disks []string `db:"disks"`
+	}
+	q = fmt.Sprintf("SELECT disks FROM `system`.`storage_policies` WHERE policy_name='%s' ORDER BY volume_priority", policies[0])
+	if err := ch.conn.Select(&volumes, q); err != nil {
+		return nil, fmt.Errorf("can't get disks of storage policy '%s' with %v", policies[0], err)
+	}
+	result := []Disk{}
+	for _, volume := range volumes {
+		for _, name := range volume.Disks {
+			if disk, ok := byName[name]; ok {
+				result = append(result, disk)
+			}
+		}
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("storage policy '%s' of '%s.%s' has no local disks", policies[0], database, table)
+	}
+	return newTableDisks(result, info.relativePath()), nil
+}
+
+// selectDisk - return disk which part is restored to, it's the disk of part in backup if storage policy of table allows it
+// or the first disk of storage policy otherwise
+func selectDisk(tableDisks []TableDisk, partDisk string) TableDisk {
+	for _, disk := range tableDisks {
+		if disk.Name == partDisk {
+			return disk
+		}
+	}
+	return tableDisks[0]
+}
+
+// detachedPath - return 'detached' directory of table on disk
+func (d TableDisk) detachedPath() string {
+	return filepath.Join(d.TablePath, "detached")
+}
+
 // GetVersion - returned ClickHouse version in number format
 // Example value: 19001005
 func (ch *ClickHouse) GetVersion() (int, error) {
@@ -149,9 +367,33 @@ func (ch *ClickHouse) GetVersion() (int, error) {
 	return strconv.Atoi(result[0])
 }
 
-// FreezeTableOldWay - freeze all partitions in table one by one
+const (
+	// freezeWithNameVersion - the first version which supports ALTER TABLE ... FREEZE WITH NAME
+	freezeWithNameVersion = 20003000
+	// unfreezeVersion - the first version which supports ALTER TABLE ... UNFREEZE WITH NAME
+	unfreezeVersion = 21010000
+)
+
+// withName - return WITH NAME clause of FREEZE and UNFREEZE, parts are frozen to 'shadow/<name>' instead of 'shadow/<increment>'
+func withName(name string) string {
+	if name == "" {
+		return ""
+	}
+	return fmt.Sprintf(" WITH NAME '%s'", quoteString(name))
+}
+
+// SupportsFreezeWithName - check that parts can be frozen to 'shadow/<name>'
+func (ch *ClickHouse) SupportsFreezeWithName() (bool, error) {
+	version, err := ch.GetVersion()
+	if err != nil {
+		return false, err
+	}
+	return version >= freezeWithNameVersion, nil
+}
+
+// FreezeTableOldWay - freeze all partitions in table one by one, empty name means freeze to 'shadow/<increment>'
 // This way using for ClickHouse below v19.1
-func (ch *ClickHouse) FreezeTableOldWay(table Table) error {
+func (ch *ClickHouse) FreezeTableOldWay(table Table, name string) error {
 	var partitions []struct {
 		PartitionID string `db:"partition_id"`
 	}
@@ -163,15 +405,17 @@ func (ch *ClickHouse) FreezeTableOldWay(table Table) error {
 	for _, item := range partitions {
 		log.Printf("  partition '%v'", item.PartitionID)
 		query := fmt.Sprintf(
-			"ALTER TABLE `%v`.`%v` FREEZE PARTITION ID '%v';",
+			"ALTER TABLE `%v`.`%v` FREEZE PARTITION ID '%v'%s;",
 			table.Database,
 			table.Name,
-			item.PartitionID)
+			item.PartitionID,
+			withName(name))
 		if item.PartitionID == "all" {
 			query = fmt.Sprintf(
-				"ALTER TABLE `%v`.`%v` FREEZE PARTITION tuple();",
+				"ALTER TABLE `%v`.`%v` FREEZE PARTITION tuple()%s;",
 				table.Database,
-				table.Name)
+				table.Name,
+				withName(name))
 		}
 		if _, err := ch.conn.Exec(query); err != nil {
 			return fmt.Errorf("can't freeze partition '%s' on '%s.%s' with: %v", item.PartitionID, table.Database, table.Name, err)
@@ -180,24 +424,40 @@ func (ch *ClickHouse) FreezeTableOldWay(table Table) error {
 	return nil
 }
 
-// FreezeTable - freeze all partitions for table
+// FreezeTable - freeze all partitions for table, empty name means freeze to 'shadow/<increment>'
 // This way available for ClickHouse sience v19.1
-func (ch *ClickHouse) FreezeTable(table Table) error {
+func (ch *ClickHouse) FreezeTable(table Table, name string) error {
 	version, err := ch.GetVersion()
 	if err != nil {
 		return err
 	}
 	if version < 19001005 || ch.Config.FreezeByPart {
-		return ch.FreezeTableOldWay(table)
+		return ch.FreezeTableOldWay(table, name)
 	}
 	log.Printf("Freeze `%s`.`%s`", table.Database, table.Name)
-	query := fmt.Sprintf("ALTER TABLE `%v`.`%v` FREEZE;", table.Database, table.Name)
+	query := fmt.Sprintf("ALTER TABLE `%v`.`%v` FREEZE%s;", table.Database, table.Name, withName(name))
 	if _, err := ch.conn.Exec(query); err != nil {
 		return fmt.Errorf("can't freeze `%s`.`%s` with: %v", table.Database, table.Name, err)
 	}
 	return nil
 }
 
+// UnfreezeTable - remove parts of table frozen with name, servers without UNFREEZE are skipped and 'shadow/<name>' is removed by caller
+func (ch *ClickHouse) UnfreezeTable(table Table, name string) error {
+	version, err := ch.GetVersion()
+	if err != nil {
+		return err
+	}
+	if version < unfreezeVersion {
+		return nil
+	}
+	query := fmt.Sprintf("ALTER TABLE `%v`.`%v` UNFREEZE%s;", table.Database, table.Name, withName(name))
+	if _, err := ch.conn.Exec(query); err != nil {
+		return fmt.Errorf("can't unfreeze `%s`.`%s` with: %v", table.Database, table.Name, err)
+	}
+	return nil
+}
+
 // GetBackupTables - return list of backups of tables that can be restored
 func (ch *ClickHouse) GetBackupTables(backupName string) (map[string]BackupTable, error) {
 	dataPath, err := ch.GetDataPath()
@@ -284,17 +544,18 @@ func (ch *ClickHouse) Chown(filename string) error {
 }
 
 // CopyData - copy partitions for specific table to detached folder
+// every part is placed on the disk it was frozen on if storage policy of the table allows it or on the first disk of policy
 func (ch *ClickHouse) CopyData(table BackupTable) error {
 	log.Printf("Prepare data for restoring `%s`.`%s`", table.Database, table.Name)
-	dataPath, err := ch.GetDataPath()
+	tableDisks, err := ch.GetTableDisks(table.Database, table.Name)
 	if err != nil {
 		return err
 	}
-	detachedParentDir := filepath.Join(dataPath, "data", TablePathEncode(table.Database), TablePathEncode(table.Name), "detached")
-	os.MkdirAll(detachedParentDir, 0750)
-	ch.Chown(detachedParentDir)
 
 	for _, partition := range table.Partitions {
+		detachedParentDir := selectDisk(tableDisks, partition.Disk).detachedPath()
+		os.MkdirAll(detachedParentDir, 0750)
+		ch.Chown(detachedParentDir)
 		detachedPath := filepath.Join(detachedParentDir, partition.Name)
 		info, err := os.Stat(detachedPath)
 		if err != nil {
@@ -324,7 +585,8 @@ func (ch *ClickHouse) CopyData(table BackupTable) error {
 				log.Printf("'%s' is not a regular file, skipping.", filePath)
 				return nil
 			}
-			if err := os.Link(filePath, dstFilePath); err != nil {
+			// backup and disk of part may be on different filesystems
+			if err := linkOrCopyFile(filePath, dstFilePath); err != nil {
 				return fmt.Errorf("failed to crete hard link '%s' -> '%s' with %v", filePath, dstFilePath, err)
 			}
 			return ch.Chown(dstFilePath)
@@ -347,20 +609,77 @@ func (ch *ClickHouse) AttachPatritions(table BackupTable) error {
 	return nil
 }
 
-// CreateDatabase - create ClickHouse database
-func (ch *ClickHouse) CreateDatabase(database string) error {
-	createQuery := fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`", database)
-	_, err := ch.conn.Exec(createQuery)
+// CreateDatabase - create ClickHouse database with query from its metadata file, backups without it create database with default engine
+// UUID of database is kept only when preserve_uuid is enabled
+func (ch *ClickHouse) CreateDatabase(database, query string) error {
+	if query == "" {
+		query = fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`", database)
+	}
+	if !ch.Config.PreserveUUID {
+		query = removeDatabaseUUID(query)
+	}
+	_, err := ch.conn.Exec(query)
 	return err
 }
 
-// CreateTable - create ClickHouse table
+// attachDatabaseRe - ATTACH query from metadata file of database, name of Atomic database is replaced with placeholder '_'
+var attachDatabaseRe = regexp.MustCompile("^ATTACH DATABASE (?:`(?:[^`\\\\]|\\\\.)*`|\\S+)")
+
+// databaseUUIDRe - UUID of Atomic database in CREATE query
+var databaseUUIDRe = regexp.MustCompile(`^(CREATE DATABASE IF NOT EXISTS .+?) UUID '[0-9a-fA-F-]+'`)
+
+// createDatabaseQuery - convert ATTACH query from metadata file of database to CREATE query which keeps engine of database
+func createDatabaseQuery(attachQuery, database string) string {
+	loc := attachDatabaseRe.FindStringIndex(attachQuery)
+	if loc == nil {
+		return ""
+	}
+	return fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`%s", database, strings.TrimRight(attachQuery[loc[1]:], "\n"))
+}
+
+// removeDatabaseUUID - remove UUID from CREATE DATABASE query, database gets new UUID
+func removeDatabaseUUID(query string) string {
+	if m := databaseUUIDRe.FindStringSubmatch(query); m != nil {
+		return m[1] + query[len(m[0]):]
+	}
+	return query
+}
+
+// attachQueryRe - metadata of tables in Atomic databases has placeholder '_' instead of table name followed by UUID
+var attachQueryRe = regexp.MustCompile(`^ATTACH ((?:MATERIALIZED |LIVE )?VIEW|TABLE|DICTIONARY) _ `)
+
+// tableUUIDRe - UUID of table and UUID of inner table of materialized view in CREATE query
+var tableUUIDRe = regexp.MustCompile(`^(CREATE (?:(?:MATERIALIZED |LIVE )?VIEW|TABLE|DICTIONARY) .+?) UUID '[0-9a-fA-F-]+'(?: TO INNER UUID '[0-9a-fA-F-]+')?`)
+
+// createQuery - convert ATTACH query from metadata file to CREATE query, placeholder of table name is replaced with database and table
+func createQuery(attachQuery, database, table string) string {
+	if m := attachQueryRe.FindStringSubmatch(attachQuery); m != nil {
+		return fmt.Sprintf("CREATE %s `%s`.`%s` %s", m[1], database, table, attachQuery[len(m[0]):])
+	}
+	return strings.Replace(attachQuery, "ATTACH", "CREATE", 1)
+}
+
+// removeTableUUID - remove UUID from CREATE query, table gets new UUID and it doesn't conflict with the original table
+func removeTableUUID(query string) string {
+	if m := tableUUIDRe.FindStringSubmatch(query); m != nil {
+		return m[1] + query[len(m[0]):]
+	}
+	return query
+}
+
+// CreateTable - create ClickHouse table, UUID of tables from Atomic databases is kept only when preserve_uuid is enabled
+// ZooKeeper path and replica name of Replicated tables are replaced when replicated_zookeeper_path is set
 func (ch *ClickHouse) CreateTable(table RestoreTable) error {
 	if _, err := ch.conn.Exec(fmt.Sprintf("USE `%s`", table.Database)); err != nil {
 		return err
 	}
 	log.Printf("Create table `%s`.`%s`", table.Database, table.Table)
-	if _, err := ch.conn.Exec(table.Query); err != nil {
+	query := table.Query
+	if !ch.Config.PreserveUUID {
+		query = removeTableUUID(query)
+	}
+	query = rewriteReplicatedEngine(query, table.Database, table.Table, ch.Config.ReplicatedZookeeperPath, ch.Config.ReplicatedReplicaName)
+	if _, err := ch.conn.Exec(query); err != nil {
 		return err
 	}
 	return nil
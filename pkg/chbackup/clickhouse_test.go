@@ -0,0 +1,82 @@
+package chbackup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateQuery(t *testing.T) {
+	assert.Equal(t, "CREATE TABLE t (a UInt8) ENGINE = Memory", createQuery("ATTACH TABLE t (a UInt8) ENGINE = Memory", "db", "t"))
+	atomic := createQuery("ATTACH TABLE _ UUID 'f7a2c1b0-0000-4000-8000-000000000001'\n(\n    `a` UInt8\n)\nENGINE = MergeTree ORDER BY a\n", "db", "t")
+	assert.Equal(t, "CREATE TABLE `db`.`t` UUID 'f7a2c1b0-0000-4000-8000-000000000001'\n(\n    `a` UInt8\n)\nENGINE = MergeTree ORDER BY a\n", atomic)
+	assert.Equal(t, "CREATE TABLE `db`.`t`\n(\n    `a` UInt8\n)\nENGINE = MergeTree ORDER BY a\n", removeTableUUID(atomic))
+
+	view := createQuery("ATTACH MATERIALIZED VIEW _ UUID 'f7a2c1b0-0000-4000-8000-000000000001' TO INNER UUID 'f7a2c1b0-0000-4000-8000-000000000002'\n(\n    `a` UInt8\n) ENGINE = Memory AS SELECT 1 AS a\n", "db", "mv")
+	assert.Equal(t, "CREATE MATERIALIZED VIEW `db`.`mv`\n(\n    `a` UInt8\n) ENGINE = Memory AS SELECT 1 AS a\n", removeTableUUID(view))
+	assert.Equal(t, "CREATE TABLE t (a UUID) ENGINE = Memory", removeTableUUID("CREATE TABLE t (a UUID) ENGINE = Memory"))
+}
+
+func TestTableInfoRelativePath(t *testing.T) {
+	assert.Equal(t, "data/db/t%2Ex", TableInfo{Database: "db", Name: "t.x"}.relativePath())
+	assert.Equal(t, "data/db/t", TableInfo{Database: "db", Name: "t", DataPaths: []string{"/var/lib/clickhouse/data/db/t/"}}.relativePath())
+	info := TableInfo{
+		Database:  "atomic",
+		Name:      "t",
+		UUID:      "f7a2c1b0-0000-4000-8000-000000000001",
+		DataPaths: []string{"/var/lib/clickhouse/store/f7a/f7a2c1b0-0000-4000-8000-000000000001/", "/mnt/hot/store/f7a/f7a2c1b0-0000-4000-8000-000000000001/"},
+	}
+	assert.Equal(t, "store/f7a/f7a2c1b0-0000-4000-8000-000000000001", info.relativePath())
+	assert.Equal(t, map[string]string{
+		"store/f7a/f7a2c1b0-0000-4000-8000-000000000001": "atomic/t",
+		"data/db/t": "db/t",
+	}, tablePaths(map[string]TableInfo{"atomic.t": info, "db.t": {Database: "db", Name: "t"}}))
+}
+
+func TestParseSchemaPatternAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clickhouse-backup-metadata")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	metadataPath := filepath.Join(dir, "metadata")
+	storePath := filepath.Join(dir, "store", "0ab", "0ab00000-0000-4000-8000-000000000003")
+	require.NoError(t, os.MkdirAll(filepath.Join(metadataPath, "ordinary"), os.ModePerm))
+	require.NoError(t, os.MkdirAll(storePath, os.ModePerm))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(metadataPath, "ordinary", "t.sql"), []byte("ATTACH TABLE t (a UInt8) ENGINE = Memory"), 0640))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(storePath, "t.sql"), []byte("ATTACH TABLE _ UUID 'f7a2c1b0-0000-4000-8000-000000000001' (a UInt8) ENGINE = Memory"), 0640))
+	// metadata directory of Atomic database is a symlink to 'store'
+	require.NoError(t, os.Symlink(storePath, filepath.Join(metadataPath, "atomic")))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(metadataPath, "atomic.sql"), []byte("ATTACH DATABASE _ UUID 'f7a2c1b0-0000-4000-8000-000000000004'\nENGINE = Atomic\n"), 0640))
+
+	tables, err := parseSchemaPattern(metadataPath, "*")
+	require.NoError(t, err)
+	require.Len(t, tables, 2)
+	assert.Equal(t, RestoreTable{
+		Database: "atomic",
+		Table:    "t",
+		Query:    "CREATE TABLE `atomic`.`t` UUID 'f7a2c1b0-0000-4000-8000-000000000001' (a UInt8) ENGINE = Memory",
+		Path:     filepath.Join(metadataPath, "atomic", "t.sql"),
+		// engine of database is restored from its metadata file
+		DatabaseQuery: "CREATE DATABASE IF NOT EXISTS `atomic` UUID 'f7a2c1b0-0000-4000-8000-000000000004'\nENGINE = Atomic",
+	}, tables[0])
+	assert.Equal(t, "ordinary", tables[1].Database)
+	assert.Equal(t, "", tables[1].DatabaseQuery)
+}
+
+func TestCreateDatabaseQuery(t *testing.T) {
+	assert.Equal(t, "CREATE DATABASE IF NOT EXISTS `db`\nENGINE = Ordinary", createDatabaseQuery("ATTACH DATABASE db\nENGINE = Ordinary\n", "db"))
+	assert.Equal(t, "CREATE DATABASE IF NOT EXISTS `my db` ENGINE = Atomic", createDatabaseQuery("ATTACH DATABASE `my db` ENGINE = Atomic", "my db"))
+	atomic := createDatabaseQuery("ATTACH DATABASE _ UUID 'f7a2c1b0-0000-4000-8000-000000000004'\nENGINE = Atomic\n", "_db")
+	assert.Equal(t, "CREATE DATABASE IF NOT EXISTS `_db` UUID 'f7a2c1b0-0000-4000-8000-000000000004'\nENGINE = Atomic", atomic)
+	assert.Equal(t, "CREATE DATABASE IF NOT EXISTS `_db`\nENGINE = Atomic", removeDatabaseUUID(atomic))
+	assert.Equal(t, "", createDatabaseQuery("", "db"))
+}
+
+func TestWithName(t *testing.T) {
+	assert.Equal(t, "", withName(""))
+	assert.Equal(t, " WITH NAME 'my_backup'", withName("my_backup"))
+	assert.Equal(t, ` WITH NAME 'it\'s'`, withName("it's"))
+}
@@ -0,0 +1,359 @@
+package chbackup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClusterShard - shard of cluster from system.clusters, Hosts are addresses of 'serve' API of its replicas in order of replica_num
+type ClusterShard struct {
+	Num   uint32   `json:"shard"`
+	Hosts []string `json:"hosts"`
+}
+
+// ClusterShardResult - result of command executed by 'serve' API of one replica of shard
+type ClusterShardResult struct {
+	Shard  uint32 `json:"shard"`
+	Host   string `json:"host"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Job    *Job   `json:"job,omitempty"`
+}
+
+// ClusterBackup - backup stored on shards of cluster under the same name, Date is the earliest creation date of shard backups
+type ClusterBackup struct {
+	Name     string    `json:"name"`
+	Location string    `json:"location"`
+	Size     int64     `json:"size"`
+	Date     time.Time `json:"creation_date"`
+	Shards   []uint32  `json:"shards"`
+	Complete bool      `json:"complete"`
+}
+
+// clusterClient - client of 'serve' API of shards
+// state of job is polled every pollInterval, pollRetries failed requests in a row are retried because job keeps running on the shard
+type clusterClient struct {
+	client       *http.Client
+	pollInterval time.Duration
+	pollRetries  int
+}
+
+func newClusterClient() *clusterClient {
+	return &clusterClient{
+		client:       &http.Client{Timeout: time.Minute},
+		pollInterval: 5 * time.Second,
+		pollRetries:  60,
+	}
+}
+
+// GetClusterShards - return shards of cluster from system.clusters, port is port of 'serve' API on every host
+func (ch *ClickHouse) GetClusterShards(cluster string, port int) ([]ClusterShard, error) {
+	var replicas []struct {
+		ShardNum uint32 `db:"shard_num"`
+		HostName string `db:"host_name"`
+	}
+	q := fmt.Sprintf("SELECT shard_num, host_name FROM `system`.`clusters` WHERE cluster='%s' ORDER BY shard_num, replica_num", quoteString(cluster))
+	if err := ch.conn.Select(&replicas, q); err != nil {
+		return nil, fmt.Errorf("can't get shards of cluster '%s' with %v", cluster, err)
+	}
+	if len(replicas) == 0 {
+		return nil, fmt.Errorf("cluster '%s' is not found in system.clusters", cluster)
+	}
+	shards := []ClusterShard{}
+	for _, replica := range replicas {
+		host := fmt.Sprintf("http://%s", net.JoinHostPort(replica.HostName, strconv.Itoa(port)))
+		if len(shards) == 0 || shards[len(shards)-1].Num != replica.ShardNum {
+			shards = append(shards, ClusterShard{Num: replica.ShardNum})
+		}
+		shards[len(shards)-1].Hosts = append(shards[len(shards)-1].Hosts, host)
+	}
+	return shards, nil
+}
+
+// getClusterShards - return shards of cluster, empty cluster means 'cluster' option of config
+func getClusterShards(config Config, cluster string) ([]ClusterShard, error) {
+	if cluster == "" {
+		cluster = config.General.Cluster
+	}
+	if cluster == "" {
+		return nil, fmt.Errorf("cluster is not set, use --cluster or 'cluster' option in 'general' section")
+	}
+	if config.General.ShardBackupPort == 0 {
+		return nil, fmt.Errorf("shard_backup_port must be set, 'serve' API of shards is called on it")
+	}
+	ch := &ClickHouse{
+		Config: &config.ClickHouse,
+	}
+	if err := ch.Connect(); err != nil {
+		return nil, fmt.Errorf("can't connect to clickouse with: %v", err)
+	}
+	defer ch.Close()
+	return ch.GetClusterShards(cluster, config.General.ShardBackupPort)
+}
+
+// do - send request to 'serve' API and decode JSON response to v, errors of API are returned as error
+func (c *clusterClient) do(method, requestURL string, v interface{}) error {
+	req, err := http.NewRequest(method, requestURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		apiError := struct {
+			Error string `json:"error"`
+		}{}
+		if json.Unmarshal(body, &apiError) == nil && apiError.Error != "" {
+			return fmt.Errorf("%s", apiError.Error)
+		}
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// isConnectError - check that request failed because connection to host wasn't established, so request didn't reach the host
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// isTransportError - check that request failed in transport, for example by timeout or broken connection, and not by response of API
+func isTransportError(err error) bool {
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// firstAvailable - call fn with replicas of shard in order until one of them is reachable, return host of the replica
+func firstAvailable(shard ClusterShard, fn func(host string) error) (string, error) {
+	var lastErr error
+	for _, host := range shard.Hosts {
+		err := fn(host)
+		if err == nil {
+			return host, nil
+		}
+		// only replicas which are not reachable are skipped, request which timed out may have started the job already
+		if !isConnectError(err) {
+			return host, err
+		}
+		log.Printf("Replica '%s' of shard %d is not available, %v", host, shard.Num, err)
+		lastErr = err
+	}
+	return "", fmt.Errorf("no replica of shard %d is available, %v", shard.Num, lastErr)
+}
+
+// runJob - start command on one replica of shard and wait until the job is finished
+func (c *clusterClient) runJob(shard ClusterShard, command string, query url.Values) ClusterShardResult {
+	result := ClusterShardResult{Shard: shard.Num, Status: JobFailed}
+	job := Job{}
+	host, err := firstAvailable(shard, func(host string) error {
+		return c.do(http.MethodPost, fmt.Sprintf("%s/%s?%s", host, command, query.Encode()), &job)
+	})
+	result.Host = host
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	log.Printf("Shard %d: '%s' is started on '%s' as job '%s'", shard.Num, command, host, job.ID)
+	failures := 0
+	for job.Status == JobQueued || job.Status == JobRunning {
+		time.Sleep(c.pollInterval)
+		err := c.do(http.MethodGet, fmt.Sprintf("%s/jobs/%s", host, job.ID), &job)
+		if err == nil {
+			failures = 0
+			continue
+		}
+		failures++
+		if !isTransportError(err) || failures > c.pollRetries {
+			result.Error = fmt.Sprintf("can't get state of job '%s' with %v", job.ID, err)
+			return result
+		}
+		log.Printf("Shard %d: can't get state of job '%s' with %v, retrying", shard.Num, job.ID, err)
+	}
+	log.Printf("Shard %d: '%s' is %s", shard.Num, command, job.Status)
+	result.Status = job.Status
+	result.Error = job.Error
+	result.Job = &job
+	return result
+}
+
+// runOnCluster - execute command on one replica of every shard in parallel and wait for all of them
+func (c *clusterClient) runOnCluster(shards []ClusterShard, command string, query url.Values) []ClusterShardResult {
+	results := make([]ClusterShardResult, len(shards))
+	var wg sync.WaitGroup
+	for i := range shards {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = c.runJob(shards[i], command, query)
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+// printClusterResults - print status of command on every shard, error is returned when command failed on any shard
+func printClusterResults(results []ClusterShardResult, operation, backupName, outputFormat string, w io.Writer) error {
+	if outputFormat == OutputFormatJSON {
+		if err := printJSON(w, results); err != nil {
+			return err
+		}
+	} else {
+		for _, result := range results {
+			fmt.Fprintf(w, "shard %d\t%s\t%s\t%s\n", result.Shard, result.Host, result.Status, result.Error)
+		}
+	}
+	failed := 0
+	for _, result := range results {
+		if result.Status != JobSucceeded {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%s of '%s' failed on %d of %d shards", operation, backupName, failed, len(results))
+	}
+	return nil
+}
+
+// ClusterCreate - create backup with the same name on one replica of every shard of cluster by 'serve' API
+// backup is uploaded to remote storage of every shard with 'create-remote' or kept locally with 'create' when local is true
+func ClusterCreate(config Config, cluster, backupName, tablePattern string, local bool, outputFormat string, w io.Writer) error {
+	if err := ValidateOutputFormat(outputFormat); err != nil {
+		return err
+	}
+	if backupName == "" {
+		backupName = NewBackupName()
+	}
+	if err := ValidateBackupName(backupName); err != nil {
+		return err
+	}
+	if err := ValidateTablePattern(tablePattern); err != nil {
+		return err
+	}
+	shards, err := getClusterShards(config, cluster)
+	if err != nil {
+		return err
+	}
+	operation := "create-remote"
+	if local {
+		operation = "create"
+	}
+	log.Printf("Create backup '%s' on %d shards", backupName, len(shards))
+	results := newClusterClient().runOnCluster(shards, fmt.Sprintf("%s/%s", operation, backupName), url.Values{"table": {tablePattern}})
+	return printClusterResults(results, operation, backupName, outputFormat, w)
+}
+
+// ClusterRestore - restore backup with the same name on one replica of every shard of cluster by 'serve' API
+// backup is streamed from remote storage of every shard with 'restore-remote' or restored from local backup with 'restore' when local is true
+func ClusterRestore(config Config, cluster, backupName, tablePattern string, schemaOnly, dataOnly, local bool, outputFormat string, w io.Writer) error {
+	if err := ValidateOutputFormat(outputFormat); err != nil {
+		return err
+	}
+	if backupName == "" {
+		return fmt.Errorf("backup name must be defined")
+	}
+	if err := ValidateBackupName(backupName); err != nil {
+		return err
+	}
+	if err := ValidateTablePattern(tablePattern); err != nil {
+		return err
+	}
+	shards, err := getClusterShards(config, cluster)
+	if err != nil {
+		return err
+	}
+	operation := "restore-remote"
+	if local {
+		operation = "restore"
+	}
+	query := url.Values{
+		"table":  {tablePattern},
+		"schema": {strconv.FormatBool(schemaOnly)},
+		"data":   {strconv.FormatBool(dataOnly)},
+	}
+	log.Printf("Restore backup '%s' on %d shards", backupName, len(shards))
+	results := newClusterClient().runOnCluster(shards, fmt.Sprintf("%s/%s", operation, backupName), query)
+	return printClusterResults(results, operation, backupName, outputFormat, w)
+}
+
+// listBackups - return backups of one replica of every shard grouped by name, backup is complete when it's stored on every shard
+func (c *clusterClient) listBackups(shards []ClusterShard, location string) ([]ClusterBackup, error) {
+	byName := map[string]*ClusterBackup{}
+	for _, shard := range shards {
+		var backups []Backup
+		if _, err := firstAvailable(shard, func(host string) error {
+			return c.do(http.MethodGet, fmt.Sprintf("%s/list/%s", host, location), &backups)
+		}); err != nil {
+			return nil, fmt.Errorf("can't list backups of shard %d with %v", shard.Num, err)
+		}
+		for _, backup := range backups {
+			clusterBackup, ok := byName[backup.Name]
+			if !ok {
+				clusterBackup = &ClusterBackup{Name: backup.Name, Location: location, Date: backup.Date}
+				byName[backup.Name] = clusterBackup
+			}
+			clusterBackup.Size += backup.Size
+			if backup.Date.Before(clusterBackup.Date) {
+				clusterBackup.Date = backup.Date
+			}
+			clusterBackup.Shards = append(clusterBackup.Shards, shard.Num)
+		}
+	}
+	result := []ClusterBackup{}
+	for _, backup := range byName {
+		backup.Complete = len(backup.Shards) == len(shards)
+		result = append(result, *backup)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Date.Before(result[j].Date)
+	})
+	return result, nil
+}
+
+// ClusterList - print backups of shards of cluster, location is 'local' or 'remote'
+func ClusterList(config Config, cluster, location, outputFormat string, w io.Writer) error {
+	if err := ValidateOutputFormat(outputFormat); err != nil {
+		return err
+	}
+	if location == "" {
+		location = "remote"
+	}
+	if location != "local" && location != "remote" {
+		return fmt.Errorf("unknown location '%s', use 'local' or 'remote'", location)
+	}
+	shards, err := getClusterShards(config, cluster)
+	if err != nil {
+		return err
+	}
+	backups, err := newClusterClient().listBackups(shards, location)
+	if err != nil {
+		return err
+	}
+	if outputFormat == OutputFormatJSON {
+		return printJSON(w, backups)
+	}
+	for _, backup := range backups {
+		complete := "complete"
+		if !backup.Complete {
+			complete = "incomplete"
+		}
+		fmt.Fprintf(w, "- '%s'\t%s\t(created at %s)\t%d/%d shards\t%s\n", backup.Name, FormatBytes(backup.Size), backup.Date.Format("02-01-2006 15:04:05"), len(backup.Shards), len(shards), complete)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package chbackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newShardServer - fake 'serve' API which runs commands with runErr and lists backups
+func newShardServer(runErr error, backups []Backup) *httptest.Server {
+	jobs := NewJobQueue(10)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		command := strings.Trim(r.URL.Path, "/")
+		switch {
+		case r.Method == http.MethodPost && r.URL.Query().Get("table") == "invalid":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid table"})
+		case r.Method == http.MethodPost:
+			job, _ := jobs.Add(command, func() error {
+				time.Sleep(10 * time.Millisecond)
+				return runErr
+			})
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(job)
+		case strings.HasPrefix(command, "jobs/"):
+			job, _ := jobs.Get(strings.TrimPrefix(command, "jobs/"))
+			json.NewEncoder(w).Encode(job)
+		case command == "list/remote":
+			json.NewEncoder(w).Encode(backups)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestRunOnCluster(t *testing.T) {
+	date := time.Date(2020, 3, 10, 10, 0, 0, 0, time.UTC)
+	first := newShardServer(nil, []Backup{{Name: "a", Size: 10, Date: date}, {Name: "b", Size: 5, Date: date.Add(time.Hour)}})
+	defer first.Close()
+	second := newShardServer(fmt.Errorf("boom"), []Backup{{Name: "a", Size: 20, Date: date.Add(-time.Minute)}})
+	defer second.Close()
+	unavailable := httptest.NewServer(http.NotFoundHandler())
+	unavailable.Close()
+
+	shards := []ClusterShard{
+		{Num: 1, Hosts: []string{unavailable.URL, first.URL}},
+		{Num: 2, Hosts: []string{second.URL}},
+	}
+	client := &clusterClient{client: http.DefaultClient, pollInterval: 5 * time.Millisecond}
+	results := client.runOnCluster(shards, "create-remote/backup", url.Values{"table": {"db.*"}})
+	require.Len(t, results, 2)
+	// unavailable replica is skipped
+	assert.Equal(t, ClusterShardResult{Shard: 1, Host: first.URL, Status: JobSucceeded, Job: results[0].Job}, results[0])
+	assert.Equal(t, "create-remote/backup", results[0].Job.Command)
+	assert.Equal(t, JobFailed, results[1].Status)
+	assert.Equal(t, "boom", results[1].Error)
+
+	out := &bytes.Buffer{}
+	assert.EqualError(t, printClusterResults(results, "create-remote", "backup", OutputFormatText, out), "create-remote of 'backup' failed on 1 of 2 shards")
+	assert.Contains(t, out.String(), fmt.Sprintf("shard 1\t%s\tsucceeded\t\n", first.URL))
+	assert.Contains(t, out.String(), fmt.Sprintf("shard 2\t%s\tfailed\tboom\n", second.URL))
+
+	// errors of API are not retried on other replicas
+	result := client.runJob(ClusterShard{Num: 1, Hosts: []string{first.URL, second.URL}}, "create/backup", url.Values{"table": {"invalid"}})
+	assert.Equal(t, ClusterShardResult{Shard: 1, Host: first.URL, Status: JobFailed, Error: "invalid table"}, result)
+	result = client.runJob(ClusterShard{Num: 3, Hosts: []string{unavailable.URL}}, "create/backup", url.Values{})
+	assert.Contains(t, result.Error, "no replica of shard 3 is available")
+
+	backups, err := client.listBackups(shards, "remote")
+	require.NoError(t, err)
+	assert.Equal(t, []ClusterBackup{
+		{Name: "a", Location: "remote", Size: 30, Date: date.Add(-time.Minute), Shards: []uint32{1, 2}, Complete: true},
+		{Name: "b", Location: "remote", Size: 5, Date: date.Add(time.Hour), Shards: []uint32{1}, Complete: false},
+	}, backups)
+}
+
+func TestRunJobRetriesPolling(t *testing.T) {
+	shard := newShardServer(nil, nil)
+	defer shard.Close()
+	target, err := url.Parse(shard.URL)
+	require.NoError(t, err)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	polls := 0
+	// the first polls of job fail with broken connection, job keeps running on the shard
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/jobs/") {
+			polls++
+			if polls <= 2 {
+				conn, _, err := w.(http.Hijacker).Hijack()
+				require.NoError(t, err)
+				conn.Close()
+				return
+			}
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer flaky.Close()
+
+	// new connection for every request, so transport doesn't retry request on broken connection itself
+	httpClient := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	client := &clusterClient{client: httpClient, pollInterval: 5 * time.Millisecond, pollRetries: 2}
+	result := client.runJob(ClusterShard{Num: 1, Hosts: []string{flaky.URL}}, "create/backup", url.Values{})
+	assert.Equal(t, JobSucceeded, result.Status, result.Error)
+
+	polls = 0
+	client.pollRetries = 1
+	result = client.runJob(ClusterShard{Num: 1, Hosts: []string{flaky.URL}}, "create/backup", url.Values{})
+	assert.Equal(t, JobFailed, result.Status)
+	assert.Contains(t, result.Error, "can't get state of job")
+}
+
+func TestRunJobDoesNotFailOverAfterTimeout(t *testing.T) {
+	started := 0
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started++
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer slow.Close()
+	other := newShardServer(nil, nil)
+	defer other.Close()
+
+	// job may be queued on the first replica already, it must not be started on the other replica of shard
+	client := &clusterClient{client: &http.Client{Timeout: 20 * time.Millisecond}, pollInterval: 5 * time.Millisecond}
+	result := client.runJob(ClusterShard{Num: 1, Hosts: []string{slow.URL, other.URL}}, "create-remote/backup", url.Values{})
+	assert.Equal(t, JobFailed, result.Status)
+	assert.Equal(t, slow.URL, result.Host)
+	assert.Equal(t, 1, started)
+}
@@ -17,15 +17,31 @@ type Config struct {
 	S3         S3Config         `yaml:"s3"`
 	GCS        GCSConfig        `yaml:"gcs"`
 	COS        COSConfig        `yaml:"cos"`
+	FS         FSConfig         `yaml:"fs"`
+	SFTP       SFTPConfig       `yaml:"sftp"`
+	AzureBlob  AzureBlobConfig  `yaml:"azblob"`
+	FTP        FTPConfig        `yaml:"ftp"`
+	Encryption EncryptionConfig `yaml:"encryption"`
+	Retention  RetentionConfig  `yaml:"retention"`
 }
 
 // GeneralConfig - general setting section
 type GeneralConfig struct {
-	RemoteStorage       string `yaml:"remote_storage" envconfig:"REMOTE_STORAGE"`
-	DisableProgressBar  bool   `yaml:"disable_progress_bar" envconfig:"DISABLE_PROGRESS_BAR"`
-	BackupsToKeepLocal  int    `yaml:"backups_to_keep_local" envconfig:"BACKUPS_TO_KEEP_LOCAL"`
-	BackupsToKeepRemote int    `yaml:"backups_to_keep_remote" envconfig:"BACKUPS_TO_KEEP_REMOTE"`
-	ShardBackupPort     int    `yaml:"shard_backup_port" envconfig:"SHARD_BACKUP_PORT"`
+	RemoteStorage           string `yaml:"remote_storage" envconfig:"REMOTE_STORAGE"`
+	DisableProgressBar      bool   `yaml:"disable_progress_bar" envconfig:"DISABLE_PROGRESS_BAR"`
+	BackupsToKeepLocal      int    `yaml:"backups_to_keep_local" envconfig:"BACKUPS_TO_KEEP_LOCAL"`
+	BackupsToKeepRemote     int    `yaml:"backups_to_keep_remote" envconfig:"BACKUPS_TO_KEEP_REMOTE"`
+	ShardBackupPort         int    `yaml:"shard_backup_port" envconfig:"SHARD_BACKUP_PORT"`
+	Cluster                 string `yaml:"cluster" envconfig:"CLUSTER"`
+	JobsHistory             int    `yaml:"jobs_history" envconfig:"JOBS_HISTORY"`
+	LockTimeout             string `yaml:"lock_timeout" envconfig:"LOCK_TIMEOUT"`
+	CompressionConcurrency  int    `yaml:"compression_concurrency" envconfig:"COMPRESSION_CONCURRENCY"`
+	ArchiveLayout           string `yaml:"archive_layout" envconfig:"ARCHIVE_LAYOUT"`
+	ArchiveSplitSize        int64  `yaml:"archive_split_size" envconfig:"ARCHIVE_SPLIT_SIZE"`
+	UploadConcurrency       int    `yaml:"upload_concurrency" envconfig:"UPLOAD_CONCURRENCY"`
+	DownloadConcurrency     int    `yaml:"download_concurrency" envconfig:"DOWNLOAD_CONCURRENCY"`
+	CreateRemoteDiffFrom    string `yaml:"create_remote_diff_from" envconfig:"CREATE_REMOTE_DIFF_FROM"`
+	CreateRemoteDeleteLocal bool   `yaml:"create_remote_delete_local" envconfig:"CREATE_REMOTE_DELETE_LOCAL"`
 }
 
 // GCSConfig - GCS settings section
@@ -68,16 +84,85 @@ type COSConfig struct {
 	Debug             bool   `yaml:"debug" envconfig:"COS_DEBUG"`
 }
 
+// FSConfig - local filesystem or mounted volume settings section
+type FSConfig struct {
+	RootPath          string `yaml:"root_path" envconfig:"FS_ROOT_PATH"`
+	Path              string `yaml:"path" envconfig:"FS_PATH"`
+	CompressionFormat string `yaml:"compression_format" envconfig:"FS_COMPRESSION_FORMAT"`
+	CompressionLevel  int    `yaml:"compression_level" envconfig:"FS_COMPRESSION_LEVEL"`
+}
+
+// SFTPConfig - sftp settings section
+type SFTPConfig struct {
+	Address           string `yaml:"address" envconfig:"SFTP_ADDRESS"`
+	Port              uint   `yaml:"port" envconfig:"SFTP_PORT"`
+	Username          string `yaml:"username" envconfig:"SFTP_USERNAME"`
+	Password          string `yaml:"password" envconfig:"SFTP_PASSWORD"`
+	Key               string `yaml:"key" envconfig:"SFTP_KEY"`
+	KnownHosts        string `yaml:"known_hosts" envconfig:"SFTP_KNOWN_HOSTS"`
+	Path              string `yaml:"path" envconfig:"SFTP_PATH"`
+	Timeout           string `yaml:"timeout" envconfig:"SFTP_TIMEOUT"`
+	CompressionFormat string `yaml:"compression_format" envconfig:"SFTP_COMPRESSION_FORMAT"`
+	CompressionLevel  int    `yaml:"compression_level" envconfig:"SFTP_COMPRESSION_LEVEL"`
+}
+
+// AzureBlobConfig - Azure Blob Storage settings section
+type AzureBlobConfig struct {
+	AccountName           string `yaml:"account_name" envconfig:"AZBLOB_ACCOUNT_NAME"`
+	AccountKey            string `yaml:"account_key" envconfig:"AZBLOB_ACCOUNT_KEY"`
+	SharedAccessSignature string `yaml:"sas" envconfig:"AZBLOB_SAS"`
+	ConnectionString      string `yaml:"connection_string" envconfig:"AZBLOB_CONNECTION_STRING"`
+	EndpointSuffix        string `yaml:"endpoint_suffix" envconfig:"AZBLOB_ENDPOINT_SUFFIX"`
+	Endpoint              string `yaml:"endpoint" envconfig:"AZBLOB_ENDPOINT"`
+	Container             string `yaml:"container" envconfig:"AZBLOB_CONTAINER"`
+	Path                  string `yaml:"path" envconfig:"AZBLOB_PATH"`
+	BlockSize             int    `yaml:"block_size" envconfig:"AZBLOB_BLOCK_SIZE"`
+	MaxBuffers            int    `yaml:"max_buffers" envconfig:"AZBLOB_MAX_BUFFERS"`
+	Timeout               string `yaml:"timeout" envconfig:"AZBLOB_TIMEOUT"`
+	CompressionFormat     string `yaml:"compression_format" envconfig:"AZBLOB_COMPRESSION_FORMAT"`
+	CompressionLevel      int    `yaml:"compression_level" envconfig:"AZBLOB_COMPRESSION_LEVEL"`
+}
+
+// FTPConfig - ftp settings section, passive mode is always used
+type FTPConfig struct {
+	Address           string `yaml:"address" envconfig:"FTP_ADDRESS"`
+	Timeout           string `yaml:"timeout" envconfig:"FTP_TIMEOUT"`
+	Username          string `yaml:"username" envconfig:"FTP_USERNAME"`
+	Password          string `yaml:"password" envconfig:"FTP_PASSWORD"`
+	TLS               bool   `yaml:"tls" envconfig:"FTP_TLS"`
+	SkipTLSVerify     bool   `yaml:"skip_tls_verify" envconfig:"FTP_SKIP_TLS_VERIFY"`
+	Concurrency       int    `yaml:"concurrency" envconfig:"FTP_CONCURRENCY"`
+	Path              string `yaml:"path" envconfig:"FTP_PATH"`
+	CompressionFormat string `yaml:"compression_format" envconfig:"FTP_COMPRESSION_FORMAT"`
+	CompressionLevel  int    `yaml:"compression_level" envconfig:"FTP_COMPRESSION_LEVEL"`
+	Debug             bool   `yaml:"debug" envconfig:"FTP_DEBUG"`
+}
+
+// EncryptionConfig - client-side encryption of backup archives, applied for all remote storages
+type EncryptionConfig struct {
+	Type                 string `yaml:"type" envconfig:"ENCRYPTION_TYPE"`
+	Key                  string `yaml:"key" envconfig:"ENCRYPTION_KEY"`
+	KeyFile              string `yaml:"key_file" envconfig:"ENCRYPTION_KEY_FILE"`
+	RecipientsFile       string `yaml:"recipients_file" envconfig:"ENCRYPTION_RECIPIENTS_FILE"`
+	PrivateKeyFile       string `yaml:"private_key_file" envconfig:"ENCRYPTION_PRIVATE_KEY_FILE"`
+	PrivateKeyPassphrase string `yaml:"private_key_passphrase" envconfig:"ENCRYPTION_PRIVATE_KEY_PASSPHRASE"`
+}
+
 // ClickHouseConfig - clickhouse settings section
 type ClickHouseConfig struct {
-	Username     string   `yaml:"username" envconfig:"CLICKHOUSE_USERNAME"`
-	Password     string   `yaml:"password" envconfig:"CLICKHOUSE_PASSWORD"`
-	Host         string   `yaml:"host" envconfig:"CLICKHOUSE_HOST"`
-	Port         uint     `yaml:"port" envconfig:"CLICKHOUSE_PORT"`
-	DataPath     string   `yaml:"data_path" envconfig:"CLICKHOUSE_DATA_PATH"`
-	SkipTables   []string `yaml:"skip_tables" envconfig:"CLICKHOUSE_SKIP_TABLES"`
-	Timeout      string   `yaml:"timeout" envconfig:"CLICKHOUSE_TIMEOUT"`
-	FreezeByPart bool     `yaml:"freeze_by_part" envconfig:"CLICKHOUSE_FREEZE_BY_PART"`
+	Username                string   `yaml:"username" envconfig:"CLICKHOUSE_USERNAME"`
+	Password                string   `yaml:"password" envconfig:"CLICKHOUSE_PASSWORD"`
+	Host                    string   `yaml:"host" envconfig:"CLICKHOUSE_HOST"`
+	Port                    uint     `yaml:"port" envconfig:"CLICKHOUSE_PORT"`
+	DataPath                string   `yaml:"data_path" envconfig:"CLICKHOUSE_DATA_PATH"`
+	SkipTables              []string `yaml:"skip_tables" envconfig:"CLICKHOUSE_SKIP_TABLES"`
+	Timeout                 string   `yaml:"timeout" envconfig:"CLICKHOUSE_TIMEOUT"`
+	FreezeByPart            bool     `yaml:"freeze_by_part" envconfig:"CLICKHOUSE_FREEZE_BY_PART"`
+	PreserveUUID            bool     `yaml:"preserve_uuid" envconfig:"CLICKHOUSE_PRESERVE_UUID"`
+	ReplicatedBackup        string   `yaml:"replicated_backup" envconfig:"CLICKHOUSE_REPLICATED_BACKUP"`
+	ReplicatedRestore       string   `yaml:"replicated_restore" envconfig:"CLICKHOUSE_REPLICATED_RESTORE"`
+	ReplicatedZookeeperPath string   `yaml:"replicated_zookeeper_path" envconfig:"CLICKHOUSE_REPLICATED_ZOOKEEPER_PATH"`
+	ReplicatedReplicaName   string   `yaml:"replicated_replica_name" envconfig:"CLICKHOUSE_REPLICATED_REPLICA_NAME"`
 }
 
 // LoadConfig - load config from file
@@ -101,18 +186,90 @@ func LoadConfig(configLocation string) (*Config, error) {
 }
 
 func validateConfig(config *Config) error {
-	if _, err := getArchiveWriter(config.S3.CompressionFormat, config.S3.CompressionLevel); err != nil {
+	if config.General.CompressionConcurrency < 0 {
+		return fmt.Errorf("compression_concurrency can't be negative")
+	}
+	if config.General.ArchiveLayout != ArchiveLayoutSingle && config.General.ArchiveLayout != ArchiveLayoutTable {
+		return fmt.Errorf("unknown archive_layout '%s', supported: '%s', '%s'", config.General.ArchiveLayout, ArchiveLayoutSingle, ArchiveLayoutTable)
+	}
+	if config.General.ArchiveSplitSize < 0 {
+		return fmt.Errorf("archive_split_size can't be negative")
+	}
+	if config.General.UploadConcurrency < 1 || config.General.DownloadConcurrency < 1 {
+		return fmt.Errorf("upload_concurrency and download_concurrency must be positive")
+	}
+	if config.General.ArchiveLayout == ArchiveLayoutSingle && config.General.UploadConcurrency > 1 {
+		return fmt.Errorf("upload_concurrency %d requires archive_layout '%s', '%s' layout is uploaded as one archive", config.General.UploadConcurrency, ArchiveLayoutTable, ArchiveLayoutSingle)
+	}
+	switch config.General.CreateRemoteDiffFrom {
+	case DiffFromNone, DiffFromLocal, DiffFromRemote:
+	default:
+		return fmt.Errorf("unknown create_remote_diff_from '%s', supported: '%s', '%s', '%s'", config.General.CreateRemoteDiffFrom, DiffFromNone, DiffFromLocal, DiffFromRemote)
+	}
+	for option, mode := range map[string]string{"replicated_backup": config.ClickHouse.ReplicatedBackup, "replicated_restore": config.ClickHouse.ReplicatedRestore} {
+		if mode != ReplicatedAll && mode != ReplicatedFirstReplica {
+			return fmt.Errorf("unknown %s '%s', supported: '%s', '%s'", option, mode, ReplicatedAll, ReplicatedFirstReplica)
+		}
+	}
+	if err := config.Retention.Local.validate("local"); err != nil {
+		return err
+	}
+	if err := config.Retention.Remote.validate("remote"); err != nil {
+		return err
+	}
+	if _, err := getArchiveWriter(config.S3.CompressionFormat, config.S3.CompressionLevel, config.General.CompressionConcurrency); err != nil {
+		return err
+	}
+	if _, err := getArchiveWriter(config.GCS.CompressionFormat, config.GCS.CompressionLevel, config.General.CompressionConcurrency); err != nil {
+		return err
+	}
+	if _, err := getArchiveWriter(config.FS.CompressionFormat, config.FS.CompressionLevel, config.General.CompressionConcurrency); err != nil {
+		return err
+	}
+	if _, err := getArchiveWriter(config.SFTP.CompressionFormat, config.SFTP.CompressionLevel, config.General.CompressionConcurrency); err != nil {
+		return err
+	}
+	if _, err := time.ParseDuration(config.SFTP.Timeout); err != nil {
+		return err
+	}
+	if _, err := getArchiveWriter(config.AzureBlob.CompressionFormat, config.AzureBlob.CompressionLevel, config.General.CompressionConcurrency); err != nil {
+		return err
+	}
+	if _, err := time.ParseDuration(config.AzureBlob.Timeout); err != nil {
+		return err
+	}
+	if config.AzureBlob.BlockSize < 1 || config.AzureBlob.MaxBuffers < 1 {
+		return fmt.Errorf("azblob block_size and max_buffers must be positive")
+	}
+	if _, err := getArchiveWriter(config.FTP.CompressionFormat, config.FTP.CompressionLevel, config.General.CompressionConcurrency); err != nil {
 		return err
 	}
-	if _, err := getArchiveWriter(config.GCS.CompressionFormat, config.GCS.CompressionLevel); err != nil {
+	if _, err := time.ParseDuration(config.FTP.Timeout); err != nil {
 		return err
 	}
+	if config.FTP.Concurrency < 1 {
+		return fmt.Errorf("ftp concurrency must be positive")
+	}
+	switch config.Encryption.Type {
+	case "", EncryptionAESGCM, EncryptionOpenPGP:
+	default:
+		return fmt.Errorf("unknown encryption type '%s', supported: '%s', '%s'", config.Encryption.Type, EncryptionAESGCM, EncryptionOpenPGP)
+	}
+	if config.General.RemoteStorage == "fs" && config.FS.RootPath == "" {
+		return fmt.Errorf("fs root_path must be set for 'fs' remote_storage")
+	}
+	if config.General.RemoteStorage == "sftp" && config.SFTP.Path == "" {
+		return fmt.Errorf("sftp path must be set for 'sftp' remote_storage, use '.' for home directory of the user")
+	}
 	if _, err := time.ParseDuration(config.ClickHouse.Timeout); err != nil {
 		return err
 	}
 	if _, err := time.ParseDuration(config.COS.Timeout); err != nil {
 		return err
 	}
+	if _, err := time.ParseDuration(config.General.LockTimeout); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -126,9 +283,16 @@ func PrintDefaultConfig() {
 func DefaultConfig() *Config {
 	return &Config{
 		General: GeneralConfig{
-			RemoteStorage:       "s3",
-			BackupsToKeepLocal:  0,
-			BackupsToKeepRemote: 0,
+			RemoteStorage:        "s3",
+			BackupsToKeepLocal:   0,
+			BackupsToKeepRemote:  0,
+			JobsHistory:          100,
+			LockTimeout:          "0s",
+			ArchiveLayout:        ArchiveLayoutSingle,
+			ArchiveSplitSize:     1024 * 1024 * 1024,
+			UploadConcurrency:    1,
+			DownloadConcurrency:  1,
+			CreateRemoteDiffFrom: DiffFromNone,
 		},
 		ClickHouse: ClickHouseConfig{
 			Username: "default",
@@ -138,7 +302,9 @@ func DefaultConfig() *Config {
 			SkipTables: []string{
 				"system.*",
 			},
-			Timeout: "5m",
+			Timeout:           "5m",
+			ReplicatedBackup:  ReplicatedAll,
+			ReplicatedRestore: ReplicatedAll,
 		},
 		S3: S3Config{
 			Region:                  "us-east-1",
@@ -163,5 +329,30 @@ func DefaultConfig() *Config {
 			CompressionLevel:  1,
 			Debug:             false,
 		},
+		FS: FSConfig{
+			CompressionFormat: "gzip",
+			CompressionLevel:  1,
+		},
+		SFTP: SFTPConfig{
+			Port:              22,
+			Path:              ".",
+			Timeout:           "2m",
+			CompressionFormat: "gzip",
+			CompressionLevel:  1,
+		},
+		AzureBlob: AzureBlobConfig{
+			EndpointSuffix:    "core.windows.net",
+			BlockSize:         16 * 1024 * 1024,
+			MaxBuffers:        3,
+			Timeout:           "15m",
+			CompressionFormat: "gzip",
+			CompressionLevel:  1,
+		},
+		FTP: FTPConfig{
+			Timeout:           "2m",
+			Concurrency:       3,
+			CompressionFormat: "gzip",
+			CompressionLevel:  1,
+		},
 	}
 }
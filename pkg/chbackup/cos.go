@@ -2,6 +2,7 @@ package chbackup
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
@@ -99,6 +100,17 @@ func (c *COS) GetFileReader(key string) (io.ReadCloser, error) {
 	return resp.Body, nil
 }
 
+// GetFileReaderWithOffset - read object starting from offset with ranged GET
+func (c *COS) GetFileReaderWithOffset(key string, offset int64) (io.ReadCloser, error) {
+	resp, err := c.client.Object.Get(context.Background(), key, &cos.ObjectGetOptions{
+		Range: fmt.Sprintf("bytes=%d-", offset),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
 func (c *COS) PutFile(key string, r io.ReadCloser) error {
 	_, err := c.client.Object.Put(context.Background(), key, r, nil)
 	return err
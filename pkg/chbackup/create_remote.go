@@ -0,0 +1,127 @@
+package chbackup
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+)
+
+const (
+	// DiffFromNone - create-remote uploads full backup
+	DiffFromNone = "none"
+	// DiffFromLocal - create-remote uploads increment from the latest local backup
+	DiffFromLocal = "local"
+	// DiffFromRemote - create-remote uploads increment from the latest remote backup, it's compared with manifest when it isn't stored locally
+	DiffFromRemote = "remote"
+)
+
+// selectDiffBase - choose base of incremental upload of backupName according to create_remote_diff_from
+// empty name means full upload, backups of old format can't be used as base
+// local backups are used only if they are uploaded too, otherwise required backup of increment is missing on remote storage
+func selectDiffBase(config Config, backupName string) (string, error) {
+	if config.General.CreateRemoteDiffFrom == DiffFromNone {
+		return "", nil
+	}
+	localBackups, err := ListLocalBackups(config)
+	if err != nil {
+		return "", err
+	}
+	bd, err := NewBackupDestination(config)
+	if err != nil {
+		return "", err
+	}
+	if err := bd.Connect(); err != nil {
+		return "", err
+	}
+	remoteBackups, err := bd.BackupList()
+	if err != nil {
+		return "", err
+	}
+	dataPath := getDataPath(config)
+	if dataPath == "" {
+		return "", ErrUnknownClickhouseDataPath
+	}
+	uploaded := map[string]bool{}
+	for _, backup := range remoteBackups {
+		uploaded[backup.Name] = true
+	}
+	candidates := map[string]bool{}
+	for _, backup := range localBackups {
+		if backup.Name != backupName && uploaded[backup.Name] && !isClickhouseShadow(path.Join(dataPath, "backup", backup.Name, "shadow")) {
+			candidates[backup.Name] = true
+		}
+	}
+	if config.General.CreateRemoteDiffFrom == DiffFromLocal {
+		for i := len(localBackups) - 1; i >= 0; i-- {
+			if candidates[localBackups[i].Name] {
+				return localBackups[i].Name, nil
+			}
+		}
+		return "", nil
+	}
+	for i := len(remoteBackups) - 1; i >= 0; i-- {
+		name := remoteBackups[i].Name
+		if candidates[name] {
+			return name, nil
+		}
+		if name == backupName {
+			continue
+		}
+		// only backups with manifest can be compared remotely, manifest of empty backup has no tables but it's valid base
+		_, err := bd.GetManifest(name)
+		if err == nil {
+			return name, nil
+		}
+		if err != ErrNotFound {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// CreateRemote - create backup of tables matched by tablePattern and upload it
+// base of incremental upload is diffFrom or chosen by create_remote_diff_from when diffFrom is empty
+// shadow is cleaned on any failure, backup which is not created completely is removed, backup which is not uploaded is kept for 'upload' command
+func CreateRemote(config Config, backupName, tablePattern, diffFrom string) (err error) {
+	if backupName == "" {
+		backupName = NewBackupName()
+	}
+	if err := ValidateBackupName(backupName); err != nil {
+		return err
+	}
+	if err := ValidateBackupName(diffFrom); err != nil {
+		return err
+	}
+	dataPath := getDataPath(config)
+	if dataPath == "" {
+		return ErrUnknownClickhouseDataPath
+	}
+	backupPath := path.Join(dataPath, "backup", backupName)
+	_, statErr := os.Stat(backupPath)
+	if err := CreateBackup(config, backupName, tablePattern, false); err != nil {
+		// backup with the same name existed before and isn't touched
+		if os.IsNotExist(statErr) {
+			os.RemoveAll(backupPath)
+		}
+		return err
+	}
+	if diffFrom == "" {
+		if diffFrom, err = selectDiffBase(config, backupName); err != nil {
+			return fmt.Errorf("can't choose base backup with %v", err)
+		}
+	}
+	if diffFrom != "" {
+		log.Printf("Upload '%s' as increment from '%s'", backupName, diffFrom)
+	}
+	if err := Upload(config, backupName, diffFrom, true); err != nil {
+		log.Printf("Backup '%s' is kept locally, run 'upload' to continue", backupName)
+		return err
+	}
+	if config.General.CreateRemoteDeleteLocal {
+		if err := RemoveBackupLocal(config, backupName); err != nil {
+			return fmt.Errorf("can't remove local backup with %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package chbackup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectDiffBase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clickhouse-backup-create-remote")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "remote")
+	require.NoError(t, os.MkdirAll(root, os.ModePerm))
+
+	config := DefaultConfig()
+	config.ClickHouse.DataPath = filepath.Join(dir, "data")
+	config.General.RemoteStorage = "fs"
+	config.General.DisableProgressBar = true
+	config.FS.RootPath = root
+	bd, err := NewBackupDestination(*config)
+	require.NoError(t, err)
+	require.NoError(t, bd.Connect())
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, name := range []string{"a", "b", "old", "new"} {
+		backupPath := filepath.Join(dir, "data", "backup", name)
+		shadowPath := filepath.Join(backupPath, "shadow", "db")
+		if name == "old" {
+			shadowPath = filepath.Join(backupPath, "shadow", "1")
+		}
+		require.NoError(t, os.MkdirAll(shadowPath, os.ModePerm))
+		require.NoError(t, os.Chtimes(backupPath, date.Add(time.Duration(i)*time.Hour), date.Add(time.Duration(i)*time.Hour)))
+	}
+	require.NoError(t, bd.CompressedStreamUpload(filepath.Join(dir, "data", "backup", "a"), "a", ""))
+
+	// 'b' is newer but it isn't uploaded, increment from it couldn't be restored from remote storage
+	for policy, expected := range map[string]string{DiffFromNone: "", DiffFromLocal: "a", DiffFromRemote: "a"} {
+		config.General.CreateRemoteDiffFrom = policy
+		base, err := selectDiffBase(*config, "new")
+		assert.NoError(t, err)
+		assert.Equal(t, expected, base, policy)
+	}
+
+	// backup which is stored only remotely is compared with manifest
+	require.NoError(t, bd.PutManifest("remote-only", &BackupManifest{
+		BackupName:   "remote-only",
+		CreationDate: time.Now().Add(time.Hour),
+		Tables:       []ManifestTable{{Database: "db", Name: "t"}},
+	}))
+	require.NoError(t, bd.CompressedStreamUpload(filepath.Join(dir, "data", "backup", "b"), "b", ""))
+	for policy, expected := range map[string]string{DiffFromLocal: "b", DiffFromRemote: "remote-only"} {
+		config.General.CreateRemoteDiffFrom = policy
+		base, err := selectDiffBase(*config, "new")
+		assert.NoError(t, err)
+		assert.Equal(t, expected, base, policy)
+	}
+
+	// backup without tables has manifest too, so it's valid base
+	require.NoError(t, bd.PutManifest("empty", &BackupManifest{
+		BackupName:   "empty",
+		CreationDate: time.Now().Add(2 * time.Hour),
+	}))
+	config.General.CreateRemoteDiffFrom = DiffFromRemote
+	base, err := selectDiffBase(*config, "new")
+	assert.NoError(t, err)
+	assert.Equal(t, "empty", base)
+}
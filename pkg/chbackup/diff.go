@@ -0,0 +1,156 @@
+package chbackup
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// diffBase - base backup of incremental upload, files which are stored in base backup are listed in meta file instead of being packed
+type diffBase struct {
+	name string
+	// path - directory of local base backup, files are compared with os.SameFile
+	path string
+	// parts - parts of remote base backup which are the same in uploaded backup, key is 'shadow/<db>/<table>/<part>'
+	parts map[string]bool
+}
+
+// newLocalDiffBase - base backup stored locally, empty path means full upload
+func newLocalDiffBase(diffFromPath string) (*diffBase, error) {
+	if diffFromPath == "" {
+		return nil, nil
+	}
+	if err := checkDiffFromPath(diffFromPath); err != nil {
+		return nil, err
+	}
+	return &diffBase{name: filepath.Base(diffFromPath), path: diffFromPath}, nil
+}
+
+// newDiffBase - base of incremental upload of backup stored in backupPath, empty diffFrom means full upload
+// files are compared by hardlinks when diffFrom is stored locally and with manifest of remote backup otherwise
+func (bd *BackupDestination) newDiffBase(dataPath, backupPath, diffFrom string) (*diffBase, error) {
+	if diffFrom == "" {
+		return nil, nil
+	}
+	diffFromPath := path.Join(dataPath, "backup", diffFrom)
+	if _, err := os.Stat(diffFromPath); !os.IsNotExist(err) {
+		return newLocalDiffBase(diffFromPath)
+	}
+	manifest, err := bd.GetManifest(diffFrom)
+	if err == ErrNotFound {
+		return nil, fmt.Errorf("'%s' is not found locally and has no %s on remote storage", diffFrom, ManifestFileName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't get %s of '%s' with %v", ManifestFileName, diffFrom, err)
+	}
+	log.Printf("'%s' is not found locally, parts are compared with %s of remote backup", diffFrom, ManifestFileName)
+	return newRemoteDiffBase(backupPath, manifest)
+}
+
+// partFiles - files of data part, key is file name, value is file of manifest with name relative to backup directory
+type partFiles map[string]ManifestFile
+
+// unchecksummedFiles - files of data part which are not described by checksums.txt and are compared by content
+var unchecksummedFiles = []string{ChecksumsFileName, "columns.txt"}
+
+// samePart - check that part of local backup is the same as part of base backup
+// files listed in checksums.txt are compared by size only because equal checksums.txt guarantee equal content
+func samePart(local, base partFiles) bool {
+	if _, ok := base[ChecksumsFileName]; !ok || len(local) != len(base) {
+		return false
+	}
+	for name, baseFile := range base {
+		localFile, ok := local[name]
+		if !ok || localFile.Size != baseFile.Size {
+			return false
+		}
+	}
+	for _, name := range unchecksummedFiles {
+		if _, ok := base[name]; ok && local[name].Checksum != base[name].Checksum {
+			return false
+		}
+	}
+	return true
+}
+
+// newRemoteDiffBase - compare parts of local backup with parts described by manifest of remote base backup
+// part is taken from base backup if it has the same name, the same files and the same checksums.txt
+func newRemoteDiffBase(localPath string, base *BackupManifest) (*diffBase, error) {
+	baseParts := map[string]partFiles{}
+	for _, table := range base.Tables {
+		for _, part := range table.Parts {
+			for _, file := range part.Files {
+				partKey := path.Dir(file.Name)
+				if baseParts[partKey] == nil {
+					baseParts[partKey] = partFiles{}
+				}
+				baseParts[partKey][path.Base(file.Name)] = file
+			}
+		}
+	}
+	localParts := map[string]partFiles{}
+	if err := filepath.Walk(filepath.Join(localPath, "shadow"), func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		relativePath := strings.TrimPrefix(strings.TrimPrefix(filepath.ToSlash(filePath), filepath.ToSlash(localPath)), "/")
+		if pathParts := strings.Split(relativePath, "/"); len(pathParts) != 5 {
+			return nil
+		}
+		partKey, name := path.Dir(relativePath), path.Base(relativePath)
+		if _, ok := baseParts[partKey]; !ok {
+			return nil
+		}
+		file := ManifestFile{Name: relativePath, Size: info.Size()}
+		for _, unchecksummed := range unchecksummedFiles {
+			if name == unchecksummed {
+				if file, err = getManifestFile(localPath, filePath); err != nil {
+					return err
+				}
+			}
+		}
+		if localParts[partKey] == nil {
+			localParts[partKey] = partFiles{}
+		}
+		localParts[partKey][name] = file
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("can't compare parts with '%s' with %v", base.BackupName, err)
+	}
+	result := &diffBase{name: base.BackupName, parts: map[string]bool{}}
+	for partKey, files := range localParts {
+		if samePart(files, baseParts[partKey]) {
+			result.parts[partKey] = true
+		}
+	}
+	return result, nil
+}
+
+// contains - check that file of uploaded backup is stored in base backup, info is stat of the file in uploaded backup
+func (d *diffBase) contains(relativePath string, info os.FileInfo) bool {
+	if d == nil {
+		return false
+	}
+	if d.path != "" {
+		baseFile, err := os.Stat(filepath.Join(d.path, relativePath))
+		return err == nil && os.SameFile(info, baseFile)
+	}
+	return d.parts[path.Dir(relativePath)] && strings.HasPrefix(relativePath, "shadow/")
+}
+
+// backupName - name of base backup which is written to meta file and manifest, empty for full upload
+func (d *diffBase) backupName() string {
+	if d == nil {
+		return ""
+	}
+	return d.name
+}
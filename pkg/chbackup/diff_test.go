@@ -0,0 +1,92 @@
+package chbackup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteDiffBase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clickhouse-backup-diff")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "remote")
+	dataPath := filepath.Join(dir, "data")
+	require.NoError(t, os.MkdirAll(root, os.ModePerm))
+
+	writePart := func(backupName, partName, checksums, data string) {
+		partPath := filepath.Join(dataPath, "backup", backupName, "shadow", "db", "t", partName)
+		require.NoError(t, os.MkdirAll(partPath, os.ModePerm))
+		for name, content := range map[string]string{ChecksumsFileName: checksums, "columns.txt": "columns", "data.bin": data} {
+			require.NoError(t, ioutil.WriteFile(filepath.Join(partPath, name), []byte(content), 0640))
+		}
+	}
+	writePart("full", "all_1_1_0", "checksums 1", "data")
+	writePart("full", "all_2_2_0", "checksums 2", "data 2")
+	// parts are copied, not hardlinked, the same as after download of base backup and its removal
+	writePart("diff", "all_1_1_0", "checksums 1", "data")
+	writePart("diff", "all_2_2_0", "checksums 3", "data 3")
+	writePart("diff", "all_3_3_0", "checksums 4", "new data")
+
+	config := DefaultConfig()
+	config.General.RemoteStorage = "fs"
+	config.General.DisableProgressBar = true
+	config.FS.RootPath = root
+	bd, err := NewBackupDestination(*config)
+	require.NoError(t, err)
+	require.NoError(t, bd.Connect())
+
+	fullPath := filepath.Join(dataPath, "backup", "full")
+	diffPath := filepath.Join(dataPath, "backup", "diff")
+	manifest := &BackupManifest{BackupName: "full", Tables: []ManifestTable{{Database: "db", Name: "t"}}}
+	for _, partName := range []string{"all_1_1_0", "all_2_2_0"} {
+		part := ManifestPart{Name: partName}
+		for _, name := range []string{ChecksumsFileName, "columns.txt", "data.bin"} {
+			file, err := getManifestFile(fullPath, filepath.Join(fullPath, "shadow", "db", "t", partName, name))
+			require.NoError(t, err)
+			part.Files = append(part.Files, file)
+		}
+		manifest.Tables[0].Parts = append(manifest.Tables[0].Parts, part)
+	}
+	require.NoError(t, bd.compressedStreamUpload(fullPath, "full", nil))
+	require.NoError(t, bd.PutManifest("full", manifest))
+	require.NoError(t, os.RemoveAll(fullPath))
+
+	_, err = bd.newDiffBase(dataPath, diffPath, "missing")
+	assert.EqualError(t, err, "'missing' is not found locally and has no manifest.json on remote storage")
+	base, err := bd.newDiffBase(dataPath, diffPath, "full")
+	require.NoError(t, err)
+	assert.Equal(t, "full", base.backupName())
+	assert.Equal(t, map[string]bool{"shadow/db/t/all_1_1_0": true}, base.parts)
+
+	require.NoError(t, bd.compressedStreamUpload(diffPath, "diff", base))
+	require.NoError(t, os.RemoveAll(diffPath))
+	require.NoError(t, bd.CompressedStreamDownload("diff", diffPath, ""))
+	for name, expected := range map[string]string{"all_1_1_0/data.bin": "data", "all_2_2_0/data.bin": "data 3", "all_3_3_0/data.bin": "new data"} {
+		content, err := ioutil.ReadFile(filepath.Join(diffPath, "shadow", "db", "t", name))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(content))
+	}
+	// unchanged part is taken from base backup
+	_, err = os.Stat(filepath.Join(fullPath, "shadow", "db", "t", "all_1_1_0", "data.bin"))
+	assert.NoError(t, err)
+}
+
+func TestSamePart(t *testing.T) {
+	base := partFiles{
+		ChecksumsFileName: {Size: 10, Checksum: "a"},
+		"columns.txt":     {Size: 5, Checksum: "b"},
+		"data.bin":        {Size: 100, Checksum: "c"},
+	}
+	assert.True(t, samePart(partFiles{ChecksumsFileName: {Size: 10, Checksum: "a"}, "columns.txt": {Size: 5, Checksum: "b"}, "data.bin": {Size: 100}}, base))
+	assert.False(t, samePart(partFiles{ChecksumsFileName: {Size: 10, Checksum: "x"}, "columns.txt": {Size: 5, Checksum: "b"}, "data.bin": {Size: 100}}, base))
+	assert.False(t, samePart(partFiles{ChecksumsFileName: {Size: 10, Checksum: "a"}, "columns.txt": {Size: 5, Checksum: "x"}, "data.bin": {Size: 100}}, base))
+	assert.False(t, samePart(partFiles{ChecksumsFileName: {Size: 10, Checksum: "a"}, "columns.txt": {Size: 5, Checksum: "b"}, "data.bin": {Size: 99}}, base))
+	assert.False(t, samePart(partFiles{ChecksumsFileName: {Size: 10, Checksum: "a"}, "columns.txt": {Size: 5, Checksum: "b"}}, base))
+	// parts without checksums.txt are never taken from base backup
+	assert.False(t, samePart(partFiles{"data.bin": {Size: 100}}, partFiles{"data.bin": {Size: 100}}))
+}
@@ -0,0 +1,359 @@
+package chbackup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	// keys without hash preferences require RIPEMD160 in openpgp.Encrypt
+	_ "golang.org/x/crypto/ripemd160"
+)
+
+const (
+	// EncryptionAESGCM - archive is encrypted by AES-256-GCM in authenticated chunks with the key from config
+	EncryptionAESGCM = "aes-256-gcm"
+	// EncryptionOpenPGP - archive is encrypted for OpenPGP recipients
+	EncryptionOpenPGP = "openpgp"
+
+	// encryptedMagicSize - encrypted archives start with magic so download detects encryption without config hints
+	encryptedMagicSize = 8
+	aesGCMMagic        = "CHBAES01"
+	aesGCMKeySize      = 32
+	openPGPMagic       = "CHBPGP01"
+	aesGCMKeyIDSize    = 8
+	aesGCMPrefixSize   = 7
+	aesGCMChunkSize    = 64 * 1024
+)
+
+// ErrArchiveEncrypted - returned when encrypted archive is downloaded without encryption settings
+var ErrArchiveEncrypted = errors.New("archive is encrypted, set 'encryption' section in config")
+
+// ManifestEncryption - encryption of uploaded archive recorded in the manifest
+type ManifestEncryption struct {
+	Type  string `json:"type"`
+	KeyID string `json:"key_id"`
+}
+
+// archiveEncryption - encrypt archives on upload and decrypt them on download
+type archiveEncryption struct {
+	kind          string
+	aesKey        []byte
+	keyID         string
+	pgpRecipients openpgp.EntityList
+	pgpKeyring    openpgp.EntityList
+}
+
+// decodeKey - key is accepted as 64 hex characters or base64 of 32 bytes, raw strings are rejected so passphrase isn't used as weak key
+func decodeKey(key []byte) ([]byte, error) {
+	text := strings.TrimSpace(string(key))
+	if len(text) == 2*aesGCMKeySize {
+		if decoded, err := hex.DecodeString(text); err == nil {
+			return decoded, nil
+		}
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(text); err == nil && len(decoded) == aesGCMKeySize {
+		return decoded, nil
+	}
+	return nil, fmt.Errorf("encryption key must be 32 bytes encoded as 64 hex characters or base64, generate it with 'openssl rand -hex 32'")
+}
+
+func readKeyring(fileName string) (openpgp.EntityList, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(content)); err == nil {
+		return keyring, nil
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader(content))
+}
+
+// newArchiveEncryption - load keys from config, returns nil if encryption is disabled
+func newArchiveEncryption(config EncryptionConfig) (*archiveEncryption, error) {
+	switch config.Type {
+	case "":
+		return nil, nil
+	case EncryptionAESGCM:
+		key := []byte(config.Key)
+		if config.KeyFile != "" {
+			var err error
+			if key, err = ioutil.ReadFile(config.KeyFile); err != nil {
+				return nil, fmt.Errorf("can't read encryption key_file with %v", err)
+			}
+		}
+		if len(key) == 0 {
+			return nil, fmt.Errorf("encryption key or key_file must be set for '%s'", EncryptionAESGCM)
+		}
+		aesKey, err := decodeKey(key)
+		if err != nil {
+			return nil, err
+		}
+		keyHash := sha256.Sum256(aesKey)
+		return &archiveEncryption{
+			kind:   EncryptionAESGCM,
+			aesKey: aesKey,
+			keyID:  hex.EncodeToString(keyHash[:aesGCMKeyIDSize]),
+		}, nil
+	case EncryptionOpenPGP:
+		e := &archiveEncryption{kind: EncryptionOpenPGP}
+		if config.RecipientsFile != "" {
+			recipients, err := readKeyring(config.RecipientsFile)
+			if err != nil {
+				return nil, fmt.Errorf("can't read encryption recipients_file with %v", err)
+			}
+			keyIDs := []string{}
+			for _, recipient := range recipients {
+				keyIDs = append(keyIDs, recipient.PrimaryKey.KeyIdString())
+			}
+			e.pgpRecipients = recipients
+			e.keyID = strings.Join(keyIDs, ",")
+		}
+		if config.PrivateKeyFile != "" {
+			keyring, err := readKeyring(config.PrivateKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("can't read encryption private_key_file with %v", err)
+			}
+			passphrase := []byte(config.PrivateKeyPassphrase)
+			for _, entity := range keyring {
+				if entity.PrivateKey != nil && entity.PrivateKey.Encrypted {
+					if err := entity.PrivateKey.Decrypt(passphrase); err != nil {
+						return nil, fmt.Errorf("can't decrypt private key with %v", err)
+					}
+				}
+				for _, subkey := range entity.Subkeys {
+					if subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted {
+						if err := subkey.PrivateKey.Decrypt(passphrase); err != nil {
+							return nil, fmt.Errorf("can't decrypt private key with %v", err)
+						}
+					}
+				}
+			}
+			e.pgpKeyring = keyring
+		}
+		if e.pgpRecipients == nil && e.pgpKeyring == nil {
+			return nil, fmt.Errorf("encryption recipients_file or private_key_file must be set for '%s'", EncryptionOpenPGP)
+		}
+		return e, nil
+	}
+	return nil, fmt.Errorf("unknown encryption type '%s', supported: '%s', '%s'", config.Type, EncryptionAESGCM, EncryptionOpenPGP)
+}
+
+// info - encryption description for the manifest
+func (e *archiveEncryption) info() *ManifestEncryption {
+	if e == nil {
+		return nil
+	}
+	return &ManifestEncryption{Type: e.kind, KeyID: e.keyID}
+}
+
+func (e *archiveEncryption) newGCM() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(e.aesKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newAESGCMPrefix - random nonce prefix of archive
+func newAESGCMPrefix() ([]byte, error) {
+	prefix := make([]byte, aesGCMPrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	return prefix, nil
+}
+
+// encryptWriter - wrap archive writer, Close must be called to write the last chunk, underlying writer is not closed
+// nonce prefix of AES-256-GCM is random for every archive and never reused, chunk counter starts from 0 for every prefix
+func (e *archiveEncryption) encryptWriter(w io.Writer) (io.WriteCloser, error) {
+	switch e.kind {
+	case EncryptionAESGCM:
+		aead, err := e.newGCM()
+		if err != nil {
+			return nil, err
+		}
+		header := make([]byte, 0, encryptedMagicSize+aesGCMKeyIDSize+aesGCMPrefixSize)
+		header = append(header, aesGCMMagic...)
+		keyID, _ := hex.DecodeString(e.keyID)
+		header = append(header, keyID...)
+		prefix, err := newAESGCMPrefix()
+		if err != nil {
+			return nil, err
+		}
+		header = append(header, prefix...)
+		if _, err := w.Write(header); err != nil {
+			return nil, err
+		}
+		return &aesGCMWriter{w: w, aead: aead, prefix: prefix, buf: make([]byte, 0, aesGCMChunkSize)}, nil
+	case EncryptionOpenPGP:
+		if len(e.pgpRecipients) == 0 {
+			return nil, fmt.Errorf("encryption recipients_file must be set to upload backups")
+		}
+		if _, err := w.Write([]byte(openPGPMagic)); err != nil {
+			return nil, err
+		}
+		return openpgp.Encrypt(w, e.pgpRecipients, nil, &openpgp.FileHints{IsBinary: true}, nil)
+	}
+	return nil, fmt.Errorf("unknown encryption type '%s'", e.kind)
+}
+
+// decryptReader - detect encrypted archive by magic and decrypt it, not encrypted archives are passed as is
+func (e *archiveEncryption) decryptReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReaderSize(r, aesGCMChunkSize)
+	magic, err := br.Peek(encryptedMagicSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch string(magic) {
+	case aesGCMMagic:
+		if e == nil || e.kind != EncryptionAESGCM {
+			return nil, ErrArchiveEncrypted
+		}
+		header := make([]byte, encryptedMagicSize+aesGCMKeyIDSize+aesGCMPrefixSize)
+		if _, err := io.ReadFull(br, header); err != nil {
+			return nil, fmt.Errorf("can't read encryption header with %v", err)
+		}
+		keyID := hex.EncodeToString(header[encryptedMagicSize : encryptedMagicSize+aesGCMKeyIDSize])
+		if keyID != e.keyID {
+			return nil, fmt.Errorf("archive is encrypted with key '%s' but key '%s' is configured", keyID, e.keyID)
+		}
+		aead, err := e.newGCM()
+		if err != nil {
+			return nil, err
+		}
+		return &aesGCMReader{r: br, aead: aead, prefix: header[encryptedMagicSize+aesGCMKeyIDSize:]}, nil
+	case openPGPMagic:
+		if e == nil || e.kind != EncryptionOpenPGP {
+			return nil, ErrArchiveEncrypted
+		}
+		if len(e.pgpKeyring) == 0 {
+			return nil, fmt.Errorf("encryption private_key_file must be set to download backups")
+		}
+		if _, err := br.Discard(encryptedMagicSize); err != nil {
+			return nil, err
+		}
+		md, err := openpgp.ReadMessage(br, e.pgpKeyring, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("can't decrypt archive with %v", err)
+		}
+		return md.UnverifiedBody, nil
+	}
+	return br, nil
+}
+
+// aesGCMNonce - 7 bytes random prefix of archive, 4 bytes chunk counter and 1 byte flag of the last chunk
+// last chunk flag prevents undetected truncation of archive
+func aesGCMNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 0, aesGCMPrefixSize+5)
+	nonce = append(nonce, prefix...)
+	var c [4]byte
+	binary.BigEndian.PutUint32(c[:], counter)
+	nonce = append(nonce, c[:]...)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+type aesGCMWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+func (w *aesGCMWriter) seal(last bool) error {
+	if w.counter == ^uint32(0) {
+		return fmt.Errorf("archive is too large for encryption")
+	}
+	chunk := w.aead.Seal(nil, aesGCMNonce(w.prefix, w.counter, last), w.buf, nil)
+	w.counter++
+	w.buf = w.buf[:0]
+	_, err := w.w.Write(chunk)
+	return err
+}
+
+func (w *aesGCMWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		// full chunk is sealed only when more data comes, otherwise it will be the last one
+		if len(w.buf) == aesGCMChunkSize {
+			if err := w.seal(false); err != nil {
+				return 0, err
+			}
+		}
+		size := aesGCMChunkSize - len(w.buf)
+		if size > len(p) {
+			size = len(p)
+		}
+		w.buf = append(w.buf, p[:size]...)
+		p = p[size:]
+	}
+	return n, nil
+}
+
+func (w *aesGCMWriter) Close() error {
+	return w.seal(true)
+}
+
+type aesGCMReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	plain   []byte
+	done    bool
+}
+
+func (r *aesGCMReader) readChunk() error {
+	chunk := make([]byte, aesGCMChunkSize+r.aead.Overhead())
+	n, err := io.ReadFull(r.r, chunk)
+	last := false
+	switch err {
+	case nil:
+		if _, err := r.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	case io.EOF, io.ErrUnexpectedEOF:
+		last = true
+	default:
+		return err
+	}
+	plain, err := r.aead.Open(chunk[:0], aesGCMNonce(r.prefix, r.counter, last), chunk[:n], nil)
+	if err != nil {
+		return fmt.Errorf("can't decrypt archive, it is corrupted or truncated")
+	}
+	r.counter++
+	r.plain = plain
+	r.done = last
+	return nil
+}
+
+func (r *aesGCMReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
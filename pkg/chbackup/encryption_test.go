@@ -0,0 +1,185 @@
+package chbackup
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/openpgp"
+)
+
+const testEncryptionKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+func encryptForTest(t *testing.T, e *archiveEncryption, data []byte) []byte {
+	buf := &bytes.Buffer{}
+	w, err := e.encryptWriter(buf)
+	require.NoError(t, err)
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func decryptForTest(e *archiveEncryption, data []byte) ([]byte, error) {
+	r, err := e.decryptReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestAESGCMEncryption(t *testing.T) {
+	e, err := newArchiveEncryption(EncryptionConfig{Type: EncryptionAESGCM, Key: testEncryptionKey})
+	require.NoError(t, err)
+	assert.Len(t, e.keyID, 16)
+
+	for _, size := range []int{0, 1, aesGCMChunkSize - 1, aesGCMChunkSize, aesGCMChunkSize + 1, 3 * aesGCMChunkSize} {
+		data := testPattern(size)
+		encrypted := encryptForTest(t, e, data)
+		decrypted, err := decryptForTest(e, encrypted)
+		assert.NoError(t, err, "size %d", size)
+		assert.Equal(t, data, decrypted, "size %d", size)
+	}
+
+	encrypted := encryptForTest(t, e, testPattern(3*aesGCMChunkSize))
+	corrupted := append([]byte{}, encrypted...)
+	corrupted[len(corrupted)/2] ^= 1
+	_, err = decryptForTest(e, corrupted)
+	assert.Error(t, err)
+	// truncation on chunk boundary must be detected too
+	_, err = decryptForTest(e, encrypted[:len(encrypted)-aesGCMChunkSize-16])
+	assert.Error(t, err)
+
+	other, err := newArchiveEncryption(EncryptionConfig{Type: EncryptionAESGCM, Key: "ZmZmZmZmZmZmZmZmZmZmZmZmZmZmZmZmZmZmZmZmZmY="})
+	require.NoError(t, err)
+	_, err = decryptForTest(other, encrypted)
+	assert.Error(t, err)
+	var disabled *archiveEncryption
+	_, err = decryptForTest(disabled, encrypted)
+	assert.Equal(t, ErrArchiveEncrypted, err)
+	plain, err := decryptForTest(disabled, []byte("plain archive"))
+	assert.NoError(t, err)
+	assert.Equal(t, "plain archive", string(plain))
+
+	_, err = newArchiveEncryption(EncryptionConfig{Type: EncryptionAESGCM, Key: "short"})
+	assert.Error(t, err)
+}
+
+func TestDecodeKey(t *testing.T) {
+	key, err := decodeKey([]byte(testEncryptionKey + "\n"))
+	require.NoError(t, err)
+	assert.Equal(t, byte(0x1f), key[31])
+	key, err = decodeKey([]byte("ZmZmZmZmZmZmZmZmZmZmZmZmZmZmZmZmZmZmZmZmZmY="))
+	require.NoError(t, err)
+	assert.Len(t, key, 32)
+	for _, weak := range []string{
+		"correct horse battery staple 123", // 32 characters passphrase
+		"000102030405060708090a0b0c0d0e0f", // 16 bytes in hex
+		"ZmZmZmZmZmZmZmZmZmZmZmY=",         // 16 bytes in base64
+		string(testPattern(32)),            // raw bytes
+	} {
+		_, err := decodeKey([]byte(weak))
+		assert.Error(t, err, weak)
+	}
+}
+
+func TestOpenPGPEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clickhouse-backup-pgp")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	entity, err := openpgp.NewEntity("backup", "", "backup@example.com", nil)
+	require.NoError(t, err)
+	public := &bytes.Buffer{}
+	require.NoError(t, entity.Serialize(public))
+	private := &bytes.Buffer{}
+	require.NoError(t, entity.SerializePrivate(private, nil))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "public.gpg"), public.Bytes(), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "private.gpg"), private.Bytes(), 0600))
+
+	uploader, err := newArchiveEncryption(EncryptionConfig{Type: EncryptionOpenPGP, RecipientsFile: filepath.Join(dir, "public.gpg")})
+	require.NoError(t, err)
+	assert.Equal(t, entity.PrimaryKey.KeyIdString(), uploader.info().KeyID)
+	downloader, err := newArchiveEncryption(EncryptionConfig{Type: EncryptionOpenPGP, PrivateKeyFile: filepath.Join(dir, "private.gpg")})
+	require.NoError(t, err)
+
+	data := testPattern(100000)
+	encrypted := encryptForTest(t, uploader, data)
+	decrypted, err := decryptForTest(downloader, encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, data, decrypted)
+	_, err = decryptForTest(uploader, encrypted)
+	assert.Error(t, err)
+}
+
+func TestEncryptedBackupDestination(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clickhouse-backup-encryption")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	local := filepath.Join(dir, "local", "backup")
+	require.NoError(t, os.MkdirAll(filepath.Join(local, "shadow", "db", "t", "all_1_1_0"), os.ModePerm))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(local, "shadow", "db", "t", "all_1_1_0", "data.bin"), []byte("secret data"), 0640))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "remote"), os.ModePerm))
+
+	config := DefaultConfig()
+	config.General.RemoteStorage = "fs"
+	config.General.DisableProgressBar = true
+	config.FS.RootPath = filepath.Join(dir, "remote")
+	config.Encryption = EncryptionConfig{Type: EncryptionAESGCM, Key: testEncryptionKey}
+	bd, err := NewBackupDestination(*config)
+	require.NoError(t, err)
+	require.NoError(t, bd.Connect())
+	require.NoError(t, bd.CompressedStreamUpload(local, "backup", ""))
+	archive, err := ioutil.ReadFile(filepath.Join(dir, "remote", "backup.tar.gz"))
+	require.NoError(t, err)
+	assert.Equal(t, aesGCMMagic, string(archive[:encryptedMagicSize]))
+
+	require.NoError(t, bd.CompressedStreamDownload("backup", filepath.Join(dir, "download"), ""))
+	content, err := ioutil.ReadFile(filepath.Join(dir, "download", "shadow", "db", "t", "all_1_1_0", "data.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, "secret data", string(content))
+
+	config.Encryption = EncryptionConfig{}
+	bd, err = NewBackupDestination(*config)
+	require.NoError(t, err)
+	assert.Equal(t, ErrArchiveEncrypted, bd.CompressedStreamDownload("backup", filepath.Join(dir, "download2"), ""))
+}
+
+func TestOpenPGPArchiveIntegrity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clickhouse-backup-pgp")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	entity, err := openpgp.NewEntity("backup", "", "backup@example.com", nil)
+	require.NoError(t, err)
+	keyring := &bytes.Buffer{}
+	require.NoError(t, entity.SerializePrivate(keyring, nil))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "keyring.gpg"), keyring.Bytes(), 0600))
+	createTestBackup(t, filepath.Join(dir, "local", "backup"))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "remote"), os.ModePerm))
+
+	config := DefaultConfig()
+	config.General.RemoteStorage = "fs"
+	config.General.DisableProgressBar = true
+	config.FS.RootPath = filepath.Join(dir, "remote")
+	config.Encryption = EncryptionConfig{
+		Type:           EncryptionOpenPGP,
+		RecipientsFile: filepath.Join(dir, "keyring.gpg"),
+		PrivateKeyFile: filepath.Join(dir, "keyring.gpg"),
+	}
+	bd, err := NewBackupDestination(*config)
+	require.NoError(t, err)
+	require.NoError(t, bd.Connect())
+	require.NoError(t, bd.CompressedStreamUpload(filepath.Join(dir, "local", "backup"), "backup", ""))
+	require.NoError(t, bd.CompressedStreamDownload("backup", filepath.Join(dir, "download"), ""))
+
+	// the last byte belongs to modification detection code which follows the end of tar archive
+	archivePath := filepath.Join(dir, "remote", "backup.tar.gz")
+	archive, err := ioutil.ReadFile(archivePath)
+	require.NoError(t, err)
+	archive[len(archive)-1] ^= 1
+	require.NoError(t, ioutil.WriteFile(archivePath, archive, 0640))
+	assert.Error(t, bd.CompressedStreamDownload("backup", filepath.Join(dir, "download2"), ""))
+}
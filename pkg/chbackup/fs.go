@@ -0,0 +1,161 @@
+package chbackup
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// fsTempPrefix - prefix of temporary files which are renamed to the target key after successful write
+const fsTempPrefix = ".tmp-"
+
+// FS - presents methods for manipulate data on local filesystem or mounted volume
+type FS struct {
+	Config *FSConfig
+}
+
+// Connect - check that root directory exists, it is not created to avoid writing to unmounted mount point
+func (f *FS) Connect() error {
+	if f.Config.RootPath == "" {
+		return fmt.Errorf("fs root_path is not set")
+	}
+	info, err := os.Stat(f.Config.RootPath)
+	if err != nil {
+		return fmt.Errorf("can't open fs root_path with %v", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("fs root_path '%s' is not a directory", f.Config.RootPath)
+	}
+	return nil
+}
+
+func (f *FS) Kind() string {
+	return "FS"
+}
+
+func (f *FS) fullPath(key string) string {
+	return filepath.Join(f.Config.RootPath, filepath.FromSlash(strings.TrimPrefix(key, "/")))
+}
+
+func (f *FS) GetFile(key string) (RemoteFile, error) {
+	info, err := os.Stat(f.fullPath(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, ErrNotFound
+	}
+	return &fsFile{info: info, name: strings.TrimPrefix(key, "/")}, nil
+}
+
+// DeleteFile - remove file and parent directories which became empty
+func (f *FS) DeleteFile(key string) error {
+	filePath := f.fullPath(key)
+	if err := os.Remove(filePath); err != nil {
+		return err
+	}
+	root := filepath.Clean(f.Config.RootPath)
+	for dir := filepath.Dir(filePath); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (f *FS) Walk(fsPath string, process func(RemoteFile)) error {
+	root := filepath.Clean(f.Config.RootPath)
+	err := filepath.Walk(f.fullPath(fsPath), func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), fsTempPrefix) {
+			return nil
+		}
+		name := filepath.ToSlash(strings.TrimPrefix(strings.TrimPrefix(filePath, root), string(filepath.Separator)))
+		process(&fsFile{info: info, name: name})
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (f *FS) GetFileReader(key string) (io.ReadCloser, error) {
+	return os.Open(f.fullPath(key))
+}
+
+// GetFileReaderWithOffset - open file and seek to offset
+func (f *FS) GetFileReaderWithOffset(key string, offset int64) (io.ReadCloser, error) {
+	file, err := os.Open(f.fullPath(key))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// PutFile - write to temporary file in the same directory and rename it, so incomplete files are never visible
+func (f *FS) PutFile(key string, r io.ReadCloser) error {
+	defer r.Close()
+	filePath := f.fullPath(key)
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(filePath), fsTempPrefix+filepath.Base(filePath))
+	if err != nil {
+		return err
+	}
+	tmpFileName := tmpFile.Name()
+	if _, err := io.Copy(tmpFile, r); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFileName)
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFileName)
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpFileName)
+		return err
+	}
+	if err := os.Chmod(tmpFileName, 0640); err != nil {
+		os.Remove(tmpFileName)
+		return err
+	}
+	if err := os.Rename(tmpFileName, filePath); err != nil {
+		os.Remove(tmpFileName)
+		return err
+	}
+	return nil
+}
+
+type fsFile struct {
+	info os.FileInfo
+	name string
+}
+
+func (f *fsFile) Size() int64 {
+	return f.info.Size()
+}
+
+func (f *fsFile) Name() string {
+	return f.name
+}
+
+func (f *fsFile) LastModified() time.Time {
+	return f.info.ModTime()
+}
@@ -0,0 +1,166 @@
+package chbackup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFSRemoteStorage(t *testing.T) {
+	root, err := ioutil.TempDir("", "clickhouse-backup-fs")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	fs := &FS{Config: &FSConfig{RootPath: root}}
+	require.NoError(t, fs.Connect())
+
+	assert.NoError(t, fs.PutFile("backups/test/file.txt", ioutil.NopCloser(strings.NewReader("content"))))
+	file, err := fs.GetFile("backups/test/file.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), file.Size())
+	assert.Equal(t, "backups/test/file.txt", file.Name())
+	_, err = fs.GetFile("backups/test/missing.txt")
+	assert.Equal(t, ErrNotFound, err)
+
+	r, err := fs.GetFileReader("backups/test/file.txt")
+	assert.NoError(t, err)
+	content, _ := ioutil.ReadAll(r)
+	r.Close()
+	assert.Equal(t, "content", string(content))
+
+	names := []string{}
+	assert.NoError(t, fs.Walk("backups", func(f RemoteFile) { names = append(names, f.Name()) }))
+	assert.Equal(t, []string{"backups/test/file.txt"}, names)
+	assert.NoError(t, fs.Walk("missing", func(f RemoteFile) { t.Error("unexpected file") }))
+
+	assert.NoError(t, fs.DeleteFile("backups/test/file.txt"))
+	_, err = os.Stat(filepath.Join(root, "backups"))
+	assert.True(t, os.IsNotExist(err))
+	assert.Error(t, (&FS{Config: &FSConfig{RootPath: filepath.Join(root, "missing")}}).Connect())
+}
+
+func TestFSBackupDestination(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clickhouse-backup-fs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "remote")
+	local := filepath.Join(dir, "local")
+	require.NoError(t, os.MkdirAll(root, os.ModePerm))
+
+	writeFile := func(name, content string) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(name), os.ModePerm))
+		require.NoError(t, ioutil.WriteFile(name, []byte(content), 0640))
+	}
+	writeFile(filepath.Join(local, "full", "metadata", "db", "t.sql"), "CREATE TABLE")
+	writeFile(filepath.Join(local, "full", "shadow", "db", "t", "all_1_1_0", "data.bin"), "data")
+	writeFile(filepath.Join(local, "diff", "metadata", "db", "t.sql"), "CREATE TABLE")
+	writeFile(filepath.Join(local, "diff", "shadow", "db", "t", "all_2_2_0", "data.bin"), "new data")
+	require.NoError(t, os.MkdirAll(filepath.Join(local, "diff", "shadow", "db", "t", "all_1_1_0"), os.ModePerm))
+	require.NoError(t, os.Link(filepath.Join(local, "full", "shadow", "db", "t", "all_1_1_0", "data.bin"), filepath.Join(local, "diff", "shadow", "db", "t", "all_1_1_0", "data.bin")))
+
+	config := DefaultConfig()
+	config.General.RemoteStorage = "fs"
+	config.General.DisableProgressBar = true
+	config.FS.RootPath = root
+	config.FS.Path = "/backups/"
+	bd, err := NewBackupDestination(*config)
+	require.NoError(t, err)
+	require.NoError(t, bd.Connect())
+
+	require.NoError(t, bd.CompressedStreamUpload(filepath.Join(local, "full"), "full", ""))
+	require.NoError(t, bd.CompressedStreamUpload(filepath.Join(local, "diff"), "diff", filepath.Join(local, "full")))
+	backups, err := bd.BackupList()
+	require.NoError(t, err)
+	assert.Len(t, backups, 2)
+
+	download := filepath.Join(dir, "download")
+	require.NoError(t, bd.CompressedStreamDownload("diff", filepath.Join(download, "diff"), ""))
+	content, err := ioutil.ReadFile(filepath.Join(download, "diff", "shadow", "db", "t", "all_1_1_0", "data.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data", string(content))
+	content, err = ioutil.ReadFile(filepath.Join(download, "diff", "shadow", "db", "t", "all_2_2_0", "data.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, "new data", string(content))
+
+	require.NoError(t, bd.RemoveBackup("full"))
+	backups, err = bd.BackupList()
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+	assert.Equal(t, "diff", backups[0].Name)
+}
+
+func TestBackupListCorruptManifest(t *testing.T) {
+	root, err := ioutil.TempDir("", "clickhouse-backup-fs")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	for name, content := range map[string]string{
+		"broken/manifest.json":         "{",
+		"broken/metadata.tar.gz":       "metadata",
+		"broken/shadow/db/t/1.tar.gz":  "data",
+		"other/manifest.json":          `{"creation_date": "2020-03-01T10:00:00Z"}`,
+		"other/metadata.tar.gz":        "metadata",
+		"other/shadow/db/t/all.tar.gz": "data",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(root, name)), os.ModePerm))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(root, name), []byte(content), 0640))
+	}
+	modTime := time.Date(2020, 3, 10, 10, 0, 0, 0, time.UTC)
+	require.NoError(t, os.Chtimes(filepath.Join(root, "broken/shadow/db/t/1.tar.gz"), modTime, modTime))
+	require.NoError(t, os.Chtimes(filepath.Join(root, "broken/metadata.tar.gz"), modTime.Add(-time.Hour), modTime.Add(-time.Hour)))
+	require.NoError(t, os.Chtimes(filepath.Join(root, "broken/manifest.json"), modTime.Add(-time.Hour), modTime.Add(-time.Hour)))
+
+	config := DefaultConfig()
+	config.General.RemoteStorage = "fs"
+	config.FS.RootPath = root
+	bd, err := NewBackupDestination(*config)
+	require.NoError(t, err)
+	require.NoError(t, bd.Connect())
+	backups, err := bd.BackupList()
+	require.NoError(t, err)
+	require.Len(t, backups, 2)
+	assert.Equal(t, "other", backups[0].Name)
+	assert.False(t, backups[0].unknownRequired)
+	assert.Equal(t, "broken", backups[1].Name)
+	assert.True(t, modTime.Equal(backups[1].Date))
+	assert.True(t, backups[1].unknownRequired, "older backups must be kept by retention")
+}
+
+func TestTransferredBytesOfIncrementalUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clickhouse-backup-fs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "remote")
+	require.NoError(t, os.MkdirAll(root, os.ModePerm))
+	base := filepath.Join(dir, "local", "base")
+	createTestBackup(t, base)
+	// increment consists of hardlinks only, they are listed in meta file instead of being uploaded
+	inc := filepath.Join(dir, "local", "inc")
+	require.NoError(t, filepath.Walk(base, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		linkPath := filepath.Join(inc, strings.TrimPrefix(filePath, base))
+		if err := os.MkdirAll(filepath.Dir(linkPath), os.ModePerm); err != nil {
+			return err
+		}
+		return os.Link(filePath, linkPath)
+	}))
+
+	config := DefaultConfig()
+	config.General.RemoteStorage = "fs"
+	config.General.DisableProgressBar = true
+	config.FS.RootPath = root
+	bd, err := NewBackupDestination(*config)
+	require.NoError(t, err)
+	require.NoError(t, bd.Connect())
+	ResetTransferredBytes()
+	require.NoError(t, bd.CompressedStreamUpload(inc, "inc", base))
+	info, err := os.Stat(filepath.Join(root, "inc.tar.gz"))
+	require.NoError(t, err)
+	assert.Equal(t, info.Size(), TransferredBytes())
+}
@@ -0,0 +1,269 @@
+package chbackup
+
+import (
+	"crypto/tls"
+	"io"
+	"net/textproto"
+	"os"
+	"path"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// FTP - presents methods for manipulate data on FTP server
+// FTP connection can run only one transfer at once, so connections are taken from the pool for every operation
+// at most Config.Concurrency connections are open at once, operation waits for a free slot
+type FTP struct {
+	Config *FTPConfig
+	pool   chan *ftp.ServerConn
+	slots  chan struct{}
+}
+
+// Connect - check connection to FTP server and initialise connection pool
+func (f *FTP) Connect() error {
+	if f.pool == nil {
+		f.pool = make(chan *ftp.ServerConn, f.Config.Concurrency)
+		f.slots = make(chan struct{}, f.Config.Concurrency)
+	}
+	conn, err := f.getConn()
+	if err != nil {
+		return err
+	}
+	f.putConn(conn)
+	return nil
+}
+
+func (f *FTP) dial() (*ftp.ServerConn, error) {
+	timeout, err := time.ParseDuration(f.Config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	options := []ftp.DialOption{ftp.DialWithTimeout(timeout)}
+	if f.Config.TLS {
+		options = append(options, ftp.DialWithExplicitTLS(&tls.Config{
+			InsecureSkipVerify: f.Config.SkipTLSVerify,
+		}))
+	}
+	if f.Config.Debug {
+		options = append(options, ftp.DialWithDebugOutput(os.Stderr))
+	}
+	conn, err := ftp.Dial(f.Config.Address, options...)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Login(f.Config.Username, f.Config.Password); err != nil {
+		conn.Quit()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// getConn - wait for a free slot, then take idle connection from the pool or dial new one
+// connection must be released with putConn or closeConn
+func (f *FTP) getConn() (*ftp.ServerConn, error) {
+	f.slots <- struct{}{}
+	for {
+		select {
+		case conn := <-f.pool:
+			// server may close idle connection
+			if err := conn.NoOp(); err != nil {
+				conn.Quit()
+				continue
+			}
+			return conn, nil
+		default:
+			conn, err := f.dial()
+			if err != nil {
+				<-f.slots
+				return nil, err
+			}
+			return conn, nil
+		}
+	}
+}
+
+// putConn - return connection to the pool, close it if pool is full
+func (f *FTP) putConn(conn *ftp.ServerConn) {
+	select {
+	case f.pool <- conn:
+	default:
+		conn.Quit()
+	}
+	<-f.slots
+}
+
+// closeConn - close connection which is broken by failed transfer
+func (f *FTP) closeConn(conn *ftp.ServerConn) {
+	conn.Quit()
+	<-f.slots
+}
+
+func isFTPNotFound(err error) bool {
+	protoErr, ok := err.(*textproto.Error)
+	return ok && protoErr.Code == ftp.StatusFileUnavailable
+}
+
+func (f *FTP) Kind() string {
+	return "FTP"
+}
+
+func (f *FTP) GetFile(key string) (RemoteFile, error) {
+	conn, err := f.getConn()
+	if err != nil {
+		return nil, err
+	}
+	defer f.putConn(conn)
+	entries, err := conn.List(path.Dir(key))
+	if err != nil {
+		if isFTPNotFound(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.Name == path.Base(key) && entry.Type == ftp.EntryTypeFile {
+			return &ftpFile{entry: *entry, name: key}, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// DeleteFile - remove file and parent directories up to the configured path which became empty
+func (f *FTP) DeleteFile(key string) error {
+	conn, err := f.getConn()
+	if err != nil {
+		return err
+	}
+	defer f.putConn(conn)
+	if err := conn.Delete(key); err != nil {
+		return err
+	}
+	root := path.Clean(f.Config.Path)
+	for dir := path.Dir(key); dir != root && dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if err := conn.RemoveDir(dir); err != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (f *FTP) Walk(ftpPath string, process func(RemoteFile)) error {
+	conn, err := f.getConn()
+	if err != nil {
+		return err
+	}
+	defer f.putConn(conn)
+	err = f.walk(conn, ftpPath, process)
+	if isFTPNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (f *FTP) walk(conn *ftp.ServerConn, dir string, process func(RemoteFile)) error {
+	entries, err := conn.List(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name == "." || entry.Name == ".." {
+			continue
+		}
+		name := path.Join(dir, entry.Name)
+		switch entry.Type {
+		case ftp.EntryTypeFolder:
+			if err := f.walk(conn, name, process); err != nil {
+				return err
+			}
+		case ftp.EntryTypeFile:
+			process(&ftpFile{entry: *entry, name: name})
+		}
+	}
+	return nil
+}
+
+// ftpReader - return connection to the pool after transfer is finished
+type ftpReader struct {
+	*ftp.Response
+	f    *FTP
+	conn *ftp.ServerConn
+}
+
+func (r *ftpReader) Close() error {
+	err := r.Response.Close()
+	if err != nil {
+		r.f.closeConn(r.conn)
+		return err
+	}
+	r.f.putConn(r.conn)
+	return nil
+}
+
+func (f *FTP) GetFileReader(key string) (io.ReadCloser, error) {
+	conn, err := f.getConn()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := conn.Retr(key)
+	if err != nil {
+		f.putConn(conn)
+		return nil, err
+	}
+	return &ftpReader{Response: resp, f: f, conn: conn}, nil
+}
+
+// GetFileReaderWithOffset - retrieve file starting from offset with REST command
+func (f *FTP) GetFileReaderWithOffset(key string, offset int64) (io.ReadCloser, error) {
+	conn, err := f.getConn()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := conn.RetrFrom(key, uint64(offset))
+	if err != nil {
+		f.putConn(conn)
+		return nil, err
+	}
+	return &ftpReader{Response: resp, f: f, conn: conn}, nil
+}
+
+// mkdirAllFTP - create directory and all its parents, errors are ignored because directory may exist
+func mkdirAllFTP(conn *ftp.ServerConn, dir string) {
+	if dir == "." || dir == "/" || dir == "" {
+		return
+	}
+	mkdirAllFTP(conn, path.Dir(dir))
+	conn.MakeDir(dir)
+}
+
+func (f *FTP) PutFile(key string, r io.ReadCloser) error {
+	defer r.Close()
+	conn, err := f.getConn()
+	if err != nil {
+		return err
+	}
+	mkdirAllFTP(conn, path.Dir(key))
+	if err := conn.Stor(key, r); err != nil {
+		f.closeConn(conn)
+		return err
+	}
+	f.putConn(conn)
+	return nil
+}
+
+type ftpFile struct {
+	entry ftp.Entry
+	name  string
+}
+
+func (f *ftpFile) Size() int64 {
+	return int64(f.entry.Size)
+}
+
+func (f *ftpFile) Name() string {
+	return f.name
+}
+
+func (f *ftpFile) LastModified() time.Time {
+	return f.entry.Time
+}
@@ -0,0 +1,100 @@
+package chbackup
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeFTPServer - FTP server which only logs in and counts open control connections
+type fakeFTPServer struct {
+	listener net.Listener
+	open     int32
+	maxOpen  int32
+}
+
+func newFakeFTPServer(t *testing.T) *fakeFTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &fakeFTPServer{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeFTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	open := atomic.AddInt32(&s.open, 1)
+	defer atomic.AddInt32(&s.open, -1)
+	for {
+		maxOpen := atomic.LoadInt32(&s.maxOpen)
+		if open <= maxOpen || atomic.CompareAndSwapInt32(&s.maxOpen, maxOpen, open) {
+			break
+		}
+	}
+	fmt.Fprint(conn, "220 ready\r\n")
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch strings.Fields(line)[0] {
+		case "USER":
+			fmt.Fprint(conn, "331 password required\r\n")
+		case "PASS":
+			fmt.Fprint(conn, "230 logged in\r\n")
+		case "TYPE", "NOOP":
+			fmt.Fprint(conn, "200 ok\r\n")
+		case "QUIT":
+			fmt.Fprint(conn, "221 bye\r\n")
+			return
+		default:
+			fmt.Fprint(conn, "502 not implemented\r\n")
+		}
+	}
+}
+
+func TestFTPConcurrency(t *testing.T) {
+	server := newFakeFTPServer(t)
+	defer server.listener.Close()
+	f := &FTP{Config: &FTPConfig{Address: server.listener.Addr().String(), Timeout: "10s", Concurrency: 2}}
+	require.NoError(t, f.Connect())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := f.getConn()
+			if !assert.NoError(t, err) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+			f.putConn(conn)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&server.maxOpen))
+
+	// slot of broken connection is released
+	conn, err := f.getConn()
+	require.NoError(t, err)
+	f.closeConn(conn)
+	assert.Len(t, f.slots, 0)
+}
@@ -65,6 +65,17 @@ func (gcs *GCS) GetFileReader(key string) (io.ReadCloser, error) {
 	return reader, nil
 }
 
+// GetFileReaderWithOffset - read object starting from offset
+func (gcs *GCS) GetFileReaderWithOffset(key string, offset int64) (io.ReadCloser, error) {
+	ctx := context.Background()
+	obj := gcs.client.Bucket(gcs.Config.Bucket).Object(key)
+	reader, err := obj.NewRangeReader(ctx, offset, -1)
+	if err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
 func (gcs *GCS) GetFileWriter(key string) io.WriteCloser {
 	ctx := context.Background()
 	obj := gcs.client.Bucket(gcs.Config.Bucket).Object(key)
@@ -0,0 +1,174 @@
+package chbackup
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// JobQueued - job is waiting for previous jobs to finish
+	JobQueued = "queued"
+	// JobRunning - job is in progress
+	JobRunning = "running"
+	// JobSucceeded - job finished without errors
+	JobSucceeded = "succeeded"
+	// JobFailed - job finished with error
+	JobFailed = "failed"
+)
+
+// ErrJobQueueFull - returned when too many jobs are waiting, new job is refused instead of blocking the caller
+var ErrJobQueueFull = errors.New("job queue is full, try again later")
+
+// Job - state of a command executed asynchronously by JobQueue
+type Job struct {
+	ID               string      `json:"id"`
+	Command          string      `json:"command"`
+	Status           string      `json:"status"`
+	Created          time.Time   `json:"created"`
+	Start            *time.Time  `json:"start,omitempty"`
+	Finish           *time.Time  `json:"finish,omitempty"`
+	Error            string      `json:"error,omitempty"`
+	Result           interface{} `json:"result,omitempty"`
+	BytesTransferred int64       `json:"bytes_transferred"`
+	run              func() (interface{}, error)
+}
+
+// JobQueue - executes jobs one by one in order of adding and keeps history of the last finished jobs
+type JobQueue struct {
+	mu         sync.Mutex
+	jobs       []*Job
+	current    *Job
+	pending    chan *Job
+	maxHistory int
+}
+
+// NewJobQueue - create JobQueue and start its worker, at most maxHistory finished jobs are kept
+func NewJobQueue(maxHistory int) *JobQueue {
+	q := &JobQueue{
+		pending:    make(chan *Job, 1024),
+		maxHistory: maxHistory,
+	}
+	go q.worker()
+	return q
+}
+
+// Add - put new job to the queue and return its state
+func (q *JobQueue) Add(command string, run func() error) (Job, error) {
+	return q.AddWithResult(command, func() (interface{}, error) {
+		return nil, run()
+	})
+}
+
+// AddWithResult - put new job to the queue and return its state, value returned by run is kept as result of the job
+func (q *JobQueue) AddWithResult(command string, run func() (interface{}, error)) (Job, error) {
+	job := &Job{
+		ID:      newJobID(),
+		Command: command,
+		Status:  JobQueued,
+		Created: time.Now(),
+		run:     run,
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	select {
+	case q.pending <- job:
+	default:
+		return Job{}, ErrJobQueueFull
+	}
+	q.jobs = append(q.jobs, job)
+	q.trim()
+	return *job, nil
+}
+
+// Get - return state of job with specified id
+func (q *JobQueue) Get(id string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, job := range q.jobs {
+		if job.ID == id {
+			return q.snapshot(job), true
+		}
+	}
+	return Job{}, false
+}
+
+// List - return state of all known jobs, the newest job goes first
+func (q *JobQueue) List() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	result := make([]Job, 0, len(q.jobs))
+	for i := len(q.jobs) - 1; i >= 0; i-- {
+		result = append(result, q.snapshot(q.jobs[i]))
+	}
+	return result
+}
+
+func (q *JobQueue) worker() {
+	for job := range q.pending {
+		ResetTransferredBytes()
+		start := time.Now()
+		q.mu.Lock()
+		job.Status = JobRunning
+		job.Start = &start
+		q.current = job
+		q.mu.Unlock()
+
+		result, err := job.run()
+
+		finish := time.Now()
+		q.mu.Lock()
+		job.Finish = &finish
+		job.BytesTransferred = TransferredBytes()
+		job.Result = result
+		job.Status = JobSucceeded
+		if err != nil {
+			job.Status = JobFailed
+			job.Error = err.Error()
+		}
+		q.current = nil
+		q.trim()
+		q.mu.Unlock()
+	}
+}
+
+// snapshot - return copy of job, q.mu must be held
+func (q *JobQueue) snapshot(job *Job) Job {
+	result := *job
+	if job == q.current {
+		result.BytesTransferred = TransferredBytes()
+	}
+	return result
+}
+
+// trim - forget the oldest finished jobs above maxHistory, q.mu must be held
+func (q *JobQueue) trim() {
+	if q.maxHistory < 1 {
+		return
+	}
+	finished := 0
+	for _, job := range q.jobs {
+		if job.Finish != nil {
+			finished++
+		}
+	}
+	jobs := q.jobs[:0]
+	for _, job := range q.jobs {
+		if job.Finish != nil && finished > q.maxHistory {
+			finished--
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	q.jobs = jobs
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().UTC().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,75 @@
+package chbackup
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func waitJob(q *JobQueue, id string) Job {
+	for i := 0; i < 100; i++ {
+		if job, ok := q.Get(id); ok && job.Finish != nil {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return Job{}
+}
+
+func TestJobQueue(t *testing.T) {
+	q := NewJobQueue(2)
+	first, err := q.Add("create", func() error { return nil })
+	require.NoError(t, err)
+	second, err := q.Add("upload", func() error { return errors.New("upload failed") })
+	require.NoError(t, err)
+	third, err := q.Add("clean", func() error { return nil })
+	require.NoError(t, err)
+	assert.Equal(t, JobQueued, first.Status)
+
+	assert.Equal(t, JobFailed, waitJob(q, second.ID).Status)
+	assert.Equal(t, "upload failed", waitJob(q, second.ID).Error)
+	assert.Equal(t, JobSucceeded, waitJob(q, third.ID).Status)
+
+	_, ok := q.Get(first.ID)
+	assert.False(t, ok, "the oldest finished job should be dropped from history")
+	jobs := q.List()
+	assert.Len(t, jobs, 2)
+	assert.Equal(t, third.ID, jobs[0].ID)
+}
+
+func TestJobQueueResult(t *testing.T) {
+	q := NewJobQueue(10)
+	succeeded, err := q.AddWithResult("verify/local/a", func() (interface{}, error) {
+		return &VerifyResult{BackupName: "a", Files: 3}, nil
+	})
+	problems := &VerifyResult{BackupName: "b", Missing: []string{"shadow/db/t/all_1_1_0/data.bin"}}
+	require.NoError(t, err)
+	failed, err := q.AddWithResult("verify/local/b", func() (interface{}, error) {
+		return problems, problems
+	})
+
+	require.NoError(t, err)
+
+	job := waitJob(q, succeeded.ID)
+	assert.Equal(t, JobSucceeded, job.Status)
+	assert.Equal(t, &VerifyResult{BackupName: "a", Files: 3}, job.Result)
+	job = waitJob(q, failed.ID)
+	assert.Equal(t, JobFailed, job.Status)
+	assert.Equal(t, problems, job.Result)
+	assert.Equal(t, problems.Error(), job.Error)
+}
+
+func TestJobQueueFull(t *testing.T) {
+	// queue without worker, so jobs are never taken from it
+	q := &JobQueue{pending: make(chan *Job, 1)}
+	_, err := q.Add("create", func() error { return nil })
+	require.NoError(t, err)
+	_, err = q.Add("upload", func() error { return nil })
+	assert.Equal(t, ErrJobQueueFull, err)
+	jobs := q.List()
+	require.Len(t, jobs, 1)
+	assert.Equal(t, "create", jobs[0].Command)
+}
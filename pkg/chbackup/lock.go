@@ -0,0 +1,161 @@
+package chbackup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// LockFileName - file in <data_path>/backup which is locked while mutating command is running
+	LockFileName = ".clickhouse-backup.lock"
+)
+
+// LockInfo - describe the command holding the operation lock
+type LockInfo struct {
+	Operation string    `json:"operation"`
+	PID       int       `json:"pid"`
+	Since     time.Time `json:"since"`
+}
+
+// LockError - returned when the operation lock is held by another command
+type LockError struct {
+	Holder LockInfo
+}
+
+func (e *LockError) Error() string {
+	return fmt.Sprintf("operation '%s' in progress since %s (pid %d)", e.Holder.Operation, e.Holder.Since.Format(time.RFC3339), e.Holder.PID)
+}
+
+// OperationLock - acquired operation lock, must be released with Unlock
+type OperationLock struct {
+	file *os.File
+}
+
+var (
+	// processLock - holder of the lock inside current process, file locks don't prevent it
+	processLock   *LockInfo
+	processLockMu sync.Mutex
+)
+
+func getLockPath(config Config) (string, error) {
+	dataPath := getDataPath(config)
+	if dataPath == "" {
+		return "", ErrUnknownClickhouseDataPath
+	}
+	return path.Join(dataPath, "backup", LockFileName), nil
+}
+
+func readLockInfo(file *os.File) LockInfo {
+	var info LockInfo
+	if _, err := file.Seek(0, 0); err != nil {
+		return info
+	}
+	if content, err := ioutil.ReadAll(file); err == nil {
+		json.Unmarshal(content, &info)
+	}
+	return info
+}
+
+// Lock - acquire the operation lock for mutating commands
+// If the lock is held by another command waits up to general.lock_timeout and then returns LockError
+func Lock(config Config, operation string) (*OperationLock, error) {
+	lockPath, err := getLockPath(config)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := time.ParseDuration(config.General.LockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		lock, err := tryLock(lockPath, operation)
+		if _, ok := err.(*LockError); !ok || time.Now().After(deadline) {
+			return lock, err
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func tryLock(lockPath string, operation string) (*OperationLock, error) {
+	processLockMu.Lock()
+	defer processLockMu.Unlock()
+	if processLock != nil {
+		return nil, &LockError{*processLock}
+	}
+	if err := os.MkdirAll(path.Dir(lockPath), os.ModePerm); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("can't open lock file with %v", err)
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, &LockError{readLockInfo(file)}
+		}
+		return nil, fmt.Errorf("can't lock '%s' with %v", lockPath, err)
+	}
+	info := LockInfo{
+		Operation: operation,
+		PID:       os.Getpid(),
+		Since:     time.Now(),
+	}
+	content, _ := json.Marshal(&info)
+	if err := file.Truncate(0); err == nil {
+		file.WriteAt(content, 0)
+	}
+	processLock = &info
+	return &OperationLock{file: file}, nil
+}
+
+// Unlock - release the operation lock
+func (l *OperationLock) Unlock() error {
+	processLockMu.Lock()
+	defer processLockMu.Unlock()
+	processLock = nil
+	l.file.Truncate(0)
+	if err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+// GetLockHolder - return the command holding the operation lock or nil if nothing is in progress
+func GetLockHolder(config Config) (*LockInfo, error) {
+	processLockMu.Lock()
+	defer processLockMu.Unlock()
+	if processLock != nil {
+		info := *processLock
+		return &info, nil
+	}
+	lockPath, err := getLockPath(config)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(lockPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err != nil {
+		if err == syscall.EWOULDBLOCK {
+			info := readLockInfo(file)
+			return &info, nil
+		}
+		return nil, err
+	}
+	syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+	return nil, nil
+}
@@ -0,0 +1,38 @@
+package chbackup
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLock(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "clickhouse-backup-lock")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+	config := *DefaultConfig()
+	config.ClickHouse.DataPath = dataPath
+
+	lock, err := Lock(config, "create")
+	require.NoError(t, err)
+	_, err = Lock(config, "upload")
+	if assert.IsType(t, &LockError{}, err) {
+		assert.Equal(t, "create", err.(*LockError).Holder.Operation)
+	}
+	holder, err := GetLockHolder(config)
+	require.NoError(t, err)
+	if assert.NotNil(t, holder) {
+		assert.Equal(t, os.Getpid(), holder.PID)
+	}
+
+	require.NoError(t, lock.Unlock())
+	holder, err = GetLockHolder(config)
+	require.NoError(t, err)
+	assert.Nil(t, holder)
+	lock, err = Lock(config, "upload")
+	require.NoError(t, err)
+	require.NoError(t, lock.Unlock())
+}
@@ -0,0 +1,327 @@
+package chbackup
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+const (
+	// ManifestFileName - name of manifest file in backup directory and on remote storage
+	ManifestFileName = "manifest.json"
+	// ManifestVersion - version of manifest format
+	ManifestVersion = 1
+)
+
+// ToolVersion - version of clickhouse-backup which is written to the manifest
+var ToolVersion = "unknown"
+
+// BackupManifest - description of backup, written on create and uploaded with every backup
+type BackupManifest struct {
+	Version           int                 `json:"version"`
+	BackupName        string              `json:"backup_name"`
+	CreationDate      time.Time           `json:"creation_date"`
+	ClickHouseVersion int                 `json:"clickhouse_version"`
+	ToolVersion       string              `json:"tool_version"`
+	CompressionFormat string              `json:"compression_format,omitempty"`
+	RequiredBackup    string              `json:"required_backup,omitempty"`
+	Encryption        *ManifestEncryption `json:"encryption,omitempty"`
+	Databases         []ManifestDatabase  `json:"databases,omitempty"`
+	Tables            []ManifestTable     `json:"tables"`
+	Archives          []ManifestArchive   `json:"archives,omitempty"`
+}
+
+// ManifestDatabase - database of tables stored in backup, Metadata is 'metadata/<db>.sql' with engine of database
+type ManifestDatabase struct {
+	Name     string       `json:"name"`
+	Metadata ManifestFile `json:"metadata"`
+}
+
+// ManifestTable - table stored in backup, UUID is set for tables of Atomic databases
+type ManifestTable struct {
+	Database   string         `json:"database"`
+	Name       string         `json:"name"`
+	Engine     string         `json:"engine"`
+	UUID       string         `json:"uuid,omitempty"`
+	Metadata   *ManifestFile  `json:"metadata,omitempty"`
+	Partitions []string       `json:"partitions"`
+	Parts      []ManifestPart `json:"parts"`
+}
+
+// ManifestPart - data part of table stored in backup, Disk is the disk which the part was frozen on
+type ManifestPart struct {
+	Name      string         `json:"name"`
+	Partition string         `json:"partition"`
+	Disk      string         `json:"disk,omitempty"`
+	Files     []ManifestFile `json:"files"`
+}
+
+// ManifestFile - file stored in backup, Name is path relative to backup directory
+// Checksum is hex encoded xxHash64 of file content
+type ManifestFile struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+}
+
+// ManifestArchive - archive of backup uploaded with 'table' archive_layout, Name is path relative to backup directory on remote storage
+// Database and Table are empty for archive with metadata, Partition is set if table is split to archive per partition
+type ManifestArchive struct {
+	Name      string `json:"name"`
+	Database  string `json:"database,omitempty"`
+	Table     string `json:"table,omitempty"`
+	Partition string `json:"partition,omitempty"`
+}
+
+// Files - return all files described by manifest, key is path relative to backup directory
+func (m *BackupManifest) Files() map[string]ManifestFile {
+	result := map[string]ManifestFile{}
+	for _, database := range m.Databases {
+		result[database.Metadata.Name] = database.Metadata
+	}
+	for _, table := range m.Tables {
+		if table.Metadata != nil {
+			result[table.Metadata.Name] = *table.Metadata
+		}
+		for _, part := range table.Parts {
+			for _, file := range part.Files {
+				result[file.Name] = file
+			}
+		}
+	}
+	return result
+}
+
+// filterTables - return copy of manifest which describes only tables matched by tablePattern
+func (m *BackupManifest) filterTables(tablePattern string) *BackupManifest {
+	result := *m
+	result.Tables = []ManifestTable{}
+	for _, table := range m.Tables {
+		if matchTablePattern(tablePattern, table.Database, table.Name) {
+			result.Tables = append(result.Tables, table)
+		}
+	}
+	if len(m.Archives) > 0 {
+		result.Archives = selectArchives(m.Archives, tablePattern)
+	}
+	return &result
+}
+
+func hashReader(r io.Reader) (int64, string, error) {
+	h := xxhash.New()
+	size, err := io.Copy(h, r)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func getManifestFile(backupPath, filePath string) (ManifestFile, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	defer f.Close()
+	size, checksum, err := hashReader(f)
+	if err != nil {
+		return ManifestFile{}, fmt.Errorf("can't read '%s' with %v", filePath, err)
+	}
+	return ManifestFile{
+		Name:     strings.TrimPrefix(strings.TrimPrefix(filepath.ToSlash(filePath), backupPath), "/"),
+		Size:     size,
+		Checksum: checksum,
+	}, nil
+}
+
+// partitionFromPartName - return partition id from part name like '201901_1_1_0' or 'all_1_1_0'
+func partitionFromPartName(partName string) string {
+	return strings.Split(partName, "_")[0]
+}
+
+// newManifest - build manifest of backup created in backupPath
+// partDisks is the disk of every part, key is 'db/table/part' relative to 'shadow', parts missing in it get disk from system.parts
+func newManifest(ch *ClickHouse, backupPath, backupName string, partDisks map[string]string) (*BackupManifest, error) {
+	version, err := ch.GetVersion()
+	if err != nil {
+		return nil, err
+	}
+	tableInfos, err := ch.GetTableInfos()
+	if err != nil {
+		return nil, fmt.Errorf("can't get tables with %v", err)
+	}
+	tables := map[string]*ManifestTable{}
+	getTable := func(database, name string) *ManifestTable {
+		fullName := fmt.Sprintf("%s.%s", database, name)
+		if t, ok := tables[fullName]; ok {
+			return t
+		}
+		t := &ManifestTable{
+			Database:   database,
+			Name:       name,
+			Engine:     tableInfos[fullName].Engine,
+			UUID:       tableInfos[fullName].UUID,
+			Partitions: []string{},
+			Parts:      []ManifestPart{},
+		}
+		tables[fullName] = t
+		return t
+	}
+	databases := []ManifestDatabase{}
+	metadataPath := path.Join(backupPath, "metadata")
+	if err := filepath.Walk(metadataPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !strings.HasSuffix(filePath, ".sql") || !info.Mode().IsRegular() {
+			return nil
+		}
+		relativePath := strings.Trim(strings.TrimPrefix(strings.TrimSuffix(filepath.ToSlash(filePath), ".sql"), metadataPath), "/")
+		pathParts := strings.Split(relativePath, "/")
+		if len(pathParts) > 2 {
+			return nil
+		}
+		file, err := getManifestFile(backupPath, filePath)
+		if err != nil {
+			return err
+		}
+		database, _ := url.PathUnescape(pathParts[0])
+		if len(pathParts) == 1 {
+			databases = append(databases, ManifestDatabase{Name: database, Metadata: file})
+			return nil
+		}
+		name, _ := url.PathUnescape(pathParts[1])
+		getTable(database, name).Metadata = &file
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	parts := map[string]*ManifestPart{}
+	shadowPath := path.Join(backupPath, "shadow")
+	if err := filepath.Walk(shadowPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		relativePath := strings.Trim(strings.TrimPrefix(filepath.ToSlash(filePath), shadowPath), "/")
+		pathParts := strings.SplitN(relativePath, "/", 4)
+		if len(pathParts) != 4 {
+			return nil
+		}
+		file, err := getManifestFile(backupPath, filePath)
+		if err != nil {
+			return err
+		}
+		partKey := strings.Join(pathParts[:3], "/")
+		if part, ok := parts[partKey]; ok {
+			part.Files = append(part.Files, file)
+			return nil
+		}
+		parts[partKey] = &ManifestPart{
+			Name:  pathParts[2],
+			Disk:  partDisks[partKey],
+			Files: []ManifestFile{file},
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	for partKey, part := range parts {
+		pathParts := strings.Split(partKey, "/")
+		database, _ := url.PathUnescape(pathParts[0])
+		name, _ := url.PathUnescape(pathParts[1])
+		table := getTable(database, name)
+		table.Parts = append(table.Parts, *part)
+	}
+
+	manifest := &BackupManifest{
+		Version:           ManifestVersion,
+		BackupName:        backupName,
+		CreationDate:      time.Now().UTC(),
+		ClickHouseVersion: version,
+		ToolVersion:       ToolVersion,
+		Tables:            []ManifestTable{},
+	}
+	if len(databases) > 0 {
+		manifest.Databases = databases
+	}
+	for _, table := range tables {
+		if len(table.Parts) > 0 {
+			chParts, err := ch.GetParts(table.Database, table.Name)
+			if err != nil {
+				return nil, err
+			}
+			partitions := map[string]bool{}
+			for i, part := range table.Parts {
+				chPart, ok := chParts[part.Name]
+				partitionID := chPart.PartitionID
+				if !ok {
+					partitionID = partitionFromPartName(part.Name)
+				}
+				if part.Disk == "" {
+					table.Parts[i].Disk = chPart.Disk
+				}
+				table.Parts[i].Partition = partitionID
+				if !partitions[partitionID] {
+					partitions[partitionID] = true
+					table.Partitions = append(table.Partitions, partitionID)
+				}
+			}
+			sort.Strings(table.Partitions)
+			sort.Slice(table.Parts, func(i, j int) bool { return table.Parts[i].Name < table.Parts[j].Name })
+		}
+		manifest.Tables = append(manifest.Tables, *table)
+	}
+	sort.Slice(manifest.Tables, func(i, j int) bool {
+		ti, tj := manifest.Tables[i], manifest.Tables[j]
+		return (ti.Database < tj.Database) || (ti.Database == tj.Database && ti.Name < tj.Name)
+	})
+	return manifest, nil
+}
+
+func parseManifest(content []byte) (*BackupManifest, error) {
+	var manifest BackupManifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, fmt.Errorf("can't parse %s with %v", ManifestFileName, err)
+	}
+	if manifest.Version > ManifestVersion {
+		return nil, fmt.Errorf("%s version %d is not supported, upgrade clickhouse-backup", ManifestFileName, manifest.Version)
+	}
+	return &manifest, nil
+}
+
+// readLocalManifest - read manifest of local backup, returns error satisfied os.IsNotExist for backups created by old versions
+func readLocalManifest(backupPath string) (*BackupManifest, error) {
+	content, err := ioutil.ReadFile(path.Join(backupPath, ManifestFileName))
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(content)
+}
+
+func writeLocalManifest(backupPath string, manifest *BackupManifest) error {
+	content, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return fmt.Errorf("can't marshal %s with %v", ManifestFileName, err)
+	}
+	return ioutil.WriteFile(path.Join(backupPath, ManifestFileName), content, 0640)
+}
@@ -0,0 +1,50 @@
+package chbackup
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManifestFiles(t *testing.T) {
+	manifest := BackupManifest{
+		Databases: []ManifestDatabase{{Name: "db", Metadata: ManifestFile{Name: "metadata/db.sql", Size: 5, Checksum: "04"}}},
+		Tables: []ManifestTable{
+			{
+				Database: "db",
+				Name:     "table",
+				Metadata: &ManifestFile{Name: "metadata/db/table.sql", Size: 10, Checksum: "01"},
+				Parts: []ManifestPart{
+					{Name: "all_1_1_0", Files: []ManifestFile{
+						{Name: "shadow/db/table/all_1_1_0/checksums.txt", Size: 20, Checksum: "02"},
+						{Name: "shadow/db/table/all_1_1_0/data.bin", Size: 30, Checksum: "03"},
+					}},
+				},
+			},
+		},
+	}
+	files := manifest.Files()
+	assert.Len(t, files, 4)
+	assert.Equal(t, int64(30), files["shadow/db/table/all_1_1_0/data.bin"].Size)
+}
+
+func TestParseManifest(t *testing.T) {
+	manifest, err := parseManifest([]byte(`{"version": 1, "backup_name": "test", "tables": []}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "test", manifest.BackupName)
+	_, err = parseManifest([]byte(`{"version": 100}`))
+	assert.Error(t, err)
+}
+
+func TestHashReader(t *testing.T) {
+	size, checksum, err := hashReader(strings.NewReader("clickhouse"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), size)
+	assert.Len(t, checksum, 16)
+}
+
+func TestPartitionFromPartName(t *testing.T) {
+	assert.Equal(t, "201901", partitionFromPartName("201901_1_1_0"))
+	assert.Equal(t, "all", partitionFromPartName("all_1_5_1_7"))
+}
@@ -0,0 +1,63 @@
+package chbackup
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// errTransferCanceled - returned by transfers which are stopped because another transfer of the same command failed
+var errTransferCanceled = errors.New("transfer is canceled")
+
+// runParallel - call task for every index from 0 to count-1 in concurrency workers
+// the first error closes cancel channel, tasks which are not started yet are skipped and the first error is returned
+func runParallel(concurrency, count int, task func(i int, cancel <-chan struct{}) error) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	cancel := make(chan struct{})
+	var once sync.Once
+	var firstErr error
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if err := task(i, cancel); err != nil {
+					once.Do(func() {
+						firstErr = err
+						close(cancel)
+					})
+				}
+			}
+		}()
+	}
+feed:
+	for i := 0; i < count; i++ {
+		select {
+		case indexes <- i:
+		case <-cancel:
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+	return firstErr
+}
+
+// cancelReader - stop reading when cancel channel is closed, nil channel never cancels
+type cancelReader struct {
+	io.Reader
+	cancel <-chan struct{}
+}
+
+func (r *cancelReader) Read(p []byte) (int, error) {
+	select {
+	case <-r.cancel:
+		return 0, errTransferCanceled
+	default:
+	}
+	return r.Reader.Read(p)
+}
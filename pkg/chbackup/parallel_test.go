@@ -0,0 +1,61 @@
+package chbackup
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunParallel(t *testing.T) {
+	var done, running, maxRunning int32
+	err := runParallel(3, 20, func(i int, cancel <-chan struct{}) error {
+		current := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if current <= max || atomic.CompareAndSwapInt32(&maxRunning, max, current) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		atomic.AddInt32(&done, 1)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(20), done)
+	assert.True(t, maxRunning <= 3)
+
+	failed := errors.New("failed")
+	done = 0
+	err = runParallel(2, 100, func(i int, cancel <-chan struct{}) error {
+		if i == 0 {
+			return failed
+		}
+		// sibling transfer is stopped by cancelReader
+		<-cancel
+		_, err := ioutil.ReadAll(&cancelReader{Reader: strings.NewReader("data"), cancel: cancel})
+		assert.Equal(t, errTransferCanceled, err)
+		atomic.AddInt32(&done, 1)
+		return err
+	})
+	assert.Equal(t, failed, err)
+	assert.True(t, done < 99)
+}
+
+func TestConcurrencyConfig(t *testing.T) {
+	config := DefaultConfig()
+	config.General.UploadConcurrency = 4
+	assert.EqualError(t, validateConfig(config), "upload_concurrency 4 requires archive_layout 'table', 'single' layout is uploaded as one archive")
+	config.General.ArchiveLayout = ArchiveLayoutTable
+	assert.NoError(t, validateConfig(config))
+	// download_concurrency is used by backups uploaded with 'table' layout before
+	config.General.ArchiveLayout = ArchiveLayoutSingle
+	config.General.UploadConcurrency = 1
+	config.General.DownloadConcurrency = 4
+	assert.NoError(t, validateConfig(config))
+}
@@ -2,10 +2,34 @@ package chbackup
 
 import (
 	"io"
+	"sync/atomic"
 
 	progressbar "gopkg.in/cheggaaa/pb.v1"
 )
 
+// transferredBytes - number of bytes read from or sent to remote storage since the last reset, progress of bars is not counted
+var transferredBytes int64
+
+// TransferredBytes - return number of bytes uploaded or downloaded since the last ResetTransferredBytes
+func TransferredBytes() int64 {
+	return atomic.LoadInt64(&transferredBytes)
+}
+
+// ResetTransferredBytes - set counter of transferred bytes to zero
+func ResetTransferredBytes() {
+	atomic.StoreInt64(&transferredBytes, 0)
+}
+
+type countingReader struct {
+	io.Reader
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	atomic.AddInt64(&transferredBytes, int64(n))
+	return n, err
+}
+
 type Bar struct {
 	pb   *progressbar.ProgressBar
 	show bool
@@ -60,6 +84,7 @@ func (b *Bar) Increment() {
 }
 
 func (b *Bar) NewProxyReader(r io.Reader) io.Reader {
+	r = &countingReader{r}
 	if b.show {
 		return b.pb.NewProxyReader(r)
 	}
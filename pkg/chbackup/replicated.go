@@ -0,0 +1,101 @@
+package chbackup
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// ReplicatedAll - data of Replicated tables is backed up and attached on every replica which runs the command
+	ReplicatedAll = "all"
+	// ReplicatedFirstReplica - data of Replicated tables is backed up and attached only on the first replica of every shard,
+	// other replicas of the shard fetch attached parts by replication
+	ReplicatedFirstReplica = "first_replica"
+)
+
+// replicatedEngineRe - engine of Replicated*MergeTree table in CREATE query
+var replicatedEngineRe = regexp.MustCompile(`ENGINE = (Replicated\w*MergeTree)`)
+
+// replicatedArgsRe - ZooKeeper path and replica name, the first arguments of Replicated engine
+var replicatedArgsRe = regexp.MustCompile(`^\(\s*'((?:[^'\\]|\\.)*)'\s*,\s*'((?:[^'\\]|\\.)*)'`)
+
+// quoteString - escape string for single quoted literal of ClickHouse query
+func quoteString(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s)
+}
+
+// rewriteReplicatedEngine - replace ZooKeeper path and replica name of Replicated engine in CREATE query of database.table
+// '{database}' and '{table}' in zkPath and replicaName are replaced with names of table, other macros are expanded by ClickHouse
+// empty zkPath keeps query unchanged, empty replicaName keeps original replica name or sets '{replica}' when engine has no arguments
+func rewriteReplicatedEngine(query, database, table, zkPath, replicaName string) string {
+	if zkPath == "" {
+		return query
+	}
+	loc := replicatedEngineRe.FindStringIndex(query)
+	if loc == nil {
+		return query
+	}
+	names := strings.NewReplacer("{database}", database, "{table}", table)
+	zkPath = quoteString(names.Replace(zkPath))
+	replicaName = quoteString(names.Replace(replicaName))
+	engine, rest := query[:loc[1]], query[loc[1]:]
+	if m := replicatedArgsRe.FindStringSubmatch(rest); m != nil {
+		if replicaName == "" {
+			replicaName = m[2]
+		}
+		return fmt.Sprintf("%s('%s', '%s'%s", engine, zkPath, replicaName, rest[len(m[0]):])
+	}
+	if replicaName == "" {
+		replicaName = "{replica}"
+	}
+	// engine without arguments takes ZooKeeper path and replica name from server config
+	if strings.HasPrefix(rest, "()") {
+		rest = rest[2:]
+	} else if strings.HasPrefix(rest, "(") {
+		return fmt.Sprintf("%s('%s', '%s', %s", engine, zkPath, replicaName, rest[1:])
+	}
+	return fmt.Sprintf("%s('%s', '%s')%s", engine, zkPath, replicaName, rest)
+}
+
+// IsFirstReplica - check that the server is the first by name of active replicas of table registered in ZooKeeper, also return name of the first replica
+// replica is active when it has 'is_active' node, tables which are not replicated have the only replica
+func (ch *ClickHouse) IsFirstReplica(database, table string) (bool, string, error) {
+	var replicas []struct {
+		ZookeeperPath string `db:"zookeeper_path"`
+		ReplicaName   string `db:"replica_name"`
+	}
+	q := fmt.Sprintf("SELECT zookeeper_path, replica_name FROM `system`.`replicas` WHERE database='%s' AND table='%s'", database, table)
+	if err := ch.conn.Select(&replicas, q); err != nil {
+		return false, "", fmt.Errorf("can't get replica of '%s.%s' with %v", database, table, err)
+	}
+	if len(replicas) == 0 {
+		return true, "", nil
+	}
+	replicasPath := replicas[0].ZookeeperPath + "/replicas"
+	var names []string
+	q = fmt.Sprintf("SELECT name FROM `system`.`zookeeper` WHERE path='%s' ORDER BY name", quoteString(replicasPath))
+	if err := ch.conn.Select(&names, q); err != nil {
+		return false, "", fmt.Errorf("can't get replicas of '%s.%s' from ZooKeeper with %v", database, table, err)
+	}
+	for _, name := range names {
+		var active []string
+		q = fmt.Sprintf("SELECT name FROM `system`.`zookeeper` WHERE path='%s' AND name='is_active'", quoteString(replicasPath+"/"+name))
+		if err := ch.conn.Select(&active, q); err != nil {
+			return false, "", fmt.Errorf("can't get state of replica '%s' of '%s.%s' from ZooKeeper with %v", name, database, table, err)
+		}
+		if len(active) > 0 {
+			return name == replicas[0].ReplicaName, name, nil
+		}
+	}
+	// data of table would be skipped by every replica
+	return false, "", fmt.Errorf("there are no active replicas of '%s.%s' in '%s'", database, table, replicasPath)
+}
+
+// isDataReplica - check that data of table is backed up or attached on this server according to replicated_backup or replicated_restore mode
+func (ch *ClickHouse) isDataReplica(mode, database, table string) (bool, string, error) {
+	if mode != ReplicatedFirstReplica {
+		return true, "", nil
+	}
+	return ch.IsFirstReplica(database, table)
+}
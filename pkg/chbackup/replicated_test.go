@@ -0,0 +1,74 @@
+package chbackup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRewriteReplicatedEngine(t *testing.T) {
+	query := "CREATE TABLE `db`.`t` (a UInt8) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/db/t', '{replica}') ORDER BY a"
+	assert.Equal(t, query, rewriteReplicatedEngine(query, "db", "t", "", ""))
+	assert.Equal(t,
+		"CREATE TABLE `db`.`t` (a UInt8) ENGINE = ReplicatedMergeTree('/clickhouse/restored/{shard}/db/t', '{replica}') ORDER BY a",
+		rewriteReplicatedEngine(query, "db", "t", "/clickhouse/restored/{shard}/{database}/{table}", ""))
+	assert.Equal(t,
+		"CREATE TABLE `db`.`t` (a UInt8) ENGINE = ReplicatedReplacingMergeTree('/new/db/t', 'r1', ver) ORDER BY a",
+		rewriteReplicatedEngine("CREATE TABLE `db`.`t` (a UInt8) ENGINE = ReplicatedReplacingMergeTree('/old/path', 'old', ver) ORDER BY a", "db", "t", "/new/{database}/{table}", "r1"))
+
+	// engine without ZooKeeper arguments uses default path of server
+	assert.Equal(t,
+		"CREATE TABLE `db`.`t` (a UInt8) ENGINE = ReplicatedMergeTree('/new/t', '{replica}') ORDER BY a",
+		rewriteReplicatedEngine("CREATE TABLE `db`.`t` (a UInt8) ENGINE = ReplicatedMergeTree ORDER BY a", "db", "t", "/new/{table}", ""))
+	assert.Equal(t,
+		"CREATE TABLE `db`.`t` (a UInt8) ENGINE = ReplicatedMergeTree('/new/t', '{replica}') ORDER BY a",
+		rewriteReplicatedEngine("CREATE TABLE `db`.`t` (a UInt8) ENGINE = ReplicatedMergeTree() ORDER BY a", "db", "t", "/new/{table}", ""))
+	assert.Equal(t,
+		"CREATE TABLE `db`.`t` (a UInt8) ENGINE = ReplicatedReplacingMergeTree('/new/t', '{replica}', ver) ORDER BY a",
+		rewriteReplicatedEngine("CREATE TABLE `db`.`t` (a UInt8) ENGINE = ReplicatedReplacingMergeTree(ver) ORDER BY a", "db", "t", "/new/{table}", ""))
+
+	memory := "CREATE TABLE `db`.`t` (a UInt8) ENGINE = Memory"
+	assert.Equal(t, memory, rewriteReplicatedEngine(memory, "db", "t", "/new/{table}", ""))
+	assert.Equal(t,
+		"CREATE TABLE `db`.`t'x` (a UInt8) ENGINE = ReplicatedMergeTree('/new/t\\'x', '{replica}') ORDER BY a",
+		rewriteReplicatedEngine("CREATE TABLE `db`.`t'x` (a UInt8) ENGINE = ReplicatedMergeTree ORDER BY a", "db", "t'x", "/new/{table}", ""))
+}
+
+func TestReplicatedConfig(t *testing.T) {
+	config := DefaultConfig()
+	assert.NoError(t, validateConfig(config))
+	config.ClickHouse.ReplicatedRestore = ReplicatedFirstReplica
+	assert.NoError(t, validateConfig(config))
+	config.ClickHouse.ReplicatedBackup = "one"
+	assert.EqualError(t, validateConfig(config), "unknown replicated_backup 'one', supported: 'all', 'first_replica'")
+}
+
+func TestRemoteRestoreSkipsReplica(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clickhouse-backup-replica")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config := DefaultConfig()
+	config.ClickHouse.DataPath = dir
+	config.ClickHouse.ReplicatedRestore = ReplicatedFirstReplica
+	r := &remoteRestore{
+		ch:           &ClickHouse{Config: &config.ClickHouse},
+		tablePattern: "*",
+		data:         true,
+		metadataPath: filepath.Join(dir, "tmp", "metadata"),
+		tables:       map[string]bool{"db.t": true},
+		parts:        map[string]map[string]bool{},
+		tableDisks:   map[string][]TableDisk{"db.t": newTableDisks([]Disk{{Name: DefaultDisk, Path: dir}}, "data/db/t")},
+		partDisks:    map[string]string{},
+		dataReplicas: map[string]bool{"db.t": false},
+	}
+	// parts of table are attached on the first replica, this replica fetches them
+	require.NoError(t, r.write("shadow/db/t/all_1_1_0/data.bin", strings.NewReader("data")))
+	assert.Empty(t, r.parts)
+	_, err = os.Stat(filepath.Join(dir, "data", "db", "t", "detached"))
+	assert.True(t, os.IsNotExist(err))
+}
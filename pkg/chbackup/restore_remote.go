@@ -0,0 +1,433 @@
+package chbackup
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// remoteRestore - restore of backup streamed from remote storage, parts are written directly to 'detached' directories of tables
+type remoteRestore struct {
+	ch           *ClickHouse
+	bd           *BackupDestination
+	tablePattern string
+	schema       bool
+	data         bool
+	// metadataPath - temporary directory for schema of tables from backup
+	metadataPath string
+	schemaOnce   sync.Once
+	schemaErr    error
+	mu           sync.Mutex
+	chownMu      sync.Mutex
+	// tables - tables which exist in ClickHouse, loaded when the first part is written
+	tables map[string]bool
+	// parts - names of written parts of every table
+	parts map[string]map[string]bool
+	// tableDisks - disks allowed by storage policy of every table, loaded when the first part of table is written
+	tableDisks map[string][]TableDisk
+	// partDisks - disk of part in backup from manifests, key is '<db>.<table>/<part>'
+	partDisks map[string]string
+	// dataReplicas - whether parts of table are attached on this server according to replicated_restore, loaded with the first part of table
+	dataReplicas map[string]bool
+	// partPaths - directories of parts in 'detached' written by this restore, they are removed when restore fails
+	partPaths map[string]bool
+}
+
+// addPartPath - record directory of part before its first file is written, so partially written part is removed too
+func (r *remoteRestore) addPartPath(partPath string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.partPaths == nil {
+		r.partPaths = map[string]bool{}
+	}
+	r.partPaths[partPath] = true
+}
+
+// removeParts - remove parts written to 'detached' by failed restore, so they aren't attached by retry or manual ATTACH
+// parts which are attached already are moved from 'detached' and are not touched
+func (r *remoteRestore) removeParts() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for partPath := range r.partPaths {
+		if err := os.RemoveAll(partPath); err != nil {
+			log.Printf("can't remove '%s' with %v", partPath, err)
+		}
+	}
+	r.partPaths = nil
+}
+
+// restoreSchema - create databases and tables from metadata received before the first part, it's called once
+func (r *remoteRestore) restoreSchema() error {
+	r.schemaOnce.Do(func() {
+		if !r.schema {
+			return
+		}
+		tablesForRestore, err := parseSchemaPattern(r.metadataPath, r.tablePattern)
+		if err != nil {
+			r.schemaErr = err
+			return
+		}
+		if len(tablesForRestore) == 0 {
+			r.schemaErr = fmt.Errorf("no have found schemas by %s in backup", r.tablePattern)
+			return
+		}
+		r.schemaErr = createSchemas(r.ch, tablesForRestore)
+	})
+	return r.schemaErr
+}
+
+// tableExists - check that table is created before its parts are written to 'detached' directory
+func (r *remoteRestore) tableExists(database, table string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.tables == nil {
+		chTables, err := r.ch.GetTables()
+		if err != nil {
+			return false, err
+		}
+		r.tables = map[string]bool{}
+		for _, chTable := range chTables {
+			r.tables[fmt.Sprintf("%s.%s", chTable.Database, chTable.Name)] = true
+		}
+	}
+	return r.tables[fmt.Sprintf("%s.%s", database, table)], nil
+}
+
+// isDataReplica - check that parts of table are attached on this server, other replicas fetch them by replication
+func (r *remoteRestore) isDataReplica(database, table string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tableName := fmt.Sprintf("%s.%s", database, table)
+	if r.dataReplicas == nil {
+		r.dataReplicas = map[string]bool{}
+	}
+	if dataReplica, ok := r.dataReplicas[tableName]; ok {
+		return dataReplica, nil
+	}
+	dataReplica, firstReplica, err := r.ch.isDataReplica(r.ch.Config.ReplicatedRestore, database, table)
+	if err != nil {
+		return false, err
+	}
+	if !dataReplica {
+		log.Printf("Skip data of `%s`.`%s`, it's attached on replica '%s' and fetched by replication", database, table, firstReplica)
+	}
+	r.dataReplicas[tableName] = dataReplica
+	return dataReplica, nil
+}
+
+// partDisk - return disk which part is restored to
+func (r *remoteRestore) partDisk(database, table, part string) (TableDisk, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tableName := fmt.Sprintf("%s.%s", database, table)
+	if r.tableDisks == nil {
+		r.tableDisks = map[string][]TableDisk{}
+	}
+	disks, ok := r.tableDisks[tableName]
+	if !ok {
+		var err error
+		if disks, err = r.ch.GetTableDisks(database, table); err != nil {
+			return TableDisk{}, err
+		}
+		r.tableDisks[tableName] = disks
+	}
+	return selectDisk(disks, r.partDisks[fmt.Sprintf("%s/%s", tableName, part)]), nil
+}
+
+// chown - give file to clickhouse user, ClickHouse.Chown caches owner and is not safe for concurrent use
+func (r *remoteRestore) chown(name string) error {
+	r.chownMu.Lock()
+	defer r.chownMu.Unlock()
+	return r.ch.Chown(name)
+}
+
+// mkdirChown - create directory and its parents below root and give them to clickhouse user
+func (r *remoteRestore) mkdirChown(root, dir string) error {
+	if dir == root || !strings.HasPrefix(dir, root) {
+		return nil
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	if err := r.mkdirChown(root, filepath.Dir(dir)); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0750); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return r.chown(dir)
+}
+
+// write - save schema of table to metadata directory or file of part to 'detached' directory of table
+func (r *remoteRestore) write(name string, reader io.Reader) error {
+	pathParts := strings.Split(name, "/")
+	if pathParts[0] == "metadata" {
+		return extractToDir(filepath.Dir(r.metadataPath))(name, reader)
+	}
+	if len(pathParts) < 5 || pathParts[0] != "shadow" {
+		return nil
+	}
+	if _, err := strconv.Atoi(pathParts[1]); err == nil && pathParts[2] == "data" {
+		return fmt.Errorf("backup has old format and can't be restored from remote storage, download it first")
+	}
+	if err := r.restoreSchema(); err != nil {
+		return err
+	}
+	database, _ := url.PathUnescape(pathParts[1])
+	table, _ := url.PathUnescape(pathParts[2])
+	exists, err := r.tableExists(database, table)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("'%s.%s' is not created. Restore schema first or create missing tables manually", database, table)
+	}
+	dataReplica, err := r.isDataReplica(database, table)
+	if err != nil || !dataReplica {
+		return err
+	}
+	disk, err := r.partDisk(database, table, pathParts[3])
+	if err != nil {
+		return err
+	}
+	detachedPath := disk.detachedPath()
+	dstFilePath := filepath.Join(append([]string{detachedPath}, pathParts[3:]...)...)
+	if err := os.MkdirAll(detachedPath, 0750); err != nil {
+		return err
+	}
+	r.addPartPath(filepath.Join(detachedPath, pathParts[3]))
+	if err := r.mkdirChown(detachedPath, filepath.Dir(dstFilePath)); err != nil {
+		return err
+	}
+	dst, err := os.Create(dstFilePath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, reader); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	if err := r.chown(dstFilePath); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tableName := fmt.Sprintf("%s.%s", database, table)
+	if r.parts[tableName] == nil {
+		r.parts[tableName] = map[string]bool{}
+	}
+	r.parts[tableName][pathParts[3]] = true
+	return nil
+}
+
+// restoreArchives - stream archives of backup and pass files accepted by filter to write
+// archives without table are streamed first, so schema is known before parts of 'table' layout are received
+// returns files which are stored in required backup of incremental backup
+func (r *remoteRestore) restoreArchives(backupName string, filter func(string) bool) (string, []string, error) {
+	bd := r.bd
+	manifest, err := bd.GetManifest(backupName)
+	if err != nil && err != ErrNotFound {
+		return "", nil, err
+	}
+	if manifest != nil {
+		r.mu.Lock()
+		for _, table := range manifest.Tables {
+			for _, part := range table.Parts {
+				r.partDisks[fmt.Sprintf("%s.%s/%s", table.Database, table.Name, part.Name)] = part.Disk
+			}
+		}
+		r.mu.Unlock()
+	}
+	var compressionFormat string
+	first, rest := []string{}, []string{}
+	var totalBytes int64
+	if manifest != nil && len(manifest.Archives) > 0 {
+		compressionFormat = manifest.CompressionFormat
+		for _, archive := range selectArchives(manifest.Archives, r.tablePattern) {
+			if archive.Table != "" && !r.data {
+				continue
+			}
+			archiveName := path.Join(bd.path, backupName, archive.Name)
+			file, err := bd.GetFile(archiveName)
+			if err != nil {
+				if err == ErrNotFound {
+					return "", nil, fmt.Errorf("'%s' is not found on remote storage", archiveName)
+				}
+				return "", nil, err
+			}
+			totalBytes += file.Size()
+			if archive.Table == "" {
+				first = append(first, archiveName)
+			} else {
+				rest = append(rest, archiveName)
+			}
+		}
+	} else {
+		file, format, err := bd.findArchive(backupName)
+		if err != nil {
+			if err == ErrNotFound {
+				return "", nil, fmt.Errorf("archive of '%s' is not found on remote storage", backupName)
+			}
+			return "", nil, err
+		}
+		compressionFormat = format
+		totalBytes = file.Size()
+		first = append(first, path.Join(bd.path, fmt.Sprintf("%s.%s", backupName, getExtension(format))))
+	}
+
+	bar := StartNewByteBar(!bd.disableProgressBar, totalBytes)
+	var requiredBackup string
+	hardlinks := []string{}
+	var mu sync.Mutex
+	restore := func(archiveName string, cancel <-chan struct{}) error {
+		reader, err := bd.GetFileReader(archiveName)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		metafile, err := bd.extractArchive(bar.NewProxyReader(reader), compressionFormat, filter, r.write, cancel)
+		if err != nil {
+			return fmt.Errorf("can't restore '%s' with %v", archiveName, err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if metafile.RequiredBackup != "" {
+			requiredBackup = metafile.RequiredBackup
+		}
+		hardlinks = append(hardlinks, metafile.Hardlinks...)
+		return nil
+	}
+	for _, archiveName := range first {
+		if err := restore(archiveName, nil); err != nil {
+			return "", nil, err
+		}
+	}
+	if err := r.restoreSchema(); err != nil {
+		return "", nil, err
+	}
+	if err := runParallel(bd.downloadConcurrency, len(rest), func(i int, cancel <-chan struct{}) error {
+		return restore(rest[i], cancel)
+	}); err != nil {
+		return "", nil, err
+	}
+	bar.Finish()
+	return requiredBackup, hardlinks, nil
+}
+
+// restoreData - write parts of tables matched by tablePattern to 'detached' directories
+// files of incremental backup which are stored in required backups are streamed from them
+func (r *remoteRestore) restoreData(backupName string) error {
+	filter := func(name string) bool {
+		if !r.data && strings.HasPrefix(name, "shadow/") {
+			return false
+		}
+		if !r.schema && strings.HasPrefix(name, "metadata/") {
+			return false
+		}
+		return matchBackupFile(name, r.tablePattern)
+	}
+	requiredBackup, hardlinks, err := r.restoreArchives(backupName, filter)
+	if err != nil {
+		return err
+	}
+	for len(hardlinks) > 0 && requiredBackup != "" {
+		log.Printf("Backup '%s' required '%s'. Restoring %d files from it.", backupName, requiredBackup, len(hardlinks))
+		missing := map[string]bool{}
+		for _, hardlink := range hardlinks {
+			missing[hardlink] = true
+		}
+		backupName = requiredBackup
+		requiredBackup, hardlinks, err = r.restoreArchives(backupName, func(name string) bool { return missing[name] })
+		if err != nil {
+			return fmt.Errorf("can't restore files of required backup '%s' with %v", backupName, err)
+		}
+	}
+	return nil
+}
+
+// attachParts - attach written parts of every table
+func (r *remoteRestore) attachParts() error {
+	tableNames := []string{}
+	for tableName := range r.parts {
+		tableNames = append(tableNames, tableName)
+	}
+	sort.Strings(tableNames)
+	for _, tableName := range tableNames {
+		names := strings.SplitN(tableName, ".", 2)
+		table := BackupTable{Database: names[0], Name: names[1]}
+		partNames := []string{}
+		for partName := range r.parts[tableName] {
+			partNames = append(partNames, partName)
+		}
+		sort.Strings(partNames)
+		for _, partName := range partNames {
+			table.Partitions = append(table.Partitions, BackupPartition{Name: partName})
+		}
+		if err := r.ch.AttachPatritions(table); err != nil {
+			return fmt.Errorf("can't attach partitions for table '%s' with %v", tableName, err)
+		}
+	}
+	return nil
+}
+
+// RestoreRemote - restore tables matched by tablePattern streaming backup from remote storage without local copy of backup
+func RestoreRemote(config Config, backupName string, tablePattern string, schemaOnly bool, dataOnly bool) error {
+	if err := ValidateBackupName(backupName); err != nil {
+		return err
+	}
+	if err := ValidateTablePattern(tablePattern); err != nil {
+		return err
+	}
+	bd, err := NewBackupDestination(config)
+	if err != nil {
+		return err
+	}
+	if err := bd.Connect(); err != nil {
+		return fmt.Errorf("can't connect to %s with %v", bd.Kind(), err)
+	}
+	ch := &ClickHouse{
+		Config: &config.ClickHouse,
+	}
+	if err := ch.Connect(); err != nil {
+		return fmt.Errorf("can't connect to clickouse with: %v", err)
+	}
+	defer ch.Close()
+	tmpDir, err := ioutil.TempDir("", "clickhouse-backup-restore")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	r := &remoteRestore{
+		ch:           ch,
+		bd:           bd,
+		tablePattern: tablePattern,
+		schema:       schemaOnly || (schemaOnly == dataOnly),
+		data:         dataOnly || (schemaOnly == dataOnly),
+		metadataPath: filepath.Join(tmpDir, "metadata"),
+		parts:        map[string]map[string]bool{},
+		partDisks:    map[string]string{},
+	}
+	log.Printf("Restore backup '%s' from %s", backupName, bd.Kind())
+	if err := r.restoreData(backupName); err != nil {
+		r.removeParts()
+		return err
+	}
+	if err := r.attachParts(); err != nil {
+		r.removeParts()
+		return err
+	}
+	log.Println("  Done.")
+	return nil
+}
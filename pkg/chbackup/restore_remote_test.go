@@ -0,0 +1,159 @@
+package chbackup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteRestoreData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clickhouse-backup-restore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "remote")
+	local := filepath.Join(dir, "local")
+	dataPath := filepath.Join(dir, "clickhouse")
+	require.NoError(t, os.MkdirAll(root, os.ModePerm))
+	require.NoError(t, os.MkdirAll(filepath.Join(dataPath, "data"), os.ModePerm))
+
+	writeFile := func(name, content string) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(name), os.ModePerm))
+		require.NoError(t, ioutil.WriteFile(name, []byte(content), 0640))
+	}
+	writeFile(filepath.Join(local, "full", "metadata", "db", "t.sql"), "ATTACH TABLE t")
+	writeFile(filepath.Join(local, "full", "shadow", "db", "t", "all_1_1_0", "data.bin"), "data")
+	writeFile(filepath.Join(local, "full", "shadow", "db", "other", "all_1_1_0", "data.bin"), "other data")
+	writeFile(filepath.Join(local, "diff", "metadata", "db", "t.sql"), "ATTACH TABLE t")
+	writeFile(filepath.Join(local, "diff", "shadow", "db", "t", "all_2_2_0", "data.bin"), "new data")
+	require.NoError(t, os.MkdirAll(filepath.Join(local, "diff", "shadow", "db", "t", "all_1_1_0"), os.ModePerm))
+	require.NoError(t, os.Link(filepath.Join(local, "full", "shadow", "db", "t", "all_1_1_0", "data.bin"), filepath.Join(local, "diff", "shadow", "db", "t", "all_1_1_0", "data.bin")))
+
+	config := DefaultConfig()
+	config.ClickHouse.DataPath = dataPath
+	config.General.RemoteStorage = "fs"
+	config.General.DisableProgressBar = true
+	config.FS.RootPath = root
+	bd, err := NewBackupDestination(*config)
+	require.NoError(t, err)
+	require.NoError(t, bd.Connect())
+	require.NoError(t, bd.CompressedStreamUpload(filepath.Join(local, "full"), "full", ""))
+	require.NoError(t, bd.CompressedStreamUpload(filepath.Join(local, "diff"), "diff", filepath.Join(local, "full")))
+
+	r := &remoteRestore{
+		ch:           &ClickHouse{Config: &config.ClickHouse},
+		bd:           bd,
+		tablePattern: "db.t",
+		data:         true,
+		metadataPath: filepath.Join(dir, "tmp", "metadata"),
+		tables:       map[string]bool{"db.t": true},
+		parts:        map[string]map[string]bool{},
+		tableDisks:   map[string][]TableDisk{"db.t": newTableDisks([]Disk{{Name: DefaultDisk, Path: dataPath}}, "data/db/t")},
+		partDisks:    map[string]string{},
+	}
+	require.NoError(t, r.restoreData("diff"))
+	assert.Equal(t, map[string]map[string]bool{"db.t": {"all_1_1_0": true, "all_2_2_0": true}}, r.parts)
+	detachedPath := filepath.Join(dataPath, "data", "db", "t", "detached")
+	for name, expected := range map[string]string{"all_1_1_0/data.bin": "data", "all_2_2_0/data.bin": "new data"} {
+		content, err := ioutil.ReadFile(filepath.Join(detachedPath, name))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(content))
+	}
+	_, err = os.Stat(filepath.Join(dataPath, "data", "db", "other"))
+	assert.True(t, os.IsNotExist(err))
+	// local copy of backup is not created
+	_, err = os.Stat(filepath.Join(dataPath, "backup"))
+	assert.True(t, os.IsNotExist(err))
+
+	r.tablePattern = "db.other"
+	r.parts = map[string]map[string]bool{}
+	assert.EqualError(t, r.restoreData("full"), "can't restore 'full.tar.gz' with 'db.other' is not created. Restore schema first or create missing tables manually")
+
+	// parts written by failed restore are removed, other parts in 'detached' are kept
+	require.NoError(t, os.MkdirAll(filepath.Join(detachedPath, "all_9_9_0"), os.ModePerm))
+	r.removeParts()
+	for _, part := range []string{"all_1_1_0", "all_2_2_0"} {
+		_, err = os.Stat(filepath.Join(detachedPath, part))
+		assert.True(t, os.IsNotExist(err), part)
+	}
+	_, err = os.Stat(filepath.Join(detachedPath, "all_9_9_0"))
+	assert.NoError(t, err)
+}
+
+// failingReader - stream of archive entry which breaks after some bytes
+type failingReader struct {
+	data string
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		return 0, fmt.Errorf("connection reset")
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestRemoteRestoreRemovesPartialPart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clickhouse-backup-restore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config := DefaultConfig()
+	config.ClickHouse.DataPath = dir
+	r := &remoteRestore{
+		ch:           &ClickHouse{Config: &config.ClickHouse},
+		tablePattern: "*",
+		data:         true,
+		metadataPath: filepath.Join(dir, "tmp", "metadata"),
+		tables:       map[string]bool{"db.t": true},
+		parts:        map[string]map[string]bool{},
+		tableDisks:   map[string][]TableDisk{"db.t": newTableDisks([]Disk{{Name: DefaultDisk, Path: dir}}, "data/db/t")},
+		partDisks:    map[string]string{},
+	}
+	assert.EqualError(t, r.write("shadow/db/t/all_1_1_0/data.bin", &failingReader{data: "partial"}), "connection reset")
+	partPath := filepath.Join(dir, "data", "db", "t", "detached", "all_1_1_0")
+	_, err = os.Stat(filepath.Join(partPath, "data.bin"))
+	require.NoError(t, err)
+	r.removeParts()
+	_, err = os.Stat(partPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRemoteRestorePartDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clickhouse-backup-restore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defaultDisk := Disk{Name: DefaultDisk, Path: filepath.Join(dir, "default")}
+	hotDisk := Disk{Name: "hot", Path: filepath.Join(dir, "hot")}
+	require.NoError(t, os.MkdirAll(filepath.Join(defaultDisk.Path, "data"), os.ModePerm))
+
+	config := DefaultConfig()
+	config.ClickHouse.DataPath = defaultDisk.Path
+	r := &remoteRestore{
+		ch:           &ClickHouse{Config: &config.ClickHouse},
+		tablePattern: "*",
+		data:         true,
+		metadataPath: filepath.Join(dir, "tmp", "metadata"),
+		tables:       map[string]bool{"db.t": true},
+		parts:        map[string]map[string]bool{},
+		tableDisks:   map[string][]TableDisk{"db.t": newTableDisks([]Disk{hotDisk, defaultDisk}, "store/f7a/f7a2c1b0-0000-4000-8000-000000000001")},
+		partDisks:    map[string]string{"db.t/all_1_1_0": DefaultDisk, "db.t/all_2_2_0": "cold"},
+	}
+	// part is restored to its disk when storage policy allows it and to the first disk of policy otherwise
+	// directory of table in Atomic database is the same on every disk
+	require.NoError(t, r.write("shadow/db/t/all_1_1_0/data.bin", strings.NewReader("data")))
+	require.NoError(t, r.write("shadow/db/t/all_2_2_0/data.bin", strings.NewReader("new data")))
+	for name, expected := range map[string]string{
+		filepath.Join(defaultDisk.Path, "store", "f7a", "f7a2c1b0-0000-4000-8000-000000000001", "detached", "all_1_1_0", "data.bin"): "data",
+		filepath.Join(hotDisk.Path, "store", "f7a", "f7a2c1b0-0000-4000-8000-000000000001", "detached", "all_2_2_0", "data.bin"):     "new data",
+	} {
+		content, err := ioutil.ReadFile(name)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(content))
+	}
+}
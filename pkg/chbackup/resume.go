@@ -0,0 +1,414 @@
+package chbackup
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// uploadStateSuffix - suffix of file next to local backup directory which keeps progress of upload
+	uploadStateSuffix = ".upload.json"
+	// downloadStateSuffix - suffix of file next to local backup directory which keeps progress of download
+	downloadStateSuffix = ".download.json"
+	// downloadSpoolSuffix - suffix of files next to local backup directory which keep downloaded bytes of table archives which are not extracted yet
+	downloadSpoolSuffix = ".part"
+)
+
+// resumableStorage - remote storage which can continue interrupted upload of object
+type resumableStorage interface {
+	PutFileResumable(key string, r io.ReadCloser, upload *multipartUpload) error
+	AbortUpload(key, uploadID string) error
+}
+
+// multipartPart - uploaded part of multipart upload, checksum is used to check that the same part of regenerated archive is not changed
+type multipartPart struct {
+	Number int64  `json:"number"`
+	ETag   string `json:"etag"`
+	MD5    string `json:"md5"`
+	Size   int64  `json:"size"`
+}
+
+// multipartUpload - multipart upload of archive which is not completed yet, every change is saved to upload state file
+type multipartUpload struct {
+	UploadID string          `json:"upload_id"`
+	Parts    []multipartPart `json:"parts"`
+	state    *uploadState
+	key      string
+}
+
+func (u *multipartUpload) id() string {
+	u.state.mu.Lock()
+	defer u.state.mu.Unlock()
+	return u.UploadID
+}
+
+func (u *multipartUpload) parts() []multipartPart {
+	u.state.mu.Lock()
+	defer u.state.mu.Unlock()
+	return append([]multipartPart{}, u.Parts...)
+}
+
+// start - record id of new multipart upload, parts of previous upload are forgotten
+func (u *multipartUpload) start(uploadID string) error {
+	u.state.mu.Lock()
+	defer u.state.mu.Unlock()
+	u.UploadID = uploadID
+	u.Parts = []multipartPart{}
+	u.state.Multipart[u.key] = u
+	return u.state.write()
+}
+
+func (u *multipartUpload) addPart(part multipartPart) error {
+	u.state.mu.Lock()
+	defer u.state.mu.Unlock()
+	parts := []multipartPart{part}
+	for _, p := range u.Parts {
+		if p.Number != part.Number {
+			parts = append(parts, p)
+		}
+	}
+	u.Parts = parts
+	return u.state.write()
+}
+
+// partChecksum - md5 of part in the same form as it's kept in upload state
+func partChecksum(data []byte) string {
+	return fmt.Sprintf("%x", md5.Sum(data))
+}
+
+// uploadState - archives which are already on remote storage and multipart uploads of archives which are interrupted
+// upload is continued only if backup, destination and archive settings are not changed
+type uploadState struct {
+	Destination       string                      `json:"destination"`
+	CreationDate      time.Time                   `json:"creation_date"`
+	CompressionFormat string                      `json:"compression_format"`
+	RequiredBackup    string                      `json:"required_backup,omitempty"`
+	Encryption        *ManifestEncryption         `json:"encryption,omitempty"`
+	Archives          []string                    `json:"archives"`
+	Multipart         map[string]*multipartUpload `json:"multipart,omitempty"`
+	mu                sync.Mutex
+	localPath         string
+}
+
+func (s *uploadState) sameUpload(other *uploadState) bool {
+	sameEncryption := (s.Encryption == nil && other.Encryption == nil) ||
+		(s.Encryption != nil && other.Encryption != nil && *s.Encryption == *other.Encryption)
+	return s.Destination == other.Destination &&
+		s.CreationDate.Equal(other.CreationDate) &&
+		s.CompressionFormat == other.CompressionFormat &&
+		s.RequiredBackup == other.RequiredBackup &&
+		sameEncryption
+}
+
+// write - save state to file, must be called with locked mutex
+func (s *uploadState) write() error {
+	if err := writeUploadState(s.localPath, s); err != nil {
+		return fmt.Errorf("can't save upload state with %v", err)
+	}
+	return nil
+}
+
+// multipart - return multipart upload of archive with key on remote storage, new upload has empty id and is recorded when it's started
+func (s *uploadState) multipart(key string) *multipartUpload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	upload, ok := s.Multipart[key]
+	if !ok {
+		upload = &multipartUpload{Parts: []multipartPart{}}
+	}
+	upload.state = s
+	upload.key = key
+	return upload
+}
+
+// uploaded - record archive as uploaded, name is the name of archive in manifest and key is the key of archive on remote storage
+func (s *uploadState) uploaded(name, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Archives = append(s.Archives, name)
+	delete(s.Multipart, key)
+	return s.write()
+}
+
+func readUploadState(localPath string) (*uploadState, error) {
+	content, err := ioutil.ReadFile(localPath + uploadStateSuffix)
+	if err != nil {
+		return nil, err
+	}
+	var state uploadState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return nil, fmt.Errorf("can't parse '%s' with %v", localPath+uploadStateSuffix, err)
+	}
+	return &state, nil
+}
+
+func writeUploadState(localPath string, state *uploadState) error {
+	content, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return fmt.Errorf("can't marshal upload state with %v", err)
+	}
+	return ioutil.WriteFile(localPath+uploadStateSuffix, content, 0640)
+}
+
+// removeUploadState - remove progress of upload of local backup, missing file is not an error
+func removeUploadState(localPath string) error {
+	if err := os.Remove(localPath + uploadStateSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// resumeUpload - fill state with progress of previous attempt of the same upload
+// multipart uploads of other upload of local backup are aborted because they will never be completed
+func (bd *BackupDestination) resumeUpload(localPath string, state *uploadState) {
+	state.localPath = localPath
+	state.Archives = []string{}
+	state.Multipart = map[string]*multipartUpload{}
+	previous, err := readUploadState(localPath)
+	if err != nil {
+		return
+	}
+	if !previous.sameUpload(state) {
+		bd.abortUploads(previous)
+		return
+	}
+	state.Archives = previous.Archives
+	if previous.Multipart != nil {
+		state.Multipart = previous.Multipart
+	}
+	log.Printf("  Continue upload, %d archives are already uploaded", len(state.Archives))
+}
+
+// abortUploads - abort multipart uploads recorded in state, errors are only logged because incomplete uploads are also removed by lifecycle rules of bucket
+func (bd *BackupDestination) abortUploads(state *uploadState) {
+	storage, ok := bd.RemoteStorage.(resumableStorage)
+	if !ok {
+		return
+	}
+	for key, upload := range state.Multipart {
+		if upload.UploadID == "" {
+			continue
+		}
+		if err := storage.AbortUpload(key, upload.UploadID); err != nil {
+			log.Printf("can't abort upload of '%s' with %v", key, err)
+		}
+	}
+}
+
+// DiscardUpload - forget progress of previous upload of local backup, so next upload starts over
+func (bd *BackupDestination) DiscardUpload(localPath string) error {
+	if state, err := readUploadState(localPath); err == nil {
+		bd.abortUploads(state)
+	}
+	return removeUploadState(localPath)
+}
+
+// localBackupDate - creation date of local backup which identifies it in upload state
+func localBackupDate(localPath string) (time.Time, error) {
+	manifest, err := readLocalManifest(localPath)
+	if err == nil {
+		return manifest.CreationDate, nil
+	}
+	if !os.IsNotExist(err) {
+		return time.Time{}, err
+	}
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime().UTC(), nil
+}
+
+// downloadArchive - progress of archive download, archive is downloaded again if it's changed on remote storage
+type downloadArchive struct {
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+	Extracted    bool      `json:"extracted"`
+	MetaFile     *MetaFile `json:"meta,omitempty"`
+}
+
+// downloadState - archives which are already extracted to local backup directory
+// download is continued only if source and table pattern are not changed
+type downloadState struct {
+	Source       string                      `json:"source"`
+	TablePattern string                      `json:"table_pattern,omitempty"`
+	Archives     map[string]*downloadArchive `json:"archives"`
+	mu           sync.Mutex
+	localPath    string
+}
+
+// archive - return progress of archive with key on remote storage, spool of changed archive is removed
+func (s *downloadState) archive(key string, file RemoteFile) *downloadArchive {
+	archive, ok := s.Archives[key]
+	if ok && archive.Size == file.Size() && archive.LastModified.Equal(file.LastModified()) {
+		return archive
+	}
+	os.Remove(downloadSpoolPath(s.localPath, key))
+	archive = &downloadArchive{Size: file.Size(), LastModified: file.LastModified()}
+	s.Archives[key] = archive
+	return archive
+}
+
+// extracted - record archive as extracted and remove its spool
+func (s *downloadState) extracted(key string, metafile MetaFile) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	archive := s.Archives[key]
+	archive.Extracted = true
+	archive.MetaFile = &metafile
+	if err := os.Remove(downloadSpoolPath(s.localPath, key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.write()
+}
+
+// write - save state to file, must be called with locked mutex or before transfers are started
+func (s *downloadState) write() error {
+	content, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return fmt.Errorf("can't marshal download state with %v", err)
+	}
+	if err := ioutil.WriteFile(s.localPath+downloadStateSuffix, content, 0640); err != nil {
+		return fmt.Errorf("can't save download state with %v", err)
+	}
+	return nil
+}
+
+func readDownloadState(localPath string) (*downloadState, error) {
+	content, err := ioutil.ReadFile(localPath + downloadStateSuffix)
+	if err != nil {
+		return nil, err
+	}
+	var state downloadState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return nil, fmt.Errorf("can't parse '%s' with %v", localPath+downloadStateSuffix, err)
+	}
+	return &state, nil
+}
+
+// downloadSpoolPath - file next to local backup directory where archive is saved while it's extracted
+func downloadSpoolPath(localPath, key string) string {
+	return fmt.Sprintf("%s.download.%x%s", localPath, md5.Sum([]byte(key)), downloadSpoolSuffix)
+}
+
+// removeDownloadState - remove progress and spools of download of local backup, missing files are not an error
+func removeDownloadState(localPath string) error {
+	spools, err := filepath.Glob(localPath + ".download.*" + downloadSpoolSuffix)
+	if err != nil {
+		return err
+	}
+	for _, spool := range append(spools, localPath+downloadStateSuffix) {
+		if err := os.Remove(spool); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// resumeDownload - return progress of previous attempt of the same download
+// partially extracted backup of other download is removed
+func resumeDownload(localPath, source, tablePattern string) (*downloadState, error) {
+	state := &downloadState{
+		Source:       source,
+		TablePattern: tablePattern,
+		Archives:     map[string]*downloadArchive{},
+		localPath:    localPath,
+	}
+	previous, err := readDownloadState(localPath)
+	if err != nil && os.IsNotExist(err) {
+		return state, nil
+	}
+	if err == nil && previous.Source == source && previous.TablePattern == tablePattern {
+		if previous.Archives != nil {
+			state.Archives = previous.Archives
+		}
+		log.Printf("  Continue download of '%s'", filepath.Base(localPath))
+		return state, nil
+	}
+	if err := DiscardDownload(localPath); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// DiscardDownload - remove partially downloaded backup with its progress, backup which is downloaded completely is not touched
+func DiscardDownload(localPath string) error {
+	if _, err := os.Stat(localPath + downloadStateSuffix); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := os.RemoveAll(localPath); err != nil {
+		return err
+	}
+	return removeDownloadState(localPath)
+}
+
+// spoolReader - archive stream which is saved to spool file while it's read
+// bytes saved by previous attempt are read from spool and only the rest of archive is requested from remote storage
+type spoolReader struct {
+	io.Reader
+	spool  *os.File
+	remote io.ReadCloser
+}
+
+func (r *spoolReader) Close() error {
+	if r.remote != nil {
+		r.remote.Close()
+	}
+	return r.spool.Close()
+}
+
+// openSpooledArchive - open archive with key and size on remote storage continuing from its spool, only bytes read from remote storage are added to bar
+// empty spoolPath streams archive without spool, it's used for the whole backup in one archive which would double used disk space
+// while it's extracted, interrupted download of such archive starts over
+func (bd *BackupDestination) openSpooledArchive(key string, size int64, spoolPath string, bar *Bar) (io.ReadCloser, error) {
+	if spoolPath == "" {
+		remote, err := bd.GetFileReader(key)
+		if err != nil {
+			return nil, err
+		}
+		return &proxyReadCloser{Reader: bar.NewProxyReader(remote), Closer: remote}, nil
+	}
+	spool, err := os.OpenFile(spoolPath, os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := spool.Seek(0, io.SeekEnd)
+	if err != nil {
+		spool.Close()
+		return nil, err
+	}
+	spooled := io.NewSectionReader(spool, 0, offset)
+	if offset >= size {
+		return &spoolReader{Reader: spooled, spool: spool}, nil
+	}
+	if offset > 0 {
+		log.Printf("  Continue download of '%s' from %d bytes", key, offset)
+	}
+	remote, err := bd.GetFileReaderWithOffset(key, offset)
+	if err != nil {
+		spool.Close()
+		return nil, err
+	}
+	return &spoolReader{
+		Reader: io.MultiReader(spooled, io.TeeReader(bar.NewProxyReader(remote), spool)),
+		spool:  spool,
+		remote: remote,
+	}, nil
+}
+
+// proxyReadCloser - read stream through wrapping reader and close the original stream
+type proxyReadCloser struct {
+	io.Reader
+	io.Closer
+}
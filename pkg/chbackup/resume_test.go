@@ -0,0 +1,268 @@
+package chbackup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clickhouse-backup-resume")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "remote")
+	require.NoError(t, os.MkdirAll(root, os.ModePerm))
+	createTestBackup(t, filepath.Join(dir, "data", "backup", "backup"))
+
+	config := DefaultConfig()
+	config.ClickHouse.DataPath = filepath.Join(dir, "data")
+	config.General.RemoteStorage = "fs"
+	config.General.DisableProgressBar = true
+	config.General.ArchiveLayout = ArchiveLayoutTable
+	config.FS.RootPath = root
+	require.NoError(t, Upload(*config, "backup", "", true))
+	bd, err := NewBackupDestination(*config)
+	require.NoError(t, err)
+	require.NoError(t, bd.Connect())
+
+	// the first half of table archive is downloaded by previous attempt, it's replaced by garbage on remote storage to check that spool is used
+	archivePath := filepath.Join(root, "backup", "shadow", "db", "t1.tar.gz")
+	archive, err := ioutil.ReadFile(archivePath)
+	require.NoError(t, err)
+	info, err := os.Stat(archivePath)
+	require.NoError(t, err)
+	localPath := filepath.Join(dir, "download", "backup")
+	require.NoError(t, os.MkdirAll(localPath, os.ModePerm))
+	state := &downloadState{
+		Source: "FS:backup",
+		Archives: map[string]*downloadArchive{
+			"backup/shadow/db/t1.tar.gz": {Size: info.Size(), LastModified: info.ModTime()},
+		},
+		localPath: localPath,
+	}
+	require.NoError(t, state.write())
+	half := len(archive) / 2
+	require.NoError(t, ioutil.WriteFile(downloadSpoolPath(localPath, "backup/shadow/db/t1.tar.gz"), archive[:half], 0640))
+	require.NoError(t, ioutil.WriteFile(archivePath, append(make([]byte, half), archive[half:]...), 0640))
+	require.NoError(t, os.Chtimes(archivePath, info.ModTime(), info.ModTime()))
+
+	require.NoError(t, bd.CompressedStreamDownload("backup", localPath, ""))
+	content, err := ioutil.ReadFile(filepath.Join(localPath, "shadow", "db", "t1", "all_1_1_0", "data.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, "t1 data", string(content))
+	for _, name := range []string{localPath + downloadStateSuffix, downloadSpoolPath(localPath, "backup/shadow/db/t1.tar.gz")} {
+		_, err := os.Stat(name)
+		assert.True(t, os.IsNotExist(err), name)
+	}
+}
+
+func TestDownloadSingleArchiveWithoutSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clickhouse-backup-resume")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "remote")
+	require.NoError(t, os.MkdirAll(root, os.ModePerm))
+	createTestBackup(t, filepath.Join(dir, "backup"))
+
+	config := DefaultConfig()
+	config.General.RemoteStorage = "fs"
+	config.General.DisableProgressBar = true
+	config.FS.RootPath = root
+	bd, err := NewBackupDestination(*config)
+	require.NoError(t, err)
+	require.NoError(t, bd.Connect())
+	require.NoError(t, bd.CompressedStreamUpload(filepath.Join(dir, "backup"), "backup", ""))
+
+	// the whole backup in one archive isn't spooled, interrupted download reads archive from the beginning
+	info, err := os.Stat(filepath.Join(root, "backup.tar.gz"))
+	require.NoError(t, err)
+	localPath := filepath.Join(dir, "download", "backup")
+	require.NoError(t, os.MkdirAll(localPath, os.ModePerm))
+	state := &downloadState{
+		Source: "FS:backup",
+		Archives: map[string]*downloadArchive{
+			"backup.tar.gz": {Size: info.Size(), LastModified: info.ModTime()},
+		},
+		localPath: localPath,
+	}
+	require.NoError(t, state.write())
+	require.NoError(t, ioutil.WriteFile(downloadSpoolPath(localPath, "backup.tar.gz"), []byte("garbage"), 0640))
+
+	require.NoError(t, bd.CompressedStreamDownload("backup", localPath, ""))
+	content, err := ioutil.ReadFile(filepath.Join(localPath, "shadow", "db", "t2", "2021_2_2_0", "data.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, "t2 data of 2021", string(content))
+	_, err = os.Stat(downloadSpoolPath(localPath, "backup.tar.gz"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDownloadResumeSkipsExtractedArchives(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clickhouse-backup-resume")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "remote")
+	require.NoError(t, os.MkdirAll(root, os.ModePerm))
+	createTestBackup(t, filepath.Join(dir, "data", "backup", "backup"))
+
+	config := DefaultConfig()
+	config.ClickHouse.DataPath = filepath.Join(dir, "data")
+	config.General.RemoteStorage = "fs"
+	config.General.DisableProgressBar = true
+	config.General.ArchiveLayout = ArchiveLayoutTable
+	config.FS.RootPath = root
+	require.NoError(t, Upload(*config, "backup", "", true))
+
+	config.ClickHouse.DataPath = filepath.Join(dir, "download")
+	localPath := filepath.Join(dir, "download", "backup", "backup")
+	require.NoError(t, os.MkdirAll(localPath, os.ModePerm))
+	info, err := os.Stat(filepath.Join(root, "backup", "shadow", "db", "t1.tar.gz"))
+	require.NoError(t, err)
+	state := &downloadState{
+		Source: "FS:backup",
+		Archives: map[string]*downloadArchive{
+			"backup/shadow/db/t1.tar.gz": {Size: info.Size(), LastModified: info.ModTime(), Extracted: true, MetaFile: &MetaFile{}},
+		},
+		localPath: localPath,
+	}
+	require.NoError(t, state.write())
+	require.NoError(t, Download(*config, "backup", "", true))
+	_, err = os.Stat(filepath.Join(localPath, "shadow", "db", "t1"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(localPath, "shadow", "db", "t2", "2020_1_1_0", "data.bin"))
+	assert.NoError(t, err)
+
+	// download with other table pattern starts over
+	require.NoError(t, state.write())
+	require.NoError(t, Download(*config, "backup", "db.t1", true))
+	_, err = os.Stat(filepath.Join(localPath, "shadow", "db", "t1", "all_1_1_0", "data.bin"))
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(localPath, "shadow", "db", "t2"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDiscardDownload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clickhouse-backup-resume")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	localPath := filepath.Join(dir, "backup")
+	require.NoError(t, os.MkdirAll(localPath, os.ModePerm))
+
+	// completely downloaded backup is not removed
+	require.NoError(t, DiscardDownload(localPath))
+	_, err = os.Stat(localPath)
+	assert.NoError(t, err)
+
+	state := &downloadState{Source: "FS:backup", Archives: map[string]*downloadArchive{}, localPath: localPath}
+	require.NoError(t, state.write())
+	require.NoError(t, ioutil.WriteFile(downloadSpoolPath(localPath, "backup.tar.gz"), []byte("part"), 0640))
+	require.NoError(t, DiscardDownload(localPath))
+	for _, name := range []string{localPath, localPath + downloadStateSuffix, downloadSpoolPath(localPath, "backup.tar.gz")} {
+		_, err := os.Stat(name)
+		assert.True(t, os.IsNotExist(err), name)
+	}
+}
+
+func TestUploadStateMultipart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clickhouse-backup-resume")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	localPath := filepath.Join(dir, "backup")
+	bd := &BackupDestination{RemoteStorage: &FS{Config: &FSConfig{RootPath: dir}}}
+	creationDate := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	state := &uploadState{Destination: "FS:backup", CreationDate: creationDate, CompressionFormat: "gzip"}
+	bd.resumeUpload(localPath, state)
+	upload := state.multipart("backup/metadata.tar.gz")
+	assert.Empty(t, state.Multipart)
+	require.NoError(t, upload.start("id"))
+	require.NoError(t, upload.addPart(multipartPart{Number: 1, ETag: "etag1", MD5: partChecksum([]byte("part1")), Size: 5}))
+	require.NoError(t, upload.addPart(multipartPart{Number: 1, ETag: "etag2", MD5: partChecksum([]byte("part2")), Size: 5}))
+
+	state = &uploadState{Destination: "FS:backup", CreationDate: creationDate, CompressionFormat: "gzip"}
+	bd.resumeUpload(localPath, state)
+	upload = state.multipart("backup/metadata.tar.gz")
+	assert.Equal(t, "id", upload.id())
+	assert.Equal(t, []multipartPart{{Number: 1, ETag: "etag2", MD5: "d067a0fa9dc61a6e7195ca99696b5a89", Size: 5}}, upload.parts())
+	require.NoError(t, state.uploaded("metadata.tar.gz", "backup/metadata.tar.gz"))
+	saved, err := readUploadState(localPath)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"metadata.tar.gz"}, saved.Archives)
+	assert.Empty(t, saved.Multipart)
+
+	// upload of changed backup starts over
+	state = &uploadState{Destination: "FS:backup", CreationDate: creationDate.Add(time.Hour), CompressionFormat: "gzip"}
+	bd.resumeUpload(localPath, state)
+	assert.Empty(t, state.Archives)
+	require.NoError(t, bd.DiscardUpload(localPath))
+	_, err = os.Stat(localPath + uploadStateSuffix)
+	assert.True(t, os.IsNotExist(err))
+}
+
+// recordingStorage - resumable storage which keeps streams of uploads in memory, every upload is interrupted after it's started
+type recordingStorage struct {
+	*FS
+	uploads [][]byte
+	aborted []string
+}
+
+func (s *recordingStorage) PutFileResumable(key string, r io.ReadCloser, upload *multipartUpload) error {
+	defer r.Close()
+	if upload.id() == "" {
+		if err := upload.start(fmt.Sprintf("upload-%d", len(s.uploads))); err != nil {
+			return err
+		}
+	}
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.uploads = append(s.uploads, content)
+	return fmt.Errorf("interrupted")
+}
+
+func (s *recordingStorage) AbortUpload(key, uploadID string) error {
+	s.aborted = append(s.aborted, uploadID)
+	return nil
+}
+
+func TestUploadResumeEncryptedArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clickhouse-backup-resume")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	backupPath := filepath.Join(dir, "backup")
+	createTestBackup(t, backupPath)
+	encryption, err := newArchiveEncryption(EncryptionConfig{Type: EncryptionAESGCM, Key: testEncryptionKey})
+	require.NoError(t, err)
+	storage := &recordingStorage{FS: &FS{Config: &FSConfig{RootPath: dir}}}
+	bd := &BackupDestination{RemoteStorage: storage, compressionFormat: "gzip", compressionConcurrency: 1, encryption: encryption}
+	creationDate := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	files := []string{"metadata/db/t1.sql", "shadow/db/t1/all_1_1_0/data.bin"}
+
+	upload := func() *uploadState {
+		state := &uploadState{Destination: "FS:backup", CreationDate: creationDate, CompressionFormat: "gzip", Encryption: encryption.info()}
+		bd.resumeUpload(backupPath, state)
+		assert.EqualError(t, bd.putArchive("backup.tar.gz", backupPath, files, nil, state.multipart("backup.tar.gz"), StartNewByteBar(false, 0), nil), "interrupted")
+		return state
+	}
+	upload()
+	// resumed upload of encrypted archive is started over with new nonce prefix, interrupted upload is aborted
+	state := upload()
+	require.Len(t, storage.uploads, 2)
+	assert.Equal(t, []string{"upload-0"}, storage.aborted)
+	assert.Equal(t, "upload-1", state.multipart("backup.tar.gz").id())
+	header := encryptedMagicSize + aesGCMKeyIDSize + aesGCMPrefixSize
+	assert.False(t, bytes.Equal(storage.uploads[0][:header], storage.uploads[1][:header]))
+	for _, content := range storage.uploads {
+		decrypted, err := decryptForTest(encryption, content)
+		require.NoError(t, err)
+		assert.NotEmpty(t, decrypted)
+	}
+}
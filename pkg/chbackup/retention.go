@@ -0,0 +1,321 @@
+package chbackup
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// RetentionPolicy - time-bucketed retention of local or remote backups, backup is kept when any count rule keeps it
+// hourly, daily, weekly, monthly and yearly keep the newest backup of each of the last N hours, days, ISO weeks, months and years which have backups
+// kept backups older than max_age or beyond max_size of total size are deleted, the newest backup is never deleted
+type RetentionPolicy struct {
+	Hourly  int    `yaml:"hourly"`
+	Daily   int    `yaml:"daily"`
+	Weekly  int    `yaml:"weekly"`
+	Monthly int    `yaml:"monthly"`
+	Yearly  int    `yaml:"yearly"`
+	MaxAge  string `yaml:"max_age" split_words:"true"`
+	MaxSize int64  `yaml:"max_size" split_words:"true"`
+}
+
+// RetentionConfig - retention section, environment variables are named RETENTION_LOCAL_<OPTION> and RETENTION_REMOTE_<OPTION>
+type RetentionConfig struct {
+	Local  RetentionPolicy `yaml:"local"`
+	Remote RetentionPolicy `yaml:"remote"`
+}
+
+func (p RetentionPolicy) validate(location string) error {
+	for _, count := range []int{p.Hourly, p.Daily, p.Weekly, p.Monthly, p.Yearly} {
+		if count < 0 {
+			return fmt.Errorf("retention %s counts can't be negative", location)
+		}
+	}
+	if p.MaxSize < 0 {
+		return fmt.Errorf("retention %s max_size can't be negative", location)
+	}
+	if p.MaxAge != "" {
+		maxAge, err := time.ParseDuration(p.MaxAge)
+		if err != nil {
+			return fmt.Errorf("can't parse retention %s max_age with %v", location, err)
+		}
+		if maxAge < 0 {
+			return fmt.Errorf("retention %s max_age can't be negative", location)
+		}
+	}
+	return nil
+}
+
+func (p RetentionPolicy) maxAge() time.Duration {
+	maxAge, _ := time.ParseDuration(p.MaxAge)
+	return maxAge
+}
+
+// enabled - false when neither keepLast nor any option of policy is set, so backups are never deleted
+func (p RetentionPolicy) enabled(keepLast int) bool {
+	return keepLast > 0 || p.Hourly > 0 || p.Daily > 0 || p.Weekly > 0 || p.Monthly > 0 || p.Yearly > 0 || p.maxAge() > 0 || p.MaxSize > 0
+}
+
+// RetentionDecision - what retention does with backup and why
+type RetentionDecision struct {
+	Backup     Backup `json:"backup"`
+	Delete     bool   `json:"delete"`
+	Reason     string `json:"reason"`
+	RequiredBy string `json:"required_by,omitempty"`
+}
+
+// retentionRule - count rule which keeps the newest backup of each of the last count buckets
+type retentionRule struct {
+	name   string
+	count  int
+	bucket func(t time.Time) string
+}
+
+func (p RetentionPolicy) rules() []retentionRule {
+	return []retentionRule{
+		{"hourly", p.Hourly, func(t time.Time) string { return t.Format("2006-01-02 15") }},
+		{"daily", p.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", p.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%d", year, week)
+		}},
+		{"monthly", p.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{"yearly", p.Yearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+}
+
+// planRetention - decide which backups are deleted by keepLast newest backups and policy, result is sorted from newest to oldest
+// buckets are calculated in UTC, when no count rule is set all backups are limited by max_age and max_size only
+// base backups required by kept backups directly or through other increments are kept regardless of policy
+func planRetention(backups []Backup, keepLast int, policy RetentionPolicy, now time.Time) []RetentionDecision {
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].Date.After(backups[j].Date)
+	})
+	decisions := make([]RetentionDecision, len(backups))
+	countRules := keepLast > 0
+	for i, backup := range backups {
+		decisions[i].Backup = backup
+		if i < keepLast {
+			decisions[i].Reason = fmt.Sprintf("last %d", keepLast)
+		}
+	}
+	for _, rule := range policy.rules() {
+		if rule.count < 1 {
+			continue
+		}
+		countRules = true
+		lastBucket := ""
+		buckets := 0
+		for i, backup := range backups {
+			bucket := rule.bucket(backup.Date.UTC())
+			if bucket == lastBucket {
+				continue
+			}
+			if buckets == rule.count {
+				break
+			}
+			lastBucket = bucket
+			buckets++
+			if decisions[i].Reason == "" {
+				decisions[i].Reason = rule.name
+			}
+		}
+	}
+	for i := range decisions {
+		if decisions[i].Reason == "" {
+			decisions[i].Delete = true
+			decisions[i].Reason = "not kept by retention rules"
+			if !countRules {
+				decisions[i].Delete = false
+				decisions[i].Reason = "within limits"
+			}
+		}
+	}
+	if maxAge := policy.maxAge(); maxAge > 0 {
+		for i := 1; i < len(decisions); i++ {
+			if !decisions[i].Delete && now.Sub(backups[i].Date) > maxAge {
+				decisions[i].Delete = true
+				decisions[i].Reason = fmt.Sprintf("older than max_age %s", policy.MaxAge)
+			}
+		}
+	}
+	if policy.MaxSize > 0 {
+		var totalSize int64
+		for i := range decisions {
+			if decisions[i].Delete {
+				continue
+			}
+			totalSize += backups[i].Size
+			if i > 0 && totalSize > policy.MaxSize {
+				decisions[i].Delete = true
+				decisions[i].Reason = fmt.Sprintf("total size exceeds max_size %s", FormatBytes(policy.MaxSize))
+			}
+		}
+	}
+	byName := map[string]int{}
+	for i, backup := range backups {
+		byName[backup.Name] = i
+	}
+	for i := range decisions {
+		if decisions[i].Delete {
+			continue
+		}
+		for current := i; ; {
+			required, ok := byName[backups[current].RequiredBackup]
+			if !ok || !decisions[required].Delete {
+				break
+			}
+			decisions[required].Delete = false
+			decisions[required].Reason = fmt.Sprintf("required by '%s'", backups[current].Name)
+			decisions[required].RequiredBy = backups[current].Name
+			current = required
+		}
+	}
+	// base of kept backup is unknown, so all older backups are kept
+	for i := range decisions {
+		if decisions[i].Delete || !backups[i].unknownRequired {
+			continue
+		}
+		for j := i + 1; j < len(decisions); j++ {
+			if decisions[j].Delete {
+				decisions[j].Delete = false
+				decisions[j].Reason = fmt.Sprintf("base of '%s' is unknown", backups[i].Name)
+				decisions[j].RequiredBy = backups[i].Name
+			}
+		}
+	}
+	return decisions
+}
+
+// applyRetention - delete backups according to decisions, kept base backups are reported
+func applyRetention(decisions []RetentionDecision, remove func(backup Backup) error) error {
+	for _, decision := range decisions {
+		if decision.RequiredBy != "" {
+			log.Printf("Keep '%s' required by '%s'", decision.Backup.Name, decision.RequiredBy)
+		}
+	}
+	for _, decision := range decisions {
+		if !decision.Delete {
+			continue
+		}
+		log.Printf("Remove old backup '%s', %s", decision.Backup.Name, decision.Reason)
+		if err := remove(decision.Backup); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeLocalBackupPath - remove local backup with its upload and download progress
+func removeLocalBackupPath(backupPath string) error {
+	if err := os.RemoveAll(backupPath); err != nil {
+		return err
+	}
+	if err := removeUploadState(backupPath); err != nil {
+		return err
+	}
+	return removeDownloadState(backupPath)
+}
+
+// Prune - apply retention to 'local', 'remote' or 'all' backups and print decisions, nothing is deleted when dryRun is true
+func Prune(config Config, location string, dryRun bool, outputFormat string, w io.Writer) error {
+	if err := ValidateOutputFormat(outputFormat); err != nil {
+		return err
+	}
+	if location == "" {
+		location = "all"
+	}
+	if location != "local" && location != "remote" && location != "all" {
+		return fmt.Errorf("unknown location '%s', use 'local', 'remote' or 'all'", location)
+	}
+	result := []RetentionDecision{}
+	if location == "local" || location == "all" {
+		if !config.Retention.Local.enabled(config.General.BackupsToKeepLocal) {
+			log.Println("Retention of local backups is disabled")
+		}
+		decisions, err := pruneLocal(config, dryRun)
+		if err != nil {
+			return err
+		}
+		result = append(result, decisions...)
+	}
+	if location == "remote" || location == "all" {
+		if !config.Retention.Remote.enabled(config.General.BackupsToKeepRemote) {
+			log.Println("Retention of remote backups is disabled")
+		}
+		decisions, err := pruneRemote(config, dryRun)
+		if err != nil {
+			return err
+		}
+		result = append(result, decisions...)
+	}
+	if outputFormat == OutputFormatJSON {
+		return printJSON(w, result)
+	}
+	for _, decision := range result {
+		action := "keep"
+		if decision.Delete {
+			action = "delete"
+		}
+		fmt.Fprintf(w, "%s\t%s\t'%s'\t%s\t(created at %s)\n", decision.Backup.Location, action, decision.Backup.Name, decision.Reason, decision.Backup.Date.Format("02-01-2006 15:04:05"))
+	}
+	if dryRun {
+		fmt.Fprintln(w, "dry run, nothing is deleted")
+	}
+	return nil
+}
+
+// pruneLocal - apply retention to local backups, nothing is deleted when retention is disabled or dryRun is true
+func pruneLocal(config Config, dryRun bool) ([]RetentionDecision, error) {
+	if !config.Retention.Local.enabled(config.General.BackupsToKeepLocal) {
+		return nil, nil
+	}
+	dataPath := getDataPath(config)
+	if dataPath == "" {
+		return nil, ErrUnknownClickhouseDataPath
+	}
+	backupList, err := ListLocalBackups(config)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	decisions := planRetention(backupList, config.General.BackupsToKeepLocal, config.Retention.Local, time.Now())
+	if dryRun {
+		return decisions, nil
+	}
+	return decisions, applyRetention(decisions, func(backup Backup) error {
+		return removeLocalBackupPath(path.Join(dataPath, "backup", backup.Name))
+	})
+}
+
+// pruneBackups - apply retention to remote backups, nothing is deleted when retention is disabled or dryRun is true
+func (bd *BackupDestination) pruneBackups(keep int, policy RetentionPolicy, dryRun bool) ([]RetentionDecision, error) {
+	if !policy.enabled(keep) {
+		return nil, nil
+	}
+	backupList, err := bd.BackupList()
+	if err != nil {
+		return nil, err
+	}
+	decisions := planRetention(backupList, keep, policy, time.Now())
+	if dryRun {
+		return decisions, nil
+	}
+	return decisions, applyRetention(decisions, func(backup Backup) error {
+		return bd.RemoveBackup(backup.Name)
+	})
+}
+
+func pruneRemote(config Config, dryRun bool) ([]RetentionDecision, error) {
+	bd, err := NewBackupDestination(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := bd.Connect(); err != nil {
+		return nil, err
+	}
+	return bd.pruneBackups(config.General.BackupsToKeepRemote, config.Retention.Remote, dryRun)
+}
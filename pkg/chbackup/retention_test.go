@@ -0,0 +1,240 @@
+package chbackup
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func retentionActions(decisions []RetentionDecision) map[string]string {
+	result := map[string]string{}
+	for _, decision := range decisions {
+		action := "keep: "
+		if decision.Delete {
+			action = "delete: "
+		}
+		result[decision.Backup.Name] = action + decision.Reason
+	}
+	return result
+}
+
+// deletedBackups - names of deleted backups from newest to oldest and names of backups which keep required base backups
+func deletedBackups(decisions []RetentionDecision) ([]string, map[string]string) {
+	deleted := []string{}
+	requiredBy := map[string]string{}
+	for _, decision := range decisions {
+		if decision.Delete {
+			deleted = append(deleted, decision.Backup.Name)
+		}
+		if decision.RequiredBy != "" {
+			requiredBy[decision.Backup.Name] = decision.RequiredBy
+		}
+	}
+	return deleted, requiredBy
+}
+
+func TestPlanRetentionKeepLast(t *testing.T) {
+	backups := []Backup{
+		{Name: "three", Date: timeParse("2019-03-28T19-50-12")},
+		{Name: "one", Date: timeParse("2019-01-28T19-50-12")},
+		{Name: "five", Date: timeParse("2019-05-28T19-50-12")},
+		{Name: "two", Date: timeParse("2019-02-28T19-50-12")},
+		{Name: "four", Date: timeParse("2019-04-28T19-50-12")},
+	}
+	now := timeParse("2019-06-28T19-50-12")
+	deleted, requiredBy := deletedBackups(planRetention(backups, 3, RetentionPolicy{}, now))
+	assert.Equal(t, []string{"two", "one"}, deleted)
+	assert.Empty(t, requiredBy)
+	deleted, _ = deletedBackups(planRetention([]Backup{backups[0]}, 3, RetentionPolicy{}, now))
+	assert.Empty(t, deleted)
+}
+
+func TestPlanRetentionRequired(t *testing.T) {
+	backups := []Backup{
+		{Name: "full1", Date: timeParse("2019-01-28T19-50-12")},
+		{Name: "diff1", Date: timeParse("2019-02-28T19-50-12"), RequiredBackup: "full1"},
+		{Name: "full2", Date: timeParse("2019-03-28T19-50-12")},
+		{Name: "diff2", Date: timeParse("2019-04-28T19-50-12"), RequiredBackup: "full2"},
+		{Name: "diff3", Date: timeParse("2019-05-28T19-50-12"), RequiredBackup: "diff2"},
+		{Name: "diff4", Date: timeParse("2019-06-28T19-50-12"), RequiredBackup: "missing"},
+	}
+	now := timeParse("2019-07-28T19-50-12")
+	deleted, requiredBy := deletedBackups(planRetention(backups, 2, RetentionPolicy{}, now))
+	assert.Equal(t, []string{"diff1", "full1"}, deleted)
+	assert.Equal(t, map[string]string{"diff2": "diff3", "full2": "diff2"}, requiredBy)
+
+	deleted, requiredBy = deletedBackups(planRetention(backups, 3, RetentionPolicy{}, now))
+	assert.Equal(t, []string{"diff1", "full1"}, deleted)
+	assert.Equal(t, map[string]string{"full2": "diff2"}, requiredBy)
+
+	deleted, requiredBy = deletedBackups(planRetention(backups, 1, RetentionPolicy{}, now))
+	assert.Equal(t, []string{"diff3", "diff2", "full2", "diff1", "full1"}, deleted)
+	assert.Empty(t, requiredBy)
+}
+
+func TestPlanRetention(t *testing.T) {
+	now := time.Date(2020, 6, 15, 12, 30, 0, 0, time.UTC)
+	backups := []Backup{
+		{Name: "h0", Date: now.Add(-10 * time.Minute), Size: 10},
+		{Name: "h0-old", Date: now.Add(-20 * time.Minute), Size: 10},
+		{Name: "h1", Date: now.Add(-time.Hour), Size: 10},
+		{Name: "d1", Date: now.Add(-24 * time.Hour), Size: 10},
+		{Name: "d2", Date: now.Add(-48 * time.Hour), Size: 10},
+		{Name: "m1", Date: now.AddDate(0, -1, 0), Size: 10},
+		{Name: "y1", Date: now.AddDate(-1, 0, 0), Size: 10},
+	}
+
+	decisions := planRetention(backups, 0, RetentionPolicy{Hourly: 2, Daily: 2, Monthly: 2, Yearly: 2}, now)
+	assert.Equal(t, "h0", decisions[0].Backup.Name)
+	assert.Equal(t, map[string]string{
+		"h0":     "keep: hourly",
+		"h0-old": "delete: not kept by retention rules",
+		"h1":     "keep: hourly",
+		"d1":     "keep: daily",
+		"d2":     "delete: not kept by retention rules",
+		"m1":     "keep: monthly",
+		"y1":     "keep: yearly",
+	}, retentionActions(decisions))
+
+	decisions = planRetention(backups, 1, RetentionPolicy{Daily: 3, MaxAge: "30h"}, now)
+	assert.Equal(t, map[string]string{
+		"h0":     "keep: last 1",
+		"h0-old": "delete: not kept by retention rules",
+		"h1":     "delete: not kept by retention rules",
+		"d1":     "keep: daily",
+		"d2":     "delete: older than max_age 30h",
+		"m1":     "delete: not kept by retention rules",
+		"y1":     "delete: not kept by retention rules",
+	}, retentionActions(decisions))
+
+	// without count rules all backups are limited by max_size only, the newest one is never deleted
+	decisions = planRetention(backups, 0, RetentionPolicy{MaxSize: 25}, now)
+	assert.Equal(t, map[string]string{
+		"h0":     "keep: within limits",
+		"h0-old": "keep: within limits",
+		"h1":     "delete: total size exceeds max_size 25 B",
+		"d1":     "delete: total size exceeds max_size 25 B",
+		"d2":     "delete: total size exceeds max_size 25 B",
+		"m1":     "delete: total size exceeds max_size 25 B",
+		"y1":     "delete: total size exceeds max_size 25 B",
+	}, retentionActions(decisions))
+	decisions = planRetention(backups, 0, RetentionPolicy{MaxAge: "1m"}, now)
+	assert.False(t, decisions[0].Delete)
+
+	backups[0].RequiredBackup = "d2"
+	backups[4].RequiredBackup = "y1"
+	decisions = planRetention(backups, 1, RetentionPolicy{}, now)
+	actions := retentionActions(decisions)
+	assert.Equal(t, "keep: required by 'h0'", actions["d2"])
+	assert.Equal(t, "keep: required by 'd2'", actions["y1"])
+	assert.Equal(t, "delete: not kept by retention rules", actions["m1"])
+
+	// base of archive uploaded by old version isn't read yet
+	backups[0].RequiredBackup = ""
+	backups[2].unknownRequired = true
+	decisions = planRetention(backups, 1, RetentionPolicy{}, now)
+	actions = retentionActions(decisions)
+	assert.Equal(t, "delete: not kept by retention rules", actions["h0-old"])
+	assert.Equal(t, "delete: not kept by retention rules", actions["h1"])
+	backups[2].unknownRequired = false
+	backups[0].unknownRequired = true
+	decisions = planRetention(backups, 1, RetentionPolicy{}, now)
+	actions = retentionActions(decisions)
+	assert.Equal(t, "keep: base of 'h0' is unknown", actions["h1"])
+	assert.Equal(t, "keep: base of 'h0' is unknown", actions["y1"])
+}
+
+func TestPruneRemoteKeepsBackupsOlderThanOldArchives(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clickhouse-backup-prune")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "remote")
+	require.NoError(t, os.MkdirAll(root, os.ModePerm))
+	config := DefaultConfig()
+	config.General.RemoteStorage = "fs"
+	config.General.DisableProgressBar = true
+	config.FS.RootPath = root
+	bd, err := NewBackupDestination(*config)
+	require.NoError(t, err)
+	require.NoError(t, bd.Connect())
+
+	// archives without manifest as uploaded by old versions, base of 'inc' is known only from its meta file
+	date := time.Now().Add(-time.Hour)
+	for i, name := range []string{"base", "full", "inc"} {
+		backupPath := filepath.Join(dir, "local", name)
+		createTestBackup(t, backupPath)
+		require.NoError(t, os.Remove(filepath.Join(backupPath, ManifestFileName)))
+		require.NoError(t, bd.CompressedStreamUpload(backupPath, name, ""))
+		modTime := date.Add(time.Duration(i) * time.Minute)
+		require.NoError(t, os.Chtimes(filepath.Join(root, name+".tar.gz"), modTime, modTime))
+	}
+
+	// archives are not read by retention, so nothing older than kept 'inc' is deleted
+	decisions, err := bd.pruneBackups(1, RetentionPolicy{}, false)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"inc":  "keep: last 1",
+		"full": "keep: base of 'inc' is unknown",
+		"base": "keep: base of 'inc' is unknown",
+	}, retentionActions(decisions))
+	backups, err := bd.BackupList()
+	require.NoError(t, err)
+	assert.Len(t, backups, 3)
+}
+
+func TestRetentionConfig(t *testing.T) {
+	config := DefaultConfig()
+	os.Setenv("RETENTION_LOCAL_DAILY", "7")
+	os.Setenv("RETENTION_REMOTE_MAX_AGE", "720h")
+	defer os.Unsetenv("RETENTION_LOCAL_DAILY")
+	defer os.Unsetenv("RETENTION_REMOTE_MAX_AGE")
+	require.NoError(t, envconfig.Process("", config))
+	assert.Equal(t, 7, config.Retention.Local.Daily)
+	assert.Equal(t, "720h", config.Retention.Remote.MaxAge)
+	assert.NoError(t, validateConfig(config))
+	assert.True(t, config.Retention.Local.enabled(0))
+	assert.False(t, RetentionPolicy{}.enabled(0))
+
+	config.Retention.Remote.MaxAge = "30d"
+	assert.Error(t, validateConfig(config))
+	config.Retention.Remote.MaxAge = ""
+	config.Retention.Local.Weekly = -1
+	assert.EqualError(t, validateConfig(config), "retention local counts can't be negative")
+}
+
+func TestPruneLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clickhouse-backup-prune")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config := DefaultConfig()
+	config.ClickHouse.DataPath = dir
+	config.General.BackupsToKeepLocal = 1
+	date := time.Now().Add(-time.Hour)
+	for i, name := range []string{"old", "new"} {
+		backupPath := filepath.Join(dir, "backup", name)
+		require.NoError(t, os.MkdirAll(filepath.Join(backupPath, "shadow"), os.ModePerm))
+		require.NoError(t, os.Chtimes(backupPath, date.Add(time.Duration(i)*time.Minute), date.Add(time.Duration(i)*time.Minute)))
+	}
+
+	out := &bytes.Buffer{}
+	require.NoError(t, Prune(*config, "local", true, OutputFormatText, out))
+	assert.Contains(t, out.String(), "local\tdelete\t'old'\tnot kept by retention rules")
+	assert.Contains(t, out.String(), "local\tkeep\t'new'\tlast 1")
+	assert.Contains(t, out.String(), "dry run, nothing is deleted")
+	_, err = os.Stat(filepath.Join(dir, "backup", "old"))
+	assert.NoError(t, err)
+
+	require.NoError(t, RemoveOldBackupsLocal(*config))
+	_, err = os.Stat(filepath.Join(dir, "backup", "old"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "backup", "new"))
+	assert.NoError(t, err)
+	assert.EqualError(t, Prune(*config, "unknown", true, OutputFormatText, out), "unknown location 'unknown', use 'local', 'remote' or 'all'")
+}
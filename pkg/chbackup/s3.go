@@ -1,9 +1,13 @@
 package chbackup
 
 import (
+	"bytes"
 	"crypto/tls"
+	"fmt"
 	"io"
 	"net/http"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -78,6 +82,20 @@ func (s *S3) GetFileReader(key string) (io.ReadCloser, error) {
 	return resp.Body, nil
 }
 
+// GetFileReaderWithOffset - read object starting from offset with ranged GET
+func (s *S3) GetFileReaderWithOffset(key string, offset int64) (io.ReadCloser, error) {
+	svc := s3.New(s.session)
+	req, resp := svc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(s.Config.Bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-", offset)),
+	})
+	if err := req.Send(); err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
 func (s *S3) PutFile(key string, r io.ReadCloser) error {
 	uploader := s3manager.NewUploader(s.session)
 	uploader.Concurrency = 10
@@ -96,6 +114,148 @@ func (s *S3) PutFile(key string, r io.ReadCloser) error {
 	return err
 }
 
+// PutFileResumable - upload stream by parts of part_size, every uploaded part is recorded to upload
+// parts uploaded by previous attempt are not uploaded again when checksum of the same part of stream is not changed
+func (s *S3) PutFileResumable(key string, r io.ReadCloser, upload *multipartUpload) error {
+	defer r.Close()
+	svc := s3.New(s.session)
+	uploaded := map[int64]multipartPart{}
+	if uploadID := upload.id(); uploadID != "" {
+		remoteParts := map[int64]string{}
+		err := svc.ListPartsPages(&s3.ListPartsInput{
+			Bucket:   aws.String(s.Config.Bucket),
+			Key:      aws.String(key),
+			UploadId: aws.String(uploadID),
+		}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+			for _, part := range page.Parts {
+				remoteParts[*part.PartNumber] = *part.ETag
+			}
+			return true
+		})
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != s3.ErrCodeNoSuchUpload {
+				return err
+			}
+			if err := upload.start(""); err != nil {
+				return err
+			}
+		}
+		for _, part := range upload.parts() {
+			if remoteParts[part.Number] == part.ETag {
+				uploaded[part.Number] = part
+			}
+		}
+	}
+	if upload.id() == "" {
+		var sse *string
+		if s.Config.SSE != "" {
+			sse = aws.String(s.Config.SSE)
+		}
+		output, err := svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+			ACL:                  aws.String(s.Config.ACL),
+			Bucket:               aws.String(s.Config.Bucket),
+			Key:                  aws.String(key),
+			ServerSideEncryption: sse,
+		})
+		if err != nil {
+			return err
+		}
+		if err := upload.start(*output.UploadId); err != nil {
+			return err
+		}
+	}
+	uploadID := upload.id()
+	partSize := s.Config.PartSize
+	if partSize < s3manager.MinUploadPartSize {
+		partSize = s3manager.MinUploadPartSize
+	}
+
+	var mu sync.Mutex
+	var uploadErr error
+	completed := []*s3.CompletedPart{}
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, 10)
+	for number := int64(1); ; number++ {
+		workers <- struct{}{}
+		data := make([]byte, partSize)
+		n, err := io.ReadFull(r, data)
+		if err == io.EOF && number > 1 {
+			<-workers
+			break
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			<-workers
+			mu.Lock()
+			uploadErr = err
+			mu.Unlock()
+			break
+		}
+		last := err != nil
+		data = data[:n]
+		checksum := partChecksum(data)
+		if part, ok := uploaded[number]; ok && part.MD5 == checksum && part.Size == int64(n) {
+			<-workers
+			mu.Lock()
+			completed = append(completed, &s3.CompletedPart{PartNumber: aws.Int64(number), ETag: aws.String(part.ETag)})
+			mu.Unlock()
+		} else {
+			wg.Add(1)
+			go func(number int64, data []byte, checksum string) {
+				defer func() { <-workers }()
+				defer wg.Done()
+				output, err := svc.UploadPart(&s3.UploadPartInput{
+					Bucket:     aws.String(s.Config.Bucket),
+					Key:        aws.String(key),
+					UploadId:   aws.String(uploadID),
+					PartNumber: aws.Int64(number),
+					Body:       bytes.NewReader(data),
+				})
+				if err == nil {
+					err = upload.addPart(multipartPart{Number: number, ETag: *output.ETag, MD5: checksum, Size: int64(len(data))})
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					if uploadErr == nil {
+						uploadErr = err
+					}
+					return
+				}
+				completed = append(completed, &s3.CompletedPart{PartNumber: aws.Int64(number), ETag: output.ETag})
+			}(number, data, checksum)
+		}
+		mu.Lock()
+		failed := uploadErr != nil
+		mu.Unlock()
+		if last || failed {
+			break
+		}
+	}
+	wg.Wait()
+	// multipart upload is kept in state for the next attempt
+	if uploadErr != nil {
+		return uploadErr
+	}
+	sort.Slice(completed, func(i, j int) bool { return *completed[i].PartNumber < *completed[j].PartNumber })
+	_, err := svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.Config.Bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	return err
+}
+
+// AbortUpload - abort multipart upload, uploaded parts are removed
+func (s *S3) AbortUpload(key, uploadID string) error {
+	_, err := s3.New(s.session).AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.Config.Bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	return err
+}
+
 func (s *S3) DeleteFile(key string) error {
 	params := &s3.DeleteObjectInput{
 		Bucket: aws.String(s.Config.Bucket),
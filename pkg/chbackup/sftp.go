@@ -0,0 +1,171 @@
+package chbackup
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTP - presents methods for manipulate data on SSH server
+type SFTP struct {
+	client *sftp.Client
+	Config *SFTPConfig
+}
+
+// Connect - connect to SSH server, host key is verified with known_hosts file
+func (s *SFTP) Connect() error {
+	timeout, err := time.ParseDuration(s.Config.Timeout)
+	if err != nil {
+		return err
+	}
+	knownHostsPath := s.Config.KnownHosts
+	if knownHostsPath == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return fmt.Errorf("can't find known_hosts with %v", err)
+		}
+		knownHostsPath = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		return fmt.Errorf("can't read known_hosts with %v", err)
+	}
+	auth := []ssh.AuthMethod{}
+	if s.Config.Key != "" {
+		key, err := ioutil.ReadFile(s.Config.Key)
+		if err != nil {
+			return fmt.Errorf("can't read sftp key with %v", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return fmt.Errorf("can't parse sftp key with %v", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if s.Config.Password != "" {
+		auth = append(auth, ssh.Password(s.Config.Password))
+	}
+	conn, err := ssh.Dial("tcp", net.JoinHostPort(s.Config.Address, strconv.Itoa(int(s.Config.Port))), &ssh.ClientConfig{
+		User:            s.Config.Username,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         timeout,
+	})
+	if err != nil {
+		return err
+	}
+	s.client, err = sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	return nil
+}
+
+func (s *SFTP) Kind() string {
+	return "SFTP"
+}
+
+func (s *SFTP) GetFile(key string) (RemoteFile, error) {
+	info, err := s.client.Stat(key)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, ErrNotFound
+	}
+	return &sftpFile{info: info, name: key}, nil
+}
+
+// DeleteFile - remove file and parent directories up to the configured path which became empty
+func (s *SFTP) DeleteFile(key string) error {
+	if err := s.client.Remove(key); err != nil {
+		return err
+	}
+	root := path.Clean(s.Config.Path)
+	for dir := path.Dir(key); dir != root && dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if err := s.client.RemoveDirectory(dir); err != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *SFTP) Walk(sftpPath string, process func(RemoteFile)) error {
+	walker := s.client.Walk(sftpPath)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			if os.IsNotExist(err) && walker.Path() == sftpPath {
+				return nil
+			}
+			return err
+		}
+		if walker.Stat().Mode().IsRegular() {
+			process(&sftpFile{info: walker.Stat(), name: walker.Path()})
+		}
+	}
+	return nil
+}
+
+func (s *SFTP) GetFileReader(key string) (io.ReadCloser, error) {
+	return s.client.Open(key)
+}
+
+// GetFileReaderWithOffset - open remote file and seek to offset
+func (s *SFTP) GetFileReaderWithOffset(key string, offset int64) (io.ReadCloser, error) {
+	file, err := s.client.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (s *SFTP) PutFile(key string, r io.ReadCloser) error {
+	defer r.Close()
+	if err := s.client.MkdirAll(path.Dir(key)); err != nil {
+		return err
+	}
+	f, err := s.client.Create(key)
+	if err != nil {
+		return err
+	}
+	if _, err := f.ReadFrom(r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+type sftpFile struct {
+	info os.FileInfo
+	name string
+}
+
+func (f *sftpFile) Size() int64 {
+	return f.info.Size()
+}
+
+func (f *sftpFile) Name() string {
+	return f.name
+}
+
+func (f *sftpFile) LastModified() time.Time {
+	return f.info.ModTime()
+}
@@ -0,0 +1,80 @@
+package chbackup
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestSFTP - SFTP remote storage connected to in-memory server through pipe
+func newTestSFTP(t *testing.T, sftpPath string) (*SFTP, func()) {
+	serverConn, clientConn := net.Pipe()
+	server := sftp.NewRequestServer(serverConn, sftp.InMemHandler())
+	go server.Serve()
+	client, err := sftp.NewClientPipe(clientConn, clientConn)
+	require.NoError(t, err)
+	return &SFTP{client: client, Config: &SFTPConfig{Path: sftpPath}}, func() {
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestSFTPRemoteStorage(t *testing.T) {
+	s, closeSFTP := newTestSFTP(t, "backups")
+	defer closeSFTP()
+
+	require.NoError(t, s.PutFile("backups/test/shadow/file.txt", ioutil.NopCloser(strings.NewReader("content"))))
+	file, err := s.GetFile("backups/test/shadow/file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), file.Size())
+	_, err = s.GetFile("backups/test")
+	assert.Equal(t, ErrNotFound, err)
+	_, err = s.GetFile("backups/missing.txt")
+	assert.Equal(t, ErrNotFound, err)
+
+	reader, err := s.GetFileReaderWithOffset("backups/test/shadow/file.txt", 3)
+	require.NoError(t, err)
+	content, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	reader.Close()
+	assert.Equal(t, "tent", string(content))
+
+	names := []string{}
+	require.NoError(t, s.Walk("backups", func(f RemoteFile) {
+		names = append(names, f.Name())
+	}))
+	assert.Equal(t, []string{"backups/test/shadow/file.txt"}, names)
+	assert.NoError(t, s.Walk("missing", func(f RemoteFile) {
+		t.Errorf("unexpected file '%s'", f.Name())
+	}))
+
+	// empty parent directories are removed up to the configured path
+	require.NoError(t, s.DeleteFile("backups/test/shadow/file.txt"))
+	_, err = s.client.Stat("backups/test")
+	assert.Error(t, err)
+	_, err = s.client.Stat("backups")
+	assert.NoError(t, err)
+}
+
+func TestSFTPDefaultPath(t *testing.T) {
+	config := DefaultConfig()
+	config.General.RemoteStorage = "sftp"
+	assert.Equal(t, ".", config.SFTP.Path)
+	assert.NoError(t, validateConfig(config))
+	config.SFTP.Path = ""
+	assert.EqualError(t, validateConfig(config), "sftp path must be set for 'sftp' remote_storage, use '.' for home directory of the user")
+
+	s, closeSFTP := newTestSFTP(t, ".")
+	defer closeSFTP()
+	require.NoError(t, s.PutFile("backup.tar.gz", ioutil.NopCloser(strings.NewReader("archive"))))
+	bd := &BackupDestination{RemoteStorage: s, path: "."}
+	backups, err := bd.BackupList()
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+	assert.Equal(t, "backup", backups[0].Name)
+}
@@ -1,6 +1,8 @@
 package chbackup
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -8,18 +10,46 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/mholt/archiver"
 )
 
+const (
+	// OutputFormatText - human readable output of list and tables commands
+	OutputFormatText = "text"
+	// OutputFormatJSON - JSON output of list and tables commands
+	OutputFormatJSON = "json"
+)
+
+// Backup - describe backup stored locally or on remote storage
 type Backup struct {
-	Name string
-	Size int64
-	Date time.Time
+	Name              string    `json:"name"`
+	Location          string    `json:"location"`
+	Size              int64     `json:"size"`
+	Date              time.Time `json:"creation_date"`
+	CompressionFormat string    `json:"compression_format,omitempty"`
+	RequiredBackup    string    `json:"required_backup,omitempty"`
+	Tables            int       `json:"tables,omitempty"`
+	// unknownRequired - base backup isn't known from manifest, archive uploaded by old version keeps it in meta file
+	unknownRequired bool
+}
+
+// ValidateOutputFormat - check that output format is 'text' or 'json'
+func ValidateOutputFormat(outputFormat string) error {
+	if outputFormat != OutputFormatText && outputFormat != OutputFormatJSON {
+		return fmt.Errorf("unknown output format '%s', supported: 'text', 'json'", outputFormat)
+	}
+	return nil
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
 }
 
 func cleanDir(dir string) error {
@@ -62,26 +92,84 @@ func isClickhouseShadow(path string) bool {
 	return true
 }
 
-func moveShadow(shadowPath, backupPath string) error {
-	if err := filepath.Walk(shadowPath, func(filePath string, info os.FileInfo, err error) error {
+// moveShadow - move frozen parts from shadow directory of disk to backup and return their paths 'db/table/part' relative to backup
+// tablePaths maps directory of table relative to disk to 'db/table', it's required for tables of Atomic databases which are
+// frozen to '<increment>/store/<uuid prefix>/<uuid>', parts of disks on other filesystems are copied
+// with not empty shadowName only 'shadow/<shadowName>' is moved and it isn't removed, otherwise the whole shadow is moved and cleaned
+func moveShadow(shadowPath, backupPath string, tablePaths map[string]string, shadowName string) ([]string, error) {
+	parts := []string{}
+	if err := filepath.Walk(filepath.Join(shadowPath, shadowName), func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
 		relativePath := strings.Trim(strings.TrimPrefix(filePath, shadowPath), "/")
-		pathParts := strings.SplitN(relativePath, "/", 3)
-		if len(pathParts) != 3 {
+		pathParts := strings.SplitN(relativePath, "/", 6)
+		if len(pathParts) < 5 {
+			return nil
+		}
+		tablePath, ok := tablePaths[path.Join(pathParts[1:4]...)]
+		if !ok && pathParts[1] == "data" {
+			tablePath, ok = path.Join(pathParts[2:4]...), true
+		}
+		if !ok {
+			if info.IsDir() {
+				log.Printf("'%s' doesn't belong to any known table, skipping", filePath)
+				return filepath.SkipDir
+			}
 			return nil
 		}
-		dstFilePath := filepath.Join(backupPath, pathParts[2])
+		partPath := path.Join(tablePath, pathParts[4])
+		dstFilePath := filepath.Join(backupPath, partPath)
+		if len(pathParts) == 6 {
+			dstFilePath = filepath.Join(dstFilePath, pathParts[5])
+		}
 		if info.IsDir() {
+			if len(pathParts) == 5 {
+				parts = append(parts, partPath)
+			}
 			return os.MkdirAll(dstFilePath, os.ModePerm)
 		}
 		if !info.Mode().IsRegular() {
 			log.Printf("'%s' is not a regular file, skipping", filePath)
 			return nil
 		}
-		return os.Rename(filePath, dstFilePath)
+		if err := os.Rename(filePath, dstFilePath); err != nil {
+			if !isCrossDevice(err) {
+				return err
+			}
+			return copyFile(filePath, dstFilePath)
+		}
+		return nil
 	}); err != nil {
-		return err
+		return nil, err
+	}
+	if shadowName != "" {
+		return parts, nil
+	}
+	if err := cleanDir(shadowPath); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return parts, nil
+}
+
+// isCrossDevice - check that rename or hardlink failed because paths are on different filesystems
+func isCrossDevice(err error) bool {
+	var linkErr *os.LinkError
+	return errors.As(err, &linkErr) && linkErr.Err == syscall.EXDEV
+}
+
+// linkOrCopyFile - create hardlink of file or copy it when it's on other filesystem
+func linkOrCopyFile(srcFile, dstFile string) error {
+	if err := os.Link(srcFile, dstFile); err != nil {
+		if !isCrossDevice(err) {
+			return err
+		}
+		return copyFile(srcFile, dstFile)
 	}
-	return cleanDir(shadowPath)
+	return nil
 }
 
 func copyFile(srcFile string, dstFile string) error {
@@ -102,17 +190,11 @@ func copyFile(srcFile string, dstFile string) error {
 	return err
 }
 
-func GetBackupsToDelete(backups []Backup, keep int) []Backup {
-	if len(backups) > keep {
-		sort.SliceStable(backups, func(i, j int) bool {
-			return backups[i].Date.After(backups[j].Date)
-		})
-		return backups[keep:]
-	}
-	return []Backup{}
-}
+// compressionFormats - supported values of compression_format
+var compressionFormats = []string{"tar", "lz4", "bzip2", "gzip", "sz", "xz", "zstd"}
 
-func getArchiveWriter(format string, level int) (archiver.Writer, error) {
+// getArchiveWriter - concurrency is used only by zstd, 0 means GOMAXPROCS
+func getArchiveWriter(format string, level int, concurrency int) (archiver.Writer, error) {
 	switch format {
 	case "tar":
 		return &archiver.Tar{}, nil
@@ -126,8 +208,10 @@ func getArchiveWriter(format string, level int) (archiver.Writer, error) {
 		return &archiver.TarSz{Tar: archiver.NewTar()}, nil
 	case "xz":
 		return &archiver.TarXz{Tar: archiver.NewTar()}, nil
+	case "zstd":
+		return newTarZstd(level, concurrency), nil
 	}
-	return nil, fmt.Errorf("wrong compression_format, supported: 'lz4', 'bzip2', 'gzip', 'sz', 'xz'")
+	return nil, fmt.Errorf("wrong compression_format, supported: 'tar', 'lz4', 'bzip2', 'gzip', 'sz', 'xz', 'zstd'")
 }
 
 func getExtension(format string) string {
@@ -144,11 +228,23 @@ func getExtension(format string) string {
 		return "tar.sz"
 	case "xz":
 		return "tar.xz"
+	case "zstd":
+		return "tar.zst"
 	}
 	return ""
 }
 
-func getArchiveReader(format string) (archiver.Reader, error) {
+// splitArchiveName - return backup name and compression format of archive name like 'backup.tar.gz'
+func splitArchiveName(archiveName string) (string, string, bool) {
+	for _, format := range compressionFormats {
+		if extension := "." + getExtension(format); strings.HasSuffix(archiveName, extension) {
+			return strings.TrimSuffix(archiveName, extension), format, true
+		}
+	}
+	return "", "", false
+}
+
+func getArchiveReader(format string, concurrency int) (archiver.Reader, error) {
 	switch format {
 	case "tar":
 		return archiver.NewTar(), nil
@@ -162,8 +258,10 @@ func getArchiveReader(format string) (archiver.Reader, error) {
 		return archiver.NewTarSz(), nil
 	case "xz":
 		return archiver.NewTarXz(), nil
+	case "zstd":
+		return newTarZstd(0, concurrency), nil
 	}
-	return nil, fmt.Errorf("wrong compression_format, supported: 'tar', 'lz4', 'bzip2', 'gzip', 'sz', 'xz'")
+	return nil, fmt.Errorf("wrong compression_format, supported: 'tar', 'lz4', 'bzip2', 'gzip', 'sz', 'xz', 'zstd'")
 }
 
 // FormatBytes - Convert bytes to human readable string
@@ -189,10 +287,45 @@ func FormatBytes(i int64) (result string) {
 	return
 }
 
+// ValidateBackupName - check that backup name can be used as a directory and object name
+func ValidateBackupName(backupName string) error {
+	if backupName == "." || backupName == ".." || strings.ContainsAny(backupName, "/\\") {
+		return fmt.Errorf("invalid backup name '%s'", backupName)
+	}
+	return nil
+}
+
+// ValidateTablePattern - check syntax of comma separated list of table patterns
+func ValidateTablePattern(tablePattern string) error {
+	if tablePattern == "" {
+		return nil
+	}
+	for _, pattern := range strings.Split(tablePattern, ",") {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid table pattern '%s' with %v", pattern, err)
+		}
+	}
+	return nil
+}
+
 func TablePathEncode(str string) string {
 	return strings.ReplaceAll(url.PathEscape(str), ".", "%2E")
 }
 
+// escapeForFileName - escape name the same way ClickHouse does for names of files, every byte except [A-Za-z0-9_] becomes '%XX'
+func escapeForFileName(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
 func parseTime(text string) (t time.Time, err error) {
 	timeFormats := []string{
 		"Mon, 02 Jan 2006 15:04:05 GMT",
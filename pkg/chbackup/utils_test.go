@@ -1,11 +1,17 @@
 package chbackup
 
 import (
+	"io/ioutil"
 	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func timeParse(s string) time.Time {
@@ -16,18 +22,116 @@ func timeParse(s string) time.Time {
 	return t
 }
 
-func TestGetBackupsToDelete(t *testing.T) {
+func TestSelectBackups(t *testing.T) {
 	testData := []Backup{
-		{Name: "three", Date: timeParse("2019-03-28T19-50-12")},
 		{Name: "one", Date: timeParse("2019-01-28T19-50-12")},
-		{Name: "five", Date: timeParse("2019-05-28T19-50-12")},
 		{Name: "two", Date: timeParse("2019-02-28T19-50-12")},
-		{Name: "four", Date: timeParse("2019-04-28T19-50-12")},
+		{Name: "three", Date: timeParse("2019-03-28T19-50-12")},
 	}
-	expectedData := []Backup{
-		{Name: "two", Date: timeParse("2019-02-28T19-50-12")},
-		{Name: "one", Date: timeParse("2019-01-28T19-50-12")},
+	latest, err := selectBackups(testData, "latest")
+	assert.NoError(t, err)
+	assert.Equal(t, testData[2:], latest)
+	penult, err := selectBackups(testData, "penult")
+	assert.NoError(t, err)
+	assert.Equal(t, testData[1:2], penult)
+	_, err = selectBackups(testData[:1], "penult")
+	assert.Error(t, err)
+	_, err = selectBackups(testData, "unknown")
+	assert.Error(t, err)
+}
+
+func TestSplitArchiveName(t *testing.T) {
+	name, format, ok := splitArchiveName("2020-01-01T00-00-00.tar.gz")
+	assert.True(t, ok)
+	assert.Equal(t, "2020-01-01T00-00-00", name)
+	assert.Equal(t, "gzip", format)
+	name, format, ok = splitArchiveName("backup.tar")
+	assert.True(t, ok)
+	assert.Equal(t, "backup", name)
+	assert.Equal(t, "tar", format)
+	name, format, ok = splitArchiveName("backup.tar.zst")
+	assert.True(t, ok)
+	assert.Equal(t, "backup", name)
+	assert.Equal(t, "zstd", format)
+	_, _, ok = splitArchiveName("backup")
+	assert.False(t, ok)
+}
+
+func TestMoveShadow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clickhouse-backup-shadow")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	backupShadow := filepath.Join(dir, "backup", "shadow")
+	for _, partPath := range []string{
+		filepath.Join("default", "shadow", "1", "data", "db", "t", "all_1_1_0"),
+		filepath.Join("hot", "shadow", "1", "data", "db", "t", "all_2_2_0"),
+		// table of Atomic database is frozen to its directory in 'store'
+		filepath.Join("hot", "shadow", "1", "store", "f7a", "f7a2c1b0-0000-4000-8000-000000000001", "all_3_3_0"),
+		filepath.Join("hot", "shadow", "1", "store", "abc", "abc00000-0000-4000-8000-000000000002", "all_4_4_0"),
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, partPath), os.ModePerm))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, partPath, "data.bin"), []byte(filepath.Base(partPath)), 0640))
+	}
+	tablePaths := map[string]string{"store/f7a/f7a2c1b0-0000-4000-8000-000000000001": "atomic/t"}
+
+	parts := []string{}
+	for _, disk := range []string{"default", "hot", "missing"} {
+		diskParts, err := moveShadow(filepath.Join(dir, disk, "shadow"), backupShadow, tablePaths, "")
+		require.NoError(t, err)
+		parts = append(parts, diskParts...)
+	}
+	sort.Strings(parts)
+	assert.Equal(t, []string{"atomic/t/all_3_3_0", "db/t/all_1_1_0", "db/t/all_2_2_0"}, parts)
+	for _, part := range []string{"db/t/all_1_1_0", "db/t/all_2_2_0", "atomic/t/all_3_3_0"} {
+		content, err := ioutil.ReadFile(filepath.Join(backupShadow, part, "data.bin"))
+		assert.NoError(t, err)
+		assert.Equal(t, path.Base(part), string(content))
+	}
+	files, err := ioutil.ReadDir(filepath.Join(dir, "hot", "shadow"))
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestMoveNamedShadow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clickhouse-backup-shadow")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	backupShadow := filepath.Join(dir, "backup", "shadow")
+	shadowPath := filepath.Join(dir, "shadow")
+	// ClickHouse escapes name of freeze, default backup name has '-'
+	named := &namedFreeze{name: "2020-03-10T10-00-00", tables: []Table{{Database: "db", Name: "t"}}}
+	assert.Equal(t, "2020%2D03%2D10T10%2D00%2D00", named.shadowName())
+	for _, partPath := range []string{
+		filepath.Join("2020%2D03%2D10T10%2D00%2D00", "data", "db", "t", "all_1_1_0"),
+		// parts frozen by ALTER TABLE ... FREEZE which is not related to backup
+		filepath.Join("1", "data", "db", "t", "all_2_2_0"),
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Join(shadowPath, partPath), os.ModePerm))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(shadowPath, partPath, "data.bin"), []byte(filepath.Base(partPath)), 0640))
 	}
-	assert.Equal(t, expectedData, GetBackupsToDelete(testData, 3))
-	assert.Equal(t, []Backup{}, GetBackupsToDelete([]Backup{testData[0]}, 3))
+
+	parts, err := moveShadow(shadowPath, backupShadow, nil, named.shadowName())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"db/t/all_1_1_0"}, parts)
+	assert.NoError(t, named.checkParts(nil, map[string]string{"db/t/all_1_1_0": DefaultDisk}))
+	_, err = os.Stat(filepath.Join(backupShadow, "db", "t", "all_1_1_0", "data.bin"))
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(backupShadow, "db", "t", "all_2_2_0"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(shadowPath, "1", "data", "db", "t", "all_2_2_0", "data.bin"))
+	assert.NoError(t, err)
+
+	require.NoError(t, (&namedFreeze{name: named.name}).unfreeze(nil, []Disk{{Name: DefaultDisk, Path: dir}}))
+	files, err := ioutil.ReadDir(shadowPath)
+	assert.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "1", files[0].Name())
+	assert.Equal(t, "", (*namedFreeze)(nil).shadowName())
+	assert.Equal(t, "", (*namedFreeze)(nil).freezeName())
+}
+
+func TestEscapeForFileName(t *testing.T) {
+	assert.Equal(t, "my_backup", escapeForFileName("my_backup"))
+	assert.Equal(t, "2020%2D03%2D10T10%2D00%2D00", escapeForFileName("2020-03-10T10-00-00"))
+	assert.Equal(t, "a%2Eb%20c%D1%84", escapeForFileName("a.b cф"))
 }
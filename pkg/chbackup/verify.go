@@ -0,0 +1,400 @@
+package chbackup
+
+import (
+	"archive/tar"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// VerifyResult - result of backup integrity check
+type VerifyResult struct {
+	BackupName string   `json:"backup_name"`
+	Location   string   `json:"location"`
+	Files      int      `json:"files"`
+	Missing    []string `json:"missing"`
+	Extra      []string `json:"extra"`
+	Corrupt    []string `json:"corrupt"`
+}
+
+// OK - true if backup has no problems
+func (r *VerifyResult) OK() bool {
+	return len(r.Missing) == 0 && len(r.Extra) == 0 && len(r.Corrupt) == 0
+}
+
+func (r *VerifyResult) Error() string {
+	const maxNames = 10
+	problems := []string{}
+	for _, p := range []struct {
+		kind  string
+		names []string
+	}{{"missing", r.Missing}, {"extra", r.Extra}, {"corrupt", r.Corrupt}} {
+		if len(p.names) == 0 {
+			continue
+		}
+		names := p.names
+		if len(names) > maxNames {
+			names = append(names[:maxNames:maxNames], fmt.Sprintf("and %d more", len(p.names)-maxNames))
+		}
+		problems = append(problems, fmt.Sprintf("%s %s", p.kind, strings.Join(names, ", ")))
+	}
+	return fmt.Sprintf("%s backup '%s' is damaged: %s", r.Location, r.BackupName, strings.Join(problems, "; "))
+}
+
+// verifyProblems - collect problems without duplicates, a file can be reported by checksums.txt and by manifest
+type verifyProblems struct {
+	missing map[string]bool
+	extra   map[string]bool
+	corrupt map[string]bool
+}
+
+func newVerifyProblems() *verifyProblems {
+	return &verifyProblems{
+		missing: map[string]bool{},
+		extra:   map[string]bool{},
+		corrupt: map[string]bool{},
+	}
+}
+
+func sortedKeys(m map[string]bool) []string {
+	result := make([]string, 0, len(m))
+	for k := range m {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (p *verifyProblems) result(backupName, location string, files int) *VerifyResult {
+	return &VerifyResult{
+		BackupName: backupName,
+		Location:   location,
+		Files:      files,
+		Missing:    sortedKeys(p.missing),
+		Extra:      sortedKeys(p.extra),
+		Corrupt:    sortedKeys(p.corrupt),
+	}
+}
+
+// checkManifest - compare files found in backup with files described by manifest
+func (p *verifyProblems) checkManifest(manifest *BackupManifest, files map[string]ManifestFile) {
+	expected := manifest.Files()
+	for name, file := range expected {
+		actual, ok := files[name]
+		if !ok {
+			p.missing[name] = true
+			continue
+		}
+		if actual.Size != file.Size || actual.Checksum != file.Checksum {
+			p.corrupt[name] = true
+		}
+	}
+	for name := range files {
+		if _, ok := expected[name]; !ok {
+			p.extra[name] = true
+		}
+	}
+}
+
+// VerifyLocal - check files of local backup against checksums.txt of every data part and against backup manifest
+func VerifyLocal(config Config, backupName string) (*VerifyResult, error) {
+	if err := ValidateBackupName(backupName); err != nil {
+		return nil, err
+	}
+	dataPath := getDataPath(config)
+	if dataPath == "" {
+		return nil, ErrUnknownClickhouseDataPath
+	}
+	backupPath := path.Join(dataPath, "backup", backupName)
+	if _, err := os.Stat(backupPath); err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("'%s' is not found on local storage", backupName)
+		}
+		return nil, err
+	}
+	files := map[string]ManifestFile{}
+	cityHashes := map[string]cityUint128{}
+	partPaths := []string{}
+	if err := filepath.Walk(backupPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		relativePath := strings.TrimPrefix(strings.TrimPrefix(filepath.ToSlash(filePath), backupPath), "/")
+		if relativePath == ManifestFileName {
+			return nil
+		}
+		if info.Name() == ChecksumsFileName {
+			partPaths = append(partPaths, path.Dir(relativePath))
+		}
+		f, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		xh := xxhash.New()
+		ch := newCityHashWriter()
+		size, err := io.Copy(io.MultiWriter(xh, ch), f)
+		if err != nil {
+			return fmt.Errorf("can't read '%s' with %v", filePath, err)
+		}
+		files[relativePath] = ManifestFile{
+			Name:     relativePath,
+			Size:     size,
+			Checksum: hex.EncodeToString(xh.Sum(nil)),
+		}
+		cityHashes[relativePath] = ch.Sum()
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	problems := newVerifyProblems()
+	for _, partPath := range partPaths {
+		checksums, err := readPartChecksumsFile(path.Join(backupPath, partPath, ChecksumsFileName))
+		if err != nil {
+			problems.corrupt[path.Join(partPath, ChecksumsFileName)] = true
+			continue
+		}
+		for name, expected := range checksums {
+			filePath := path.Join(partPath, name)
+			actual, ok := files[filePath]
+			if !ok {
+				// projections are listed in checksums.txt of parent part as directories
+				if info, err := os.Stat(path.Join(backupPath, filePath)); err == nil && info.IsDir() {
+					continue
+				}
+				problems.missing[filePath] = true
+				continue
+			}
+			if uint64(actual.Size) != expected.FileSize || cityHashes[filePath] != expected.FileHash {
+				problems.corrupt[filePath] = true
+			}
+		}
+	}
+
+	manifest, err := readLocalManifest(backupPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if manifest != nil {
+		problems.checkManifest(manifest, files)
+	}
+	return problems.result(backupName, "local", len(files)), nil
+}
+
+// VerifyRemote - stream archive of remote backup without extracting and check every entry against backup manifest
+func VerifyRemote(config Config, backupName string) (*VerifyResult, error) {
+	if err := ValidateBackupName(backupName); err != nil {
+		return nil, err
+	}
+	bd, err := NewBackupDestination(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := bd.Connect(); err != nil {
+		return nil, err
+	}
+	manifest, err := bd.GetManifest(backupName)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, fmt.Errorf("'%s' has no %s on remote storage and can't be verified", backupName, ManifestFileName)
+		}
+		return nil, err
+	}
+	compressionFormat := manifest.CompressionFormat
+	archives := []string{}
+	var totalBytes int64
+	if len(manifest.Archives) > 0 {
+		for _, archive := range manifest.Archives {
+			archiveName := path.Join(bd.path, backupName, archive.Name)
+			file, err := bd.GetFile(archiveName)
+			if err != nil {
+				if err == ErrNotFound {
+					return nil, fmt.Errorf("'%s' is not found on remote storage", archiveName)
+				}
+				return nil, err
+			}
+			totalBytes += file.Size()
+			archives = append(archives, archiveName)
+		}
+	} else {
+		archive, format, err := bd.findArchive(backupName)
+		if err != nil {
+			if err == ErrNotFound {
+				return nil, fmt.Errorf("archive of '%s' is not found on remote storage", backupName)
+			}
+			return nil, err
+		}
+		compressionFormat = format
+		totalBytes = archive.Size()
+		archives = append(archives, path.Join(bd.path, fmt.Sprintf("%s.%s", backupName, getExtension(format))))
+	}
+	bar := StartNewByteBar(!bd.disableProgressBar, totalBytes)
+	files := map[string]ManifestFile{}
+	var metafile MetaFile
+	var mu sync.Mutex
+	if err := runParallel(bd.downloadConcurrency, len(archives), func(i int, cancel <-chan struct{}) error {
+		archiveFiles, archiveMetafile, err := bd.hashArchive(archives[i], compressionFormat, bar, cancel)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for name, file := range archiveFiles {
+			files[name] = file
+		}
+		if archiveMetafile.RequiredBackup != "" {
+			metafile.RequiredBackup = archiveMetafile.RequiredBackup
+		}
+		metafile.Hardlinks = append(metafile.Hardlinks, archiveMetafile.Hardlinks...)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	bar.Finish()
+
+	problems := newVerifyProblems()
+	if len(metafile.Hardlinks) > 0 {
+		// files of incremental backup which are stored in required backup
+		required, err := bd.GetManifest(metafile.RequiredBackup)
+		if err != nil && err != ErrNotFound {
+			return nil, err
+		}
+		// required backup uploaded by old version has no manifest, only its presence can be checked
+		requiredFiles := manifest.Files()
+		requiredExists := required != nil
+		if required != nil {
+			requiredFiles = required.Files()
+		} else {
+			backupList, err := bd.BackupList()
+			if err != nil {
+				return nil, err
+			}
+			for _, backup := range backupList {
+				requiredExists = requiredExists || backup.Name == metafile.RequiredBackup
+			}
+		}
+		for _, hardlink := range metafile.Hardlinks {
+			if file, ok := requiredFiles[hardlink]; ok && requiredExists {
+				files[hardlink] = file
+			} else {
+				problems.missing[hardlink] = true
+			}
+		}
+	}
+	problems.checkManifest(manifest, files)
+	return problems.result(backupName, "remote", len(files)), nil
+}
+
+// hashArchive - stream archive without extracting and return size and checksum of every entry
+func (bd *BackupDestination) hashArchive(archiveName, compressionFormat string, bar *Bar, cancel <-chan struct{}) (map[string]ManifestFile, MetaFile, error) {
+	files := map[string]ManifestFile{}
+	var metafile MetaFile
+	reader, err := bd.GetFileReader(archiveName)
+	if err != nil {
+		return nil, metafile, err
+	}
+	defer reader.Close()
+	z, err := getArchiveReader(compressionFormat, bd.compressionConcurrency)
+	if err != nil {
+		return nil, metafile, err
+	}
+	archiveReader, err := bd.encryption.decryptReader(bar.NewProxyReader(&cancelReader{Reader: reader, cancel: cancel}))
+	if err != nil {
+		return nil, metafile, err
+	}
+	if err := z.Open(archiveReader, 0); err != nil {
+		return nil, metafile, err
+	}
+	defer z.Close()
+	for {
+		file, err := z.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, metafile, fmt.Errorf("can't read '%s' with %v", archiveName, err)
+		}
+		header, ok := file.Header.(*tar.Header)
+		if !ok {
+			return nil, metafile, fmt.Errorf("expected header to be *tar.Header but was %T", file.Header)
+		}
+		switch header.Name {
+		case MetaFileName:
+			content, err := ioutil.ReadAll(file)
+			if err != nil {
+				return nil, metafile, fmt.Errorf("can't read %s", MetaFileName)
+			}
+			if err := json.Unmarshal(content, &metafile); err != nil {
+				return nil, metafile, err
+			}
+		case ManifestFileName:
+			// manifest in archive is written before upload, the uploaded one is authoritative
+		default:
+			size, checksum, err := hashReader(file)
+			if err != nil {
+				return nil, metafile, fmt.Errorf("can't read '%s' from '%s' with %v", header.Name, archiveName, err)
+			}
+			files[header.Name] = ManifestFile{Name: header.Name, Size: size, Checksum: checksum}
+		}
+		file.Close()
+	}
+	// the rest of stream is read so integrity of OpenPGP message is checked at its end
+	if _, err := io.Copy(ioutil.Discard, archiveReader); err != nil {
+		return nil, metafile, fmt.Errorf("can't read '%s' with %v", archiveName, err)
+	}
+	return files, metafile, nil
+}
+
+// Verify - check integrity of local or remote backup and print report
+// returns *VerifyResult as error if backup has problems
+func Verify(config Config, location string, backupName string, outputFormat string, w io.Writer) error {
+	var result *VerifyResult
+	var err error
+	switch location {
+	case "local":
+		result, err = VerifyLocal(config, backupName)
+	case "remote":
+		result, err = VerifyRemote(config, backupName)
+	default:
+		return fmt.Errorf("unknown location '%s', use 'local' or 'remote'", location)
+	}
+	if err != nil {
+		return err
+	}
+	if outputFormat == OutputFormatJSON {
+		if err := printJSON(w, result); err != nil {
+			return err
+		}
+	} else {
+		for _, name := range result.Missing {
+			fmt.Fprintf(w, "missing\t%s\n", name)
+		}
+		for _, name := range result.Extra {
+			fmt.Fprintf(w, "extra\t%s\n", name)
+		}
+		for _, name := range result.Corrupt {
+			fmt.Fprintf(w, "corrupt\t%s\n", name)
+		}
+		if result.OK() {
+			fmt.Fprintf(w, "%s backup '%s' is OK, %d files checked\n", location, backupName, result.Files)
+		}
+	}
+	if !result.OK() {
+		return result
+	}
+	return nil
+}
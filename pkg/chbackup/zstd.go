@@ -0,0 +1,77 @@
+package chbackup
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/mholt/archiver"
+)
+
+// tarZstd - tar archive compressed by zstd, archiver.TarZstd doesn't allow to set level and concurrency of encoder
+type tarZstd struct {
+	*archiver.Tar
+	CompressionLevel int
+	Concurrency      int
+	encoder          *zstd.Encoder
+	decoder          *zstd.Decoder
+}
+
+func newTarZstd(level, concurrency int) *tarZstd {
+	if concurrency < 1 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+	return &tarZstd{
+		Tar:              archiver.NewTar(),
+		CompressionLevel: level,
+		Concurrency:      concurrency,
+	}
+}
+
+// Create - open zstd stream to out and start tar archive inside it
+func (t *tarZstd) Create(out io.Writer) error {
+	encoder, err := zstd.NewWriter(out,
+		zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(t.CompressionLevel)),
+		zstd.WithEncoderConcurrency(t.Concurrency),
+	)
+	if err != nil {
+		return fmt.Errorf("can't create zstd encoder with %v", err)
+	}
+	if err := t.Tar.Create(encoder); err != nil {
+		encoder.Close()
+		return err
+	}
+	t.encoder = encoder
+	return nil
+}
+
+// Open - read tar archive from zstd stream
+func (t *tarZstd) Open(in io.Reader, size int64) error {
+	decoder, err := zstd.NewReader(in, zstd.WithDecoderConcurrency(t.Concurrency))
+	if err != nil {
+		return fmt.Errorf("can't create zstd decoder with %v", err)
+	}
+	if err := t.Tar.Open(decoder, size); err != nil {
+		decoder.Close()
+		return err
+	}
+	t.decoder = decoder
+	return nil
+}
+
+// Close - finish tar archive first, then flush the last zstd frame
+func (t *tarZstd) Close() error {
+	err := t.Tar.Close()
+	if t.encoder != nil {
+		if encErr := t.encoder.Close(); encErr != nil && err == nil {
+			err = encErr
+		}
+		t.encoder = nil
+	}
+	if t.decoder != nil {
+		t.decoder.Close()
+		t.decoder = nil
+	}
+	return err
+}
@@ -0,0 +1,60 @@
+package chbackup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMixedCompressionFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clickhouse-backup-zstd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "remote")
+	local := filepath.Join(dir, "local")
+	require.NoError(t, os.MkdirAll(root, os.ModePerm))
+	for _, name := range []string{"gzip", "zstd"} {
+		part := filepath.Join(local, name, "shadow", "db", "t", "all_1_1_0")
+		require.NoError(t, os.MkdirAll(part, os.ModePerm))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(part, "data.bin"), testPattern(100000), 0640))
+	}
+
+	config := DefaultConfig()
+	config.General.RemoteStorage = "fs"
+	config.General.DisableProgressBar = true
+	config.General.CompressionConcurrency = 2
+	config.FS.RootPath = root
+	bd, err := NewBackupDestination(*config)
+	require.NoError(t, err)
+	require.NoError(t, bd.Connect())
+	require.NoError(t, bd.CompressedStreamUpload(filepath.Join(local, "gzip"), "gzip", ""))
+
+	config.FS.CompressionFormat = "zstd"
+	config.FS.CompressionLevel = 3
+	require.NoError(t, validateConfig(config))
+	bd, err = NewBackupDestination(*config)
+	require.NoError(t, err)
+	require.NoError(t, bd.CompressedStreamUpload(filepath.Join(local, "zstd"), "zstd", ""))
+	_, err = os.Stat(filepath.Join(root, "zstd.tar.zst"))
+	assert.NoError(t, err)
+
+	backups, err := bd.BackupList()
+	require.NoError(t, err)
+	formats := map[string]string{}
+	for _, backup := range backups {
+		formats[backup.Name] = backup.CompressionFormat
+	}
+	assert.Equal(t, map[string]string{"gzip": "gzip", "zstd": "zstd"}, formats)
+
+	for _, name := range []string{"gzip", "zstd"} {
+		require.NoError(t, bd.CompressedStreamDownload(name, filepath.Join(dir, "download", name), ""))
+		content, err := ioutil.ReadFile(filepath.Join(dir, "download", name, "shadow", "db", "t", "all_1_1_0", "data.bin"))
+		assert.NoError(t, err)
+		assert.Equal(t, testPattern(100000), content)
+	}
+	assert.Error(t, bd.CompressedStreamDownload("missing", filepath.Join(dir, "download", "missing"), ""))
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/chbackup"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/urfave/cli"
+)
+
+var (
+	httpRequestsSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "clickhouse_backup_http_request_duration_seconds",
+		Help:    "Execution time of each http request",
+		Buckets: []float64{1, 10, 30, 60, 120, 240, 300, 600, 1200, 2400, 3600, 7200, 14400},
+	},
+		[]string{"method", "path", "status"})
+)
+
+// badRequestError - returned by handlers when request parameters are invalid
+type badRequestError struct {
+	error
+}
+
+// apiParams - command options which can be passed in query string or JSON body, names are the same as CLI flags
+type apiParams struct {
+	Table    string `json:"tables"`
+	Schema   bool   `json:"schema"`
+	Data     bool   `json:"data"`
+	DiffFrom string `json:"diff-from"`
+	Resume   bool   `json:"resume"`
+}
+
+func getParams(r *http.Request) (apiParams, error) {
+	params := apiParams{Resume: true}
+	if r.Body != nil {
+		body := struct {
+			apiParams
+			// Table - 'table' is accepted as well as 'tables' for compatibility
+			Table string `json:"table"`
+		}{apiParams: params}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+			return params, badRequestError{fmt.Errorf("can't parse request body with %v", err)}
+		}
+		params = body.apiParams
+		if body.Table != "" {
+			params.Table = body.Table
+		}
+	}
+	query := r.URL.Query()
+	for _, name := range []string{"table", "tables", "t"} {
+		if value, ok := query[name]; ok {
+			params.Table = strings.Join(value, ",")
+		}
+	}
+	for _, flag := range []struct {
+		names []string
+		value *bool
+	}{
+		{[]string{"schema", "s"}, &params.Schema},
+		{[]string{"data", "d"}, &params.Data},
+		{[]string{"resume"}, &params.Resume},
+	} {
+		for _, name := range flag.names {
+			value, ok := query[name]
+			if !ok {
+				continue
+			}
+			*flag.value = true
+			if value[0] != "" {
+				b, err := strconv.ParseBool(value[0])
+				if err != nil {
+					return params, badRequestError{fmt.Errorf("invalid value '%s' of '%s' parameter", value[0], name)}
+				}
+				*flag.value = b
+			}
+		}
+	}
+	if value := query.Get("diff-from"); value != "" {
+		params.DiffFrom = value
+	}
+	if err := chbackup.ValidateTablePattern(params.Table); err != nil {
+		return params, badRequestError{err}
+	}
+	if err := chbackup.ValidateBackupName(params.DiffFrom); err != nil {
+		return params, badRequestError{err}
+	}
+	return params, nil
+}
+
+// getBackupName - return validated backupName parameter from request path
+func getBackupName(ps httprouter.Params) (string, error) {
+	backupName := ps.ByName("backupName")
+	if err := chbackup.ValidateBackupName(backupName); err != nil {
+		return "", badRequestError{err}
+	}
+	return backupName, nil
+}
+
+type apiHandler func(c *cli.Context, w http.ResponseWriter, r *http.Request, ps httprouter.Params) error
+
+// jobHandler - validates request and returns the function which will be executed by job queue
+type jobHandler func(c *cli.Context, r *http.Request, ps httprouter.Params) (func() error, error)
+
+// jobResultHandler - same as jobHandler, the value returned by the function is kept as result of the job
+type jobResultHandler func(c *cli.Context, r *http.Request, ps httprouter.Params) (func() (interface{}, error), error)
+
+func attachConfig(h apiHandler, c *cli.Context, name string, method string) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		start := time.Now()
+		outputFormat, err := getOutputFormat(r)
+		if err == nil {
+			if outputFormat == chbackup.OutputFormatJSON {
+				w.Header().Set("Content-Type", "application/json")
+			}
+			err = h(c, w, r, ps)
+		}
+		t := time.Now()
+		elapsed := t.Sub(start)
+
+		if err != nil {
+			status := http.StatusInternalServerError
+			if _, ok := err.(badRequestError); ok {
+				status = http.StatusBadRequest
+			}
+			if err == chbackup.ErrJobQueueFull {
+				status = http.StatusServiceUnavailable
+			}
+			str := err.Error()
+			if outputFormat == chbackup.OutputFormatJSON {
+				writeJSON(w, status, map[string]string{"error": str})
+			} else {
+				http.Error(w, str, status)
+			}
+			httpRequestsSeconds.With(prometheus.Labels{"status": strconv.Itoa(status), "method": method, "path": name}).Observe(elapsed.Seconds())
+			return
+		}
+
+		httpRequestsSeconds.With(prometheus.Labels{"status": "200", "method": method, "path": name}).Observe(elapsed.Seconds())
+	}
+}
+
+// getOutputFormat - return 'json' if it was requested by 'format' parameter or Accept header
+// unknown 'format' is rejected before command is executed or queued
+func getOutputFormat(r *http.Request) (string, error) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		if err := chbackup.ValidateOutputFormat(format); err != nil {
+			return "", badRequestError{err}
+		}
+		return format, nil
+	}
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		return chbackup.OutputFormatJSON, nil
+	}
+	return chbackup.OutputFormatText, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
+
+func create(c *cli.Context, r *http.Request, ps httprouter.Params) (func() error, error) {
+	config := getConfig(c)
+	backupName, err := getBackupName(ps)
+	if err != nil {
+		return nil, err
+	}
+	params, err := getParams(r)
+	if err != nil {
+		return nil, err
+	}
+	return func() error {
+		return chbackup.CreateBackup(*config, backupName, params.Table, false)
+	}, nil
+}
+
+func createRemote(c *cli.Context, r *http.Request, ps httprouter.Params) (func() error, error) {
+	config := getConfig(c)
+	backupName, err := getBackupName(ps)
+	if err != nil {
+		return nil, err
+	}
+	params, err := getParams(r)
+	if err != nil {
+		return nil, err
+	}
+	return func() error {
+		return chbackup.CreateRemote(*config, backupName, params.Table, params.DiffFrom)
+	}, nil
+}
+
+func restore(c *cli.Context, r *http.Request, ps httprouter.Params) (func() error, error) {
+	config := getConfig(c)
+	backupName, err := getBackupName(ps)
+	if err != nil {
+		return nil, err
+	}
+	params, err := getParams(r)
+	if err != nil {
+		return nil, err
+	}
+	return func() error {
+		return chbackup.Restore(*config, backupName, params.Table, params.Schema, params.Data)
+	}, nil
+}
+
+func restoreRemote(c *cli.Context, r *http.Request, ps httprouter.Params) (func() error, error) {
+	config := getConfig(c)
+	backupName, err := getBackupName(ps)
+	if err != nil {
+		return nil, err
+	}
+	params, err := getParams(r)
+	if err != nil {
+		return nil, err
+	}
+	return func() error {
+		return chbackup.RestoreRemote(*config, backupName, params.Table, params.Schema, params.Data)
+	}, nil
+}
+
+func delete(c *cli.Context, r *http.Request, ps httprouter.Params) (func() error, error) {
+	serverType := ps.ByName("serverType")
+	backupName, err := getBackupName(ps)
+	if err != nil {
+		return nil, err
+	}
+	if serverType != "local" && serverType != "remote" {
+		return nil, badRequestError{fmt.Errorf("unknown backup location '%s', should be 'local' or 'remote'", serverType)}
+	}
+	return func() error {
+		return deleteBackup(c, serverType, backupName)
+	}, nil
+}
+
+func upload(c *cli.Context, r *http.Request, ps httprouter.Params) (func() error, error) {
+	config := getConfig(c)
+	backupName, err := getBackupName(ps)
+	if err != nil {
+		return nil, err
+	}
+	params, err := getParams(r)
+	if err != nil {
+		return nil, err
+	}
+	if diffFrom := ps.ByName("diffFrom"); diffFrom != "" {
+		if err := chbackup.ValidateBackupName(diffFrom); err != nil {
+			return nil, badRequestError{err}
+		}
+		params.DiffFrom = diffFrom
+	}
+	if params.DiffFrom == backupName {
+		return nil, badRequestError{fmt.Errorf("backup '%s' can't be uploaded as diff from itself", backupName)}
+	}
+	return func() error {
+		return chbackup.Upload(*config, backupName, params.DiffFrom, params.Resume)
+	}, nil
+}
+
+func download(c *cli.Context, r *http.Request, ps httprouter.Params) (func() error, error) {
+	config := getConfig(c)
+	backupName, err := getBackupName(ps)
+	if err != nil {
+		return nil, err
+	}
+	params, err := getParams(r)
+	if err != nil {
+		return nil, err
+	}
+	return func() error {
+		return chbackup.Download(*config, backupName, params.Table, params.Resume)
+	}, nil
+}
+
+func freeze(c *cli.Context, r *http.Request, ps httprouter.Params) (func() error, error) {
+	config := getConfig(c)
+	params, err := getParams(r)
+	if err != nil {
+		return nil, err
+	}
+	return func() error {
+		return chbackup.Freeze(*config, params.Table)
+	}, nil
+}
+
+func clean(c *cli.Context, r *http.Request, ps httprouter.Params) (func() error, error) {
+	config := getConfig(c)
+	return func() error {
+		return chbackup.Clean(*config)
+	}, nil
+}
+
+func verify(c *cli.Context, r *http.Request, ps httprouter.Params) (func() (interface{}, error), error) {
+	config := getConfig(c)
+	serverType := ps.ByName("serverType")
+	backupName, err := getBackupName(ps)
+	if err != nil {
+		return nil, err
+	}
+	if serverType != "local" && serverType != "remote" {
+		return nil, badRequestError{fmt.Errorf("unknown backup location '%s', should be 'local' or 'remote'", serverType)}
+	}
+	return func() (interface{}, error) {
+		verifyBackup := chbackup.VerifyLocal
+		if serverType == "remote" {
+			verifyBackup = chbackup.VerifyRemote
+		}
+		result, err := verifyBackup(*config, backupName)
+		if err != nil {
+			return nil, err
+		}
+		if !result.OK() {
+			return result, result
+		}
+		return result, nil
+	}, nil
+}
+
+func tables(c *cli.Context, w http.ResponseWriter, r *http.Request, ps httprouter.Params) error {
+	outputFormat, err := getOutputFormat(r)
+	if err != nil {
+		return err
+	}
+	return chbackup.PrintTables(*getConfig(c), outputFormat, w)
+}
+
+func isClean(c *cli.Context, w http.ResponseWriter, r *http.Request, ps httprouter.Params) error {
+	outputFormat, err := getOutputFormat(r)
+	if err != nil {
+		return err
+	}
+	return chbackup.IsClean(*getConfig(c), outputFormat, w)
+}
+
+func list(c *cli.Context, w http.ResponseWriter, r *http.Request, ps httprouter.Params) error {
+	var serverType = ps.ByName("serverType")
+	var format = ps.ByName("format")
+	if serverType != "local" && serverType != "remote" && serverType != "all" {
+		return badRequestError{fmt.Errorf("unknown backup location '%s', should be 'local', 'remote' or 'all'", serverType)}
+	}
+	outputFormat, err := getOutputFormat(r)
+	if err != nil {
+		return err
+	}
+	return listBackups(c, serverType, format, outputFormat, w)
+}
+
+func listJobs(jobs *chbackup.JobQueue) apiHandler {
+	return func(c *cli.Context, w http.ResponseWriter, r *http.Request, ps httprouter.Params) error {
+		return writeJSON(w, http.StatusOK, jobs.List())
+	}
+}
+
+func getJob(jobs *chbackup.JobQueue) apiHandler {
+	return func(c *cli.Context, w http.ResponseWriter, r *http.Request, ps httprouter.Params) error {
+		job, ok := jobs.Get(ps.ByName("id"))
+		if !ok {
+			http.Error(w, fmt.Sprintf("job '%s' not found", ps.ByName("id")), http.StatusNotFound)
+			return nil
+		}
+		return writeJSON(w, http.StatusOK, job)
+	}
+}
+
+func lock(c *cli.Context, w http.ResponseWriter, r *http.Request, ps httprouter.Params) error {
+	holder, err := chbackup.GetLockHolder(*getConfig(c))
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, struct {
+		Locked bool `json:"locked"`
+		*chbackup.LockInfo
+	}{holder != nil, holder})
+}
+
+func metrics(h http.Handler) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		h.ServeHTTP(w, r)
+	}
+}
+
+func bindGet(router *httprouter.Router, c *cli.Context, name string, h apiHandler) {
+	// initialise the historgram to 0 count
+	httpRequestsSeconds.With(prometheus.Labels{"status": "200", "method": "GET", "path": name})
+	httpRequestsSeconds.With(prometheus.Labels{"status": "500", "method": "GET", "path": name})
+	router.GET(name, attachConfig(h, c, name, "GET"))
+}
+
+func bindPost(router *httprouter.Router, c *cli.Context, name string, h apiHandler) {
+	httpRequestsSeconds.With(prometheus.Labels{"status": "200", "method": "POST", "path": name})
+	httpRequestsSeconds.With(prometheus.Labels{"status": "500", "method": "POST", "path": name})
+	router.POST(name, attachConfig(h, c, name, "POST"))
+}
+
+// bindJob - register POST handler which puts command to the job queue and responds with the job state immediately
+// Job holds the operation lock while running, so it's used for commands which change state
+func bindJob(router *httprouter.Router, c *cli.Context, jobs *chbackup.JobQueue, name string, h jobHandler) {
+	operation := strings.Split(strings.Trim(name, "/"), "/")[0]
+	bindResultJob(router, c, jobs, name, func(c *cli.Context, r *http.Request, ps httprouter.Params) (func() (interface{}, error), error) {
+		run, err := h(c, r, ps)
+		if err != nil {
+			return nil, err
+		}
+		config := getConfig(c)
+		return func() (interface{}, error) {
+			return nil, runLocked(config, operation, run)
+		}, nil
+	})
+}
+
+// bindResultJob - same as bindJob for read-only commands, job doesn't take the operation lock
+// result of the command is returned by 'GET /jobs/:id'
+func bindResultJob(router *httprouter.Router, c *cli.Context, jobs *chbackup.JobQueue, name string, h jobResultHandler) {
+	bindPost(router, c, name, func(c *cli.Context, w http.ResponseWriter, r *http.Request, ps httprouter.Params) error {
+		run, err := h(c, r, ps)
+		if err != nil {
+			return err
+		}
+		job, err := jobs.AddWithResult(strings.Trim(r.URL.Path, "/"), run)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusAccepted, job)
+	})
+}
+
+func getConfigAndRun(c *cli.Context) error {
+	config := getConfig(c)
+	jobs := chbackup.NewJobQueue(config.General.JobsHistory)
+	router := httprouter.New()
+	bindJob(router, c, jobs, "/create/:backupName", create)
+	bindJob(router, c, jobs, "/create-remote/:backupName", createRemote)
+	bindJob(router, c, jobs, "/upload/:backupName", upload)
+	bindJob(router, c, jobs, "/download/:backupName", download)
+	bindJob(router, c, jobs, "/upload/:backupName/:diffFrom", upload)
+	bindJob(router, c, jobs, "/freeze", freeze)
+	bindGet(router, c, "/tables", tables)
+	bindGet(router, c, "/list/:serverType/:format", list)
+	bindGet(router, c, "/list/:serverType", list)
+	bindJob(router, c, jobs, "/restore/:backupName", restore)
+	bindJob(router, c, jobs, "/restore-remote/:backupName", restoreRemote)
+	bindJob(router, c, jobs, "/delete/:serverType/:backupName", delete)
+	bindJob(router, c, jobs, "/clean", clean)
+	bindResultJob(router, c, jobs, "/verify/:serverType/:backupName", verify)
+	bindGet(router, c, "/is-clean", isClean)
+	bindGet(router, c, "/jobs", listJobs(jobs))
+	bindGet(router, c, "/jobs/:id", getJob(jobs))
+	bindGet(router, c, "/lock", lock)
+	router.GET("/metrics", metrics(promhttp.Handler()))
+
+	return http.ListenAndServe(fmt.Sprintf(":%d", config.General.ShardBackupPort), router)
+}